@@ -11,7 +11,6 @@ package app
 import (
     "gopkg.in/kataras/iris.v6"
     "gopkg.in/kataras/iris.v6/adaptors/httprouter"
-    "gopkg.in/kataras/iris.v6/adaptors/sessions"
     "log"
     "os"
     "strconv"
@@ -42,13 +41,6 @@ func init() {
     App = iris.New()
     App.Adapt(httprouter.New())
     App.Adapt(iris.DevLogger())
-    mySessions := sessions.New(sessions.Config{
-        Cookie: "spacedocksid",
-        Expires: 0,
-        CookieLength: 32,
-        DisableSubdomainPersistence: false,
-    })
-    App.Adapt(mySessions)
     App.Config.Gzip = true
     App.Config.DisableBodyConsumptionOnUnmarshal = true
 }
@@ -57,6 +49,21 @@ func init() {
  Entrypoint wrapper that is called from the main() function
  */
 func Run() {
+    // Bring the database schema up to date
+    if !Settings.ManualMigrations {
+        if err := Migrate(); err != nil {
+            log.Fatalf("* %s", err)
+        }
+    } else if pending, err := PendingMigrations(); err != nil {
+        log.Fatalf("* Failed to read the schema migrations: %s", err)
+    } else if len(pending) > 0 {
+        log.Printf("* There are %d pending schema migrations, run \"sdb db migrate\" to apply them", len(pending))
+    }
+
+    // Start the background jobs
+    log.Print("* Starting background jobs")
+    StartJobs()
+
     // Start listening
     App.Listen(Settings.Host + ":" + strconv.Itoa(Settings.Port))
 }
\ No newline at end of file
@@ -15,6 +15,7 @@ import (
     _ "github.com/jinzhu/gorm/dialects/postgres"
     "log"
     "sync"
+    "time"
 )
 
 /*
@@ -22,13 +23,6 @@ import (
  */
 var Database *gorm.DB
 
-/*
- Counter for recursive reference fetching
- */
-var DBRecursion map[uint64]int = map[uint64]int{}
-var DBRecursionMax int = 2
-var DBRecursionLock sync.RWMutex = sync.RWMutex{}
-
 /*
  Establishes the connection to the database
  */
@@ -40,15 +34,145 @@ func LoadDatabase() {
     Database = db
     log.Print("* Database connection successfull")
     Database.LogMode(Settings.Debug)
+    registerQueryStats()
+}
+
+/*
+ Counts the SQL statements that were run through a database handle, and how long they took.
+ Budget is the number of statements the handle is expected to need, 0 if there is none
+ */
+type QueryStats struct {
+    Budget   int
+    count    int
+    exempt   int
+    depth    int
+    duration time.Duration
+    lock     sync.Mutex
+}
+
+func (stats *QueryStats) record(duration time.Duration) {
+    stats.lock.Lock()
+    stats.count += 1
+    stats.duration += duration
+    stats.lock.Unlock()
+}
+
+/*
+ Returns the number of statements and their total time
+ */
+func (stats *QueryStats) Totals() (int, time.Duration) {
+    stats.lock.Lock()
+    defer stats.lock.Unlock()
+    return stats.count, stats.duration
+}
+
+/*
+ Runs a function whose statements are counted, but not charged against the budget, like the ones that authenticate a request
+ */
+func (stats *QueryStats) Exempt(fn func()) {
+    stats.lock.Lock()
+    stats.depth += 1
+    before := stats.count
+    stats.lock.Unlock()
+    defer func() {
+        stats.lock.Lock()
+        stats.depth -= 1
+        if stats.depth == 0 {
+            stats.exempt += stats.count - before
+        }
+        stats.lock.Unlock()
+    }()
+    fn()
+}
+
+/*
+ Returns the number of statements that are charged against the budget
+ */
+func (stats *QueryStats) Charged() int {
+    stats.lock.Lock()
+    defer stats.lock.Unlock()
+    return stats.count - stats.exempt
 }
 
 /*
- Creates a table only if it doesn't exist
+ Returns a database handle that counts its statements, including the ones for loading relations
  */
-func CreateTable(models interface{}) {
-    if !Database.HasTable(models) {
-        Database.CreateTable(models)
+func TrackQueries(db *gorm.DB, stats *QueryStats) *gorm.DB {
+    return db.Set("spacedock:stats", stats)
+}
+
+func registerQueryStats() {
+    start := func(scope *gorm.Scope) {
+        scope.InstanceSet("spacedock:started", time.Now())
+    }
+    stop := func(scope *gorm.Scope) {
+        stats, ok := scope.Get("spacedock:stats")
+        if !ok {
+            return
+        }
+        if started, ok := scope.InstanceGet("spacedock:started"); ok {
+            stats.(*QueryStats).record(time.Since(started.(time.Time)))
+        }
+    }
+    callbacks := Database.Callback()
+    callbacks.Query().Before("gorm:query").Register("spacedock:query_start", start)
+    callbacks.Query().After("gorm:query").Register("spacedock:query_stop", stop)
+    callbacks.RowQuery().Before("gorm:row_query").Register("spacedock:row_query_start", start)
+    callbacks.RowQuery().After("gorm:row_query").Register("spacedock:row_query_stop", stop)
+    callbacks.Create().Before("gorm:create").Register("spacedock:create_start", start)
+    callbacks.Create().After("gorm:create").Register("spacedock:create_stop", stop)
+    callbacks.Update().Before("gorm:update").Register("spacedock:update_start", start)
+    callbacks.Update().After("gorm:update").Register("spacedock:update_stop", stop)
+    callbacks.Delete().Before("gorm:delete").Register("spacedock:delete_start", start)
+    callbacks.Delete().After("gorm:delete").Register("spacedock:delete_stop", stop)
+}
+
+/*
+ A set of changes that is written to the database as a whole. Everything that isn't stored in the database,
+ like uploaded files, can register a cleanup that undoes it if the changes are rolled back
+ */
+type UnitOfWork struct {
+    DB       *gorm.DB
+    cleanups []func()
+}
+
+/*
+ Registers a function that is called if the changes are rolled back
+ */
+func (work *UnitOfWork) OnRollback(cleanup func()) {
+    work.cleanups = append(work.cleanups, cleanup)
+}
+
+func (work *UnitOfWork) rollback() {
+    work.DB.Rollback()
+    for i := len(work.cleanups) - 1; i >= 0; i-- {
+        work.cleanups[i]()
+    }
+}
+
+/*
+ Runs the callback inside of a database transaction. The changes are committed if it returns nil, and rolled back
+ if it returns an error or panics
+ */
+func Transaction(callback func(work *UnitOfWork) error) (err error) {
+    work := &UnitOfWork{DB: Database.Begin()}
+    if work.DB.Error != nil {
+        return work.DB.Error
+    }
+    defer func() {
+        if r := recover(); r != nil {
+            work.rollback()
+            panic(r)
+        }
+    }()
+    if err = callback(work); err != nil {
+        work.rollback()
+        return err
+    }
+    if err = work.DB.Commit().Error; err != nil {
+        work.rollback()
     }
+    return err
 }
 
 func NoAssociations(callback func()) {
@@ -0,0 +1,55 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package app
+
+import (
+    "log"
+    "time"
+)
+
+/*
+ A task that is executed periodically while the webserver is running
+ */
+type Job struct {
+    Name     string
+    Interval time.Duration
+    Run      func()
+}
+
+var jobs []Job
+
+/*
+ Registers a function that should be called every interval. Jobs are started by Run()
+ */
+func RegisterJob(name string, interval time.Duration, run func()) {
+    jobs = append(jobs, Job{Name: name, Interval: interval, Run: run})
+}
+
+/*
+ Starts a goroutine for every registered job
+ */
+func StartJobs() {
+    for _,element := range jobs {
+        go func(job Job) {
+            ticker := time.NewTicker(job.Interval)
+            for range ticker.C {
+                runJob(job)
+            }
+        }(element)
+    }
+}
+
+func runJob(job Job) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Printf("* Job %s failed: %v", job.Name, r)
+        }
+    }()
+    job.Run()
+}
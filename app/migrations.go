@@ -0,0 +1,226 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package app
+
+import (
+    "github.com/jinzhu/gorm"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "time"
+)
+
+/*
+ A versioned change of the database schema. Versions are applied in ascending order, so a released version must never be changed or reused.
+ Down undoes Up, migrations without it can't be rolled back
+ */
+type Migration struct {
+    Version int
+    Name    string
+    Up      func(db *gorm.DB) error
+    Down    func(db *gorm.DB) error
+}
+
+/*
+ A migration that was applied to the database
+ */
+type SchemaMigration struct {
+    ID        uint `gorm:"primary_key"`
+    Version   int `gorm:"unique_index;not null"`
+    Name      string `gorm:"size:256"`
+    AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+    return "schema_migrations"
+}
+
+/*
+ The state of a migration, for displaying it. Known is false if the database contains a migration this version of the backend doesn't have
+ */
+type MigrationState struct {
+    Version   int
+    Name      string
+    Applied   bool
+    AppliedAt time.Time
+    Known     bool
+}
+
+var migrations = map[int]Migration{}
+
+/*
+ Registers a migration. They are applied by Migrate(), which happens on startup unless manual-migrations is enabled
+ */
+func RegisterMigration(version int, name string, up func(db *gorm.DB) error, down func(db *gorm.DB) error) {
+    if existing, ok := migrations[version]; ok {
+        log.Fatalf("* Migration %d (%s) uses the same version as %s", version, name, existing.Name)
+    }
+    migrations[version] = Migration{Version: version, Name: name, Up: up, Down: down}
+}
+
+func sortedMigrations() []Migration {
+    value := []Migration{}
+    for _,element := range migrations {
+        value = append(value, element)
+    }
+    sort.Slice(value, func(i, j int) bool {
+        return value[i].Version < value[j].Version
+    })
+    return value
+}
+
+/*
+ Returns the applied migrations, ordered by their version
+ */
+func appliedMigrations() ([]SchemaMigration, error) {
+    if !Database.HasTable(&SchemaMigration{}) {
+        if err := Database.CreateTable(&SchemaMigration{}).Error; err != nil {
+            return nil, err
+        }
+    }
+    applied := []SchemaMigration{}
+    err := Database.Order("version asc").Find(&applied).Error
+    return applied, err
+}
+
+/*
+ Returns the registered migrations that weren't applied yet
+ */
+func PendingMigrations() ([]Migration, error) {
+    applied, err := appliedMigrations()
+    if err != nil {
+        return nil, err
+    }
+    done := map[int]bool{}
+    for _,element := range applied {
+        done[element.Version] = true
+    }
+    pending := []Migration{}
+    for _,element := range sortedMigrations() {
+        if !done[element.Version] {
+            pending = append(pending, element)
+        }
+    }
+    return pending, nil
+}
+
+/*
+ Applies all pending migrations. Every migration runs in its own transaction, together with its entry in schema_migrations.
+ MySQL commits schema changes immediately, so a failed migration can leave some of its changes behind there
+ */
+func Migrate() error {
+    pending, err := PendingMigrations()
+    if err != nil {
+        return err
+    }
+    for _,element := range pending {
+        migration := element
+        log.Printf("* Applying migration %d: %s", migration.Version, migration.Name)
+        err := Transaction(func(work *UnitOfWork) error {
+            if err := migration.Up(work.DB); err != nil {
+                return err
+            }
+            return work.DB.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+        })
+        if err != nil {
+            return fmt.Errorf("Migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+        }
+    }
+    return nil
+}
+
+/*
+ Rolls back the given number of migrations, starting with the newest one
+ */
+func Rollback(steps int) error {
+    applied, err := appliedMigrations()
+    if err != nil {
+        return err
+    }
+    for i := len(applied) - 1; i >= 0 && i >= len(applied) - steps; i-- {
+        migration, ok := migrations[applied[i].Version]
+        if !ok {
+            return errors.New("Migration " + strconv.Itoa(applied[i].Version) + " (" + applied[i].Name + ") is unknown to this version of the backend")
+        }
+        if migration.Down == nil {
+            return errors.New("Migration " + strconv.Itoa(migration.Version) + " (" + migration.Name + ") can't be rolled back")
+        }
+        log.Printf("* Rolling back migration %d: %s", migration.Version, migration.Name)
+        err := Transaction(func(work *UnitOfWork) error {
+            if err := migration.Down(work.DB); err != nil {
+                return err
+            }
+            return work.DB.Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error
+        })
+        if err != nil {
+            return fmt.Errorf("Rolling back migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+        }
+    }
+    return nil
+}
+
+/*
+ Returns the state of every registered or applied migration, ordered by their version
+ */
+func MigrationStatus() ([]MigrationState, error) {
+    applied, err := appliedMigrations()
+    if err != nil {
+        return nil, err
+    }
+    states := map[int]*MigrationState{}
+    for _,element := range sortedMigrations() {
+        states[element.Version] = &MigrationState{Version: element.Version, Name: element.Name, Known: true}
+    }
+    for _,element := range applied {
+        state, ok := states[element.Version]
+        if !ok {
+            state = &MigrationState{Version: element.Version, Name: element.Name}
+            states[element.Version] = state
+        }
+        state.Applied = true
+        state.AppliedAt = element.AppliedAt
+    }
+    value := []MigrationState{}
+    for _,element := range states {
+        value = append(value, *element)
+    }
+    sort.Slice(value, func(i, j int) bool {
+        return value[i].Version < value[j].Version
+    })
+    return value, nil
+}
+
+/*
+ Adds the column of a struct field to the table of the model, if it doesn't exist yet. The type comes from the dialect,
+ so the same migration works with postgres, mysql and mssql. Fields that are "not null" need a default to be added to a table with rows
+ */
+func AddColumn(db *gorm.DB, model interface{}, field string) error {
+    scope := db.NewScope(model)
+    column, ok := scope.FieldByName(field)
+    if !ok {
+        return errors.New("Unknown field " + field)
+    }
+    if scope.Dialect().HasColumn(scope.TableName(), column.DBName) {
+        return nil
+    }
+    return db.Exec(fmt.Sprintf("ALTER TABLE %v ADD %v %v", scope.QuotedTableName(), scope.Quote(column.DBName), scope.Dialect().DataTypeOf(column.StructField))).Error
+}
+
+/*
+ Removes a column from the table of the model, if it exists
+ */
+func DropColumn(db *gorm.DB, model interface{}, column string) error {
+    scope := db.NewScope(model)
+    if !scope.Dialect().HasColumn(scope.TableName(), column) {
+        return nil
+    }
+    return db.Model(model).DropColumn(column).Error
+}
\ No newline at end of file
@@ -12,6 +12,7 @@ import (
     "github.com/jinzhu/configor"
     "log"
     "os"
+    "path/filepath"
 )
 
 /*
@@ -34,6 +35,50 @@ type SettingsData struct {
     // Set this to false to disable registration
     Registration bool
 
+    // Either open, or invite to require an invite code for registration
+    RegistrationMode string `yaml:"registration-mode" json:"registration-mode"`
+
+    // Whether new accounts have to be approved by an admin before they can log in
+    RegistrationApproval bool `yaml:"registration-approval" json:"registration-approval"`
+
+    // Email domains that are allowed or denied for new accounts. An empty allowlist allows every domain
+    EmailAllowlist []string `yaml:"email-allowlist" json:"email-allowlist"`
+    EmailDenylist  []string `yaml:"email-denylist" json:"email-denylist"`
+
+    // Whether throwaway email addresses should be rejected, and additional domains to treat as disposable
+    BlockDisposableEmails bool `yaml:"block-disposable-emails" json:"block-disposable-emails"`
+    DisposableDomains     []string `yaml:"disposable-domains" json:"disposable-domains"`
+
+    // How many failed logins are allowed per username and per IP address, and for how many minutes they get locked out afterwards
+    LoginAttempts   string `yaml:"login-attempts" json:"login-attempts"`
+    LoginIPAttempts string `yaml:"login-ip-attempts" json:"login-ip-attempts"`
+    LoginLockout    int `yaml:"login-lockout" json:"login-lockout"`
+
+    // How many days a login session stays valid
+    SessionLifetime int `yaml:"session-lifetime" json:"session-lifetime"`
+
+    // How many days a deleted account can still be restored
+    DeletionGracePeriod int `yaml:"deletion-grace-period" json:"deletion-grace-period"`
+
+    // How many days the entries of the audit log are kept, and after how many days their IP addresses are removed. 0 keeps them forever
+    AuditRetention   int `yaml:"audit-retention" json:"audit-retention"`
+    AuditIPRetention int `yaml:"audit-ip-retention" json:"audit-ip-retention"`
+
+    // Whether users get an email when an admin logs into their account
+    ImpersonationNotice bool `yaml:"impersonation-notice" json:"impersonation-notice"`
+
+    // How many minutes repeated downloads of a version from the same IP address are counted only once
+    DownloadWindow int `yaml:"download-window" json:"download-window"`
+
+    // Whether pending schema migrations have to be applied with "sdb db migrate", instead of when the backend starts
+    ManualMigrations bool `yaml:"manual-migrations" json:"manual-migrations"`
+
+    // How many minutes lie between two syncs of the mirrors, 0 disables them
+    MirrorInterval int `yaml:"mirror-interval" json:"mirror-interval"`
+
+    // Whether admins and game admins have to use two-factor authentication
+    TwoFactorAdmins bool `yaml:"two-factor-admins" json:"two-factor-admins"`
+
     // The address to bind to
     Host string
     Port int
@@ -96,12 +141,16 @@ func LoadSettings() {
 }
 
 /*
- Loads the settings from a configuration file
+ Loads the settings from a configuration file. The files are in config/, or in the directory from SPACEDOCK_CONFIG_DIR
  */
 func LoadFromConfigFile(data interface{}, configFile string) {
-    log.Printf("* Loading configuration file: config/%s", configFile)
+    dir := os.Getenv("SPACEDOCK_CONFIG_DIR")
+    if dir == "" {
+        dir = "config"
+    }
+    log.Printf("* Loading configuration file: %s", filepath.Join(dir, configFile))
     os.Setenv("CONFIGOR_ENV_PREFIX", "SPACEDOCK")
-    err := configor.Load(data, "config/" + configFile)
+    err := configor.Load(data, filepath.Join(dir, configFile))
     if err != nil {
         log.Fatalf("* Failed to parse configuration file: %s", err)
     }
@@ -12,12 +12,28 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-    "encoding/json"
+    "github.com/jinzhu/gorm"
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
     "log"
+    "strings"
+    "time"
 )
 
+/*
+ Returns the values of a parameter that the role parameters are matched against
+ */
+type paramLookup func(param string) []string
+
+/*
+ Matches the role parameters against the route parameters and the JSON body of the request
+ */
+func requestParams(ctx *iris.Context) paramLookup {
+    return func(param string) []string {
+        return []string{ctx.GetString(param), cast.ToString(utils.GetFullJSON(ctx)[param])}
+    }
+}
+
 /*
  Checks if a User has a given permission + parameters
 
@@ -27,51 +43,135 @@ import (
     2 - Userprofile isn't public
     3 - User has no permission to view this site
     4 - Role params are invalid
+    5 - The API token of the request doesn't have the required scope
+    6 - The user has to enable two-factor authentication first
+    7 - The user is suspended or banned
  */
 func UserHasPermission(ctx *iris.Context, permission string, public bool, params []string) int {
-    user := CurrentUser(ctx)
+    status := 0
+    authQueries(ctx, func(db *gorm.DB) {
+        status, _ = checkPermission(db, requestUser(ctx), CurrentToken(ctx), permission, public, params, requestParams(ctx))
+    })
+    return status
+}
+
+/*
+ Runs the same checks as UserHasPermission for a user and the given parameter values, without a request.
+ Returns the status code and the steps that lead to it
+ */
+func ExplainPermission(user *objects.User, permission string, public bool, values map[string]string) (int, []string) {
+    params := []string{}
+    for key := range values {
+        params = append(params, key)
+    }
+    return checkPermission(app.Database, user, nil, permission, public, params, func(param string) []string {
+        return []string{values[param]}
+    })
+}
+
+func checkPermission(db *gorm.DB, user *objects.User, token *objects.Token, permission string, public bool, params []string, lookup paramLookup) (int, []string) {
+    trace := []string{}
     if user == nil {
-        return 1
+        return 1, append(trace, "Nobody is logged in")
+    }
+    trace = append(trace, "Checking the ability " + permission + " for the user " + user.Username)
+    if user.IsSanctioned() {
+        return 7, append(trace, "The user is suspended or banned")
     } else if public && !user.Public {
-        return 2
+        return 2, append(trace, "The page requires a public profile, but the profile of the user is private")
     }
     if params == nil {
         params = []string{}
     }
 
     ability := objects.Ability {}
-    app.Database.Where("name = ?", permission).First(&ability)
+    db.Where("name = ?", permission).First(&ability)
 
-    user_abilities := user.GetAbilities()
-    user_params := map[string]map[string][]string{}
+    user_abilities := user.GetAbilitiesTx(db)
+    user_params := map[string][]objects.RoleParam{}
+    granted := []string{}
     for _,element := range user.Roles {
-        var temp map[string]map[string][]string
-        err := json.Unmarshal([]byte(element.Params), &temp)
-        if err != nil {
-            log.Fatal("Invalid Role Parameters! (Rolename: " + element.Name + ")")
-            return 4
+        for _,element2 := range element.Params {
+            if element2.Ability == permission {
+                user_params[element2.Param] = append(user_params[element2.Param], element2)
+            }
         }
-        for k, v := range temp {
-            user_params[k] = v
+        for _,element2 := range element.Abilities {
+            if element2.Name == permission {
+                granted = append(granted, element.Name)
+            }
         }
     }
 
-    has := false
-    if ok,_ := utils.ArrayContains(ability.Name, user_abilities); ok {
-        if len(params) > 0 {
-            for _,element := range params {
-                if utils.ArrayContainsRe(getParam(ability.Name, element, user_params), ctx.GetString(element)) || utils.ArrayContainsRe(getParam(ability.Name, element, user_params), cast.ToString(utils.GetFullJSON(ctx)[element])) {
-                    has = true
+    if ok,_ := utils.ArrayContains(ability.Name, user_abilities); !ok {
+        return 3, append(trace, "None of the roles of the user has the ability " + permission)
+    }
+    trace = append(trace, "The ability is granted by the roles: " + strings.Join(granted, ", "))
+    if ok, err := matchRoleParams(lookup, params, user_params); err != nil {
+        log.Printf("Invalid role parameter for the ability %s: %s", permission, err)
+        return 4, append(trace, "A parameter of the roles is invalid: " + err.Error())
+    } else if !ok {
+        return 3, append(trace, "None of the parameters " + strings.Join(params, ", ") + " matches the values the roles allow")
+    }
+    if len(params) > 0 {
+        trace = append(trace, "The parameters match the values the roles allow")
+    }
+    if token != nil && !tokenAllows(lookup, token, ability.Name, params) {
+        return 5, append(trace, "The API token doesn't have the scope " + permission)
+    }
+    if ability.Name != "logged-in" && user.NeedsTwoFactorSetupTx(db) {
+        return 6, append(trace, "The user has to enable two-factor authentication first")
+    }
+    return 0, append(trace, "Access granted")
+}
+
+/*
+ Checks whether one of the requested parameters matches one of the role parameters
+ */
+func matchRoleParams(lookup paramLookup, params []string, p map[string][]objects.RoleParam) (bool, error) {
+    if len(params) == 0 {
+        return true, nil
+    }
+    for _,element := range params {
+        for _,value := range lookup(element) {
+            for _,allowed := range p[element] {
+                ok, err := allowed.Matches(value)
+                if err != nil {
+                    return false, err
+                }
+                if ok {
+                    return true, nil
                 }
             }
-        } else {
-            has = true
         }
-        if has {
-            return 0
+    }
+    return false, nil
+}
+
+/*
+ Checks whether one of the requested parameters matches the allowed values in the scopes of an API token.
+ The values are compared like role parameters without a match mode
+ */
+func matchParams(lookup paramLookup, ability string, params []string, p map[string]map[string][]string) bool {
+    if len(params) == 0 {
+        return true
+    }
+    for _,element := range params {
+        for _,value := range lookup(element) {
+            for _,allowed := range getParam(ability, element, p) {
+                param := objects.RoleParam{Ability: ability, Param: element, Value: allowed, Match: objects.GuessMatch(allowed)}
+                ok, err := param.Matches(value)
+                if err != nil {
+                    log.Printf("Invalid token scope for the ability %s: %s", ability, err)
+                    continue
+                }
+                if ok {
+                    return true
+                }
+            }
         }
     }
-    return 3
+    return false
 }
 
 func NeedsPermission(permission string, public bool, params ...string) func(ctx *iris.Context) {
@@ -91,6 +191,15 @@ func NeedsPermission(permission string, public bool, params ...string) func(ctx
         } else if status == 3 {
             utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have access to this page. You need to have the abilities: " + permission).Code(1020))
             return
+        } else if status == 5 {
+            utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("Your API token doesn't grant access to this page. It needs the scope: " + permission).Code(1040))
+            return
+        } else if status == 6 {
+            utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You need to enable two-factor authentication to use this page.").Code(1050))
+            return
+        } else if status == 7 {
+            utils.WriteJSON(ctx, iris.StatusForbidden, SanctionError(requestUser(ctx)))
+            return
         } else {
             utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error("Invalid Role parameter detected. Please contact the server administrator").Code(1010))
             return
@@ -98,6 +207,21 @@ func NeedsPermission(permission string, public bool, params ...string) func(ctx
     }
 }
 
+/*
+ Builds the error for a suspended or banned user, including the reason and when the suspension ends
+ */
+func SanctionError(user *objects.User) iris.Map {
+    sanction := objects.ActiveSanction(user.ID)
+    if sanction == nil {
+        return utils.Error("Your account is suspended.").Code(1060)
+    }
+    message := "Your account is banned. Reason: " + sanction.Reason
+    if sanction.ExpiresAt != nil {
+        message = "Your account is suspended until " + sanction.ExpiresAt.Format(time.RFC3339) + ". Reason: " + sanction.Reason
+    }
+    return utils.Error(message).Code(1060)
+}
+
 func getParam(ability string, param string, p map[string]map[string][]string) []string {
     if _, ok := p[ability]; ok {
         if _,ok := p[ability][param]; ok {
@@ -0,0 +1,30 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package middleware
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "gopkg.in/kataras/iris.v6"
+)
+
+/*
+ Writes an entry into the audit log for a privileged action of the current user.
+ changes can be nil, or the result of utils.Diff for edits
+ */
+func Audit(ctx *iris.Context, action string, targetType string, targetID uint, changes map[string]interface{}) {
+    actor := uint(0)
+    if user := requestUser(ctx); user != nil {
+        actor = user.ID
+    }
+    impersonator := uint(0)
+    if session := CurrentSession(ctx); session != nil {
+        impersonator = session.ImpersonatorID
+    }
+    Queries(ctx).Save(objects.NewAuditEntry(actor, impersonator, action, targetType, targetID, changes, ctx.RemoteAddr()))
+}
\ No newline at end of file
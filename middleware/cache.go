@@ -37,7 +37,14 @@ func CreateCache() {
         IrisGzipEnabled:   true,
         CacheKeyFunc:      cache.RequestPathToMD5,
     }, memoryStore)
-    Cache = c.Serve
+    Cache = func(ctx *iris.Context) {
+        // The cache key is only the path, so responses that depend on the query string can't be cached
+        if ctx.Request.URL.RawQuery != "" {
+            ctx.Next()
+            return
+        }
+        c.Serve(ctx)
+    }
     utils.InvalidFunc = c.Invalidate
 }
 
@@ -0,0 +1,48 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package middleware
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/ulule/limiter"
+    "gopkg.in/kataras/iris.v6"
+    "strconv"
+    "time"
+)
+
+/*
+ Remembers which versions an IP address downloaded recently
+ */
+var downloadLimiter *limiter.Limiter
+
+/*
+ Sets up the deduplication of downloads
+ */
+func CreateDownloadCounter() {
+    if app.Settings.DownloadWindow <= 0 {
+        app.Settings.DownloadWindow = 10
+    }
+    rate := limiter.Rate{
+        Period: time.Minute * time.Duration(app.Settings.DownloadWindow),
+        Limit: 1,
+    }
+    downloadLimiter = limiter.NewLimiter(limiter.NewMemoryStore(), rate)
+}
+
+/*
+ Returns whether a download should be counted. Downloading the same version again from the same IP address only counts once per window
+ */
+func CountsDownload(ctx *iris.Context, version *objects.ModVersion) bool {
+    context, err := downloadLimiter.Get("download-" + ctx.RemoteAddr() + ":" + strconv.Itoa(int(version.ID)))
+    if err != nil {
+        return true
+    }
+    return !context.Reached
+}
\ No newline at end of file
@@ -9,9 +9,9 @@
 package middleware
 
 import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
     "github.com/spf13/cast"
     "github.com/ulule/limiter"
     "gopkg.in/kataras/iris.v6"
@@ -42,11 +42,16 @@ func NewAccessLimiter(limiterObj *limiter.Limiter) iris.HandlerFunc {
 }
 
 func limitFunc(context limiter.Context, ctx *iris.Context) bool {
-    s_token := ctx.URLParam("token")
+    s_token := BearerToken(ctx)
+    if s_token == "" {
+        s_token = ctx.URLParam("token")
+    }
     if s_token != "" {
-        var token objects.Token
-        app.Database.Where("token = ?", s_token).First(&token)
-        if token.Token != s_token {
+        var token *objects.Token
+        authQueries(ctx, func(db *gorm.DB) {
+            token = objects.FindTokenTx(db, s_token)
+        })
+        if token == nil {
             return context.Reached
         }
         _,ips := token.GetValue("ips")
@@ -0,0 +1,125 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package middleware
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/ulule/limiter"
+    "gopkg.in/kataras/iris.v6"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/*
+ Count the failed logins per username and per IP address
+ */
+var loginUserLimiter *limiter.Limiter
+var loginIPLimiter *limiter.Limiter
+
+/*
+ Failed attempts before the delay kicks in, and the longest delay
+ */
+const (
+    loginDelayAfter = 3
+    loginDelayMax   = time.Second * 8
+)
+
+/*
+ Sets up the counters for failed logins
+ */
+func CreateLoginGuard() {
+    if app.Settings.LoginAttempts == "" {
+        app.Settings.LoginAttempts = "10-H"
+    }
+    if app.Settings.LoginIPAttempts == "" {
+        app.Settings.LoginIPAttempts = "50-H"
+    }
+    userRate, err := limiter.NewRateFromFormatted(app.Settings.LoginAttempts)
+    if err != nil {
+        log.Fatal("Failed to parse the login attempt limit")
+        return
+    }
+    ipRate, err := limiter.NewRateFromFormatted(app.Settings.LoginIPAttempts)
+    if err != nil {
+        log.Fatal("Failed to parse the login attempt limit for IP addresses")
+        return
+    }
+    loginUserLimiter = limiter.NewLimiter(limiter.NewMemoryStore(), userRate)
+    loginIPLimiter = limiter.NewLimiter(limiter.NewMemoryStore(), ipRate)
+}
+
+/*
+ Returns the lockout that prevents logging in as this user from the current IP address, or nil
+ */
+func LoginLockout(ctx *iris.Context, username string) *objects.Lockout {
+    if lockout := objects.LatestLockout(objects.LockoutUser, strings.ToLower(username)); lockout != nil && lockout.IsActive() {
+        return lockout
+    }
+    if lockout := objects.LatestLockout(objects.LockoutIP, ctx.RemoteAddr()); lockout != nil && lockout.IsActive() {
+        return lockout
+    }
+    return nil
+}
+
+/*
+ Records a failed login. Every failure past the first few slows the response down a bit more,
+ and hitting the limit locks out the username or IP address. The owner of the account gets an email in that case
+ */
+func LoginFailed(ctx *iris.Context, username string, user *objects.User) {
+    ip := ctx.RemoteAddr()
+    username = strings.ToLower(username)
+    duration := time.Minute * time.Duration(app.Settings.LoginLockout)
+    if duration <= 0 {
+        duration = time.Minute * 30
+    }
+
+    failures := int64(0)
+    if context, err := loginUserLimiter.Get(loginKey(objects.LockoutUser, username)); err == nil {
+        failures = context.Limit - context.Remaining
+        if context.Reached {
+            lockout := objects.NewLockout(objects.LockoutUser, username, ip, duration)
+            app.Database.Save(lockout)
+            if user != nil {
+                utils.SendLockoutNotice(user.Username, user.Email, ip, lockout.ExpiresAt)
+            }
+        }
+    }
+    if context, err := loginIPLimiter.Get(loginKey(objects.LockoutIP, ip)); err == nil {
+        if context.Limit - context.Remaining > failures {
+            failures = context.Limit - context.Remaining
+        }
+        if context.Reached {
+            app.Database.Save(objects.NewLockout(objects.LockoutIP, ip, ip, duration))
+        }
+    }
+
+    // Progressive delay
+    if failures > loginDelayAfter {
+        delay := time.Second << uint(failures - loginDelayAfter - 1)
+        if delay > loginDelayMax || delay <= 0 {
+            delay = loginDelayMax
+        }
+        time.Sleep(delay)
+    }
+}
+
+/*
+ The counter key changes with every lockout, so the attempts are counted from zero once a lockout ends or gets cleared
+ */
+func loginKey(kind string, subject string) string {
+    generation := uint(0)
+    if lockout := objects.LatestLockout(kind, subject); lockout != nil {
+        generation = lockout.ID
+    }
+    return "login-" + kind + ":" + subject + ":" + strconv.Itoa(int(generation))
+}
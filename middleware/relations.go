@@ -0,0 +1,125 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package middleware
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "gopkg.in/kataras/iris.v6"
+    "strings"
+)
+
+/*
+ Declares which relations of the model a route loads. Clients can add more with ?include=versions,game,
+ and get them in the output with ?expand=user,default_version.gameversion
+ */
+func Relations(model interface{}, names ...string) func (ctx *iris.Context) {
+    return func (ctx *iris.Context) {
+        requested := append([]string{}, names...)
+        if include := ctx.URLParam("include"); include != "" {
+            requested = append(requested, strings.Split(include, ",")...)
+        }
+        expand := []string{}
+        if value := ctx.URLParam("expand"); value != "" {
+            expand = strings.Split(value, ",")
+            requested = append(requested, expand...)
+        }
+        relations, err := objects.ResolveIncludes(model, requested)
+        if err != nil {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error(err.Error()).Code(2149))
+            return
+        }
+        ctx.Set("sdb-model", model)
+        ctx.Set("sdb-relations", relations)
+        ctx.Set("sdb-expand", expand)
+        ctx.Next()
+    }
+}
+
+/*
+ Applies ?expand= and ?fields= to the output of an object. Expanded relations are kept even if they aren't in the list of fields
+ */
+func Expand(ctx *iris.Context, value interface{}, output map[string]interface{}) map[string]interface{} {
+    expand, _ := ctx.Get("sdb-expand").([]string)
+    objects.ExpandRelations(value, output, expand)
+    fields := ctx.URLParam("fields")
+    if fields == "" {
+        return output
+    }
+    selected := strings.Split(fields, ",")
+    for _,element := range expand {
+        selected = append(selected, strings.Split(strings.TrimSpace(element), ".")[0])
+    }
+    return utils.SelectFields(output, selected)
+}
+
+/*
+ Sets how many SQL statements a route may run, in addition to one for every relation it loads.
+ Authenticating the request doesn't count. In debug mode, routes that go over their budget are logged
+ */
+func QueryBudget(budget int) func (ctx *iris.Context) {
+    return func (ctx *iris.Context) {
+        relations, _ := ctx.Get("sdb-relations").([]string)
+        queryStats(ctx).Budget = budget + preloadCount(relations)
+        ctx.Next()
+    }
+}
+
+/*
+ Returns the database handle for the queries of a route. It loads the relations the route declared for its model, and nothing for other types.
+ Routes without declared relations get the defaults of every type
+ */
+func DB(ctx *iris.Context) *gorm.DB {
+    db := Queries(ctx)
+    if relations, ok := ctx.Get("sdb-relations").([]string); ok {
+        return objects.WithRelations(db, ctx.Get("sdb-model"), relations...)
+    }
+    return db
+}
+
+/*
+ Returns a database handle that counts its statements for the request, without loading any relations
+ */
+func Queries(ctx *iris.Context) *gorm.DB {
+    return app.TrackQueries(app.Database, queryStats(ctx))
+}
+
+/*
+ Runs the statements that authenticate the request. They show up in the stats, but don't count towards the budget of the route
+ */
+func authQueries(ctx *iris.Context, fn func(db *gorm.DB)) {
+    queryStats(ctx).Exempt(func() {
+        fn(Queries(ctx))
+    })
+}
+
+func queryStats(ctx *iris.Context) *app.QueryStats {
+    stats, ok := ctx.Get("sdb-queries").(*app.QueryStats)
+    if !ok {
+        stats = &app.QueryStats{}
+        ctx.Set("sdb-queries", stats)
+    }
+    return stats
+}
+
+/*
+ Returns how many queries are needed to preload the relations. Every step of a path is one query, unless another path loads it already
+ */
+func preloadCount(relations []string) int {
+    steps := map[string]bool{}
+    for _,element := range relations {
+        parts := strings.Split(element, ".")
+        for i := range parts {
+            steps[strings.Join(parts[:i + 1], ".")] = true
+        }
+    }
+    return len(steps)
+}
\ No newline at end of file
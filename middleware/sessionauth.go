@@ -9,47 +9,231 @@
 package middleware
 
 import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
-    "github.com/spf13/cast"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
     "gopkg.in/kataras/iris.v6"
+    "net/http"
+    "time"
 )
 
+/*
+ The name of the cookie that holds the session ID
+ */
+const SessionCookie = "spacedocksid"
+
 func LoginRequired(ctx *iris.Context) {
-    userID, err := ctx.Session().GetInt("SessionID")
-    if err == nil {
-        var user objects.User
-        err = user.GetById(cast.ToUint(userID))
-        if !(err == nil && user.IsAuthenticated()) {
-            ctx.SetStatusCode(iris.StatusUnauthorized)
-            return
-        }
-    } else {
+    user := CurrentUser(ctx)
+    if user == nil {
         ctx.SetStatusCode(iris.StatusUnauthorized)
         return
     }
     ctx.Next()
 }
 
+/*
+ Creates a new session for the user and sends the cookie
+ */
 func LoginUser(ctx *iris.Context, user *objects.User) {
+    dropPendingSession(ctx)
     user.Login()
-    ctx.Session().Set("SessionID", cast.ToInt(user.ID))
+    session := startSession(ctx, user, false)
+    ctx.Set("sdb-session", session)
+}
+
+/*
+ Remembers that the user entered the correct password, but still needs to send the two-factor authentication code
+ */
+func StartPendingLogin(ctx *iris.Context, user *objects.User) {
+    dropPendingSession(ctx)
+    startSession(ctx, user, true)
+}
+
+/*
+ Returns the user of a login that waits for the two-factor authentication code, or nil
+ */
+func PendingUser(ctx *iris.Context) *objects.User {
+    var user *objects.User
+    authQueries(ctx, func(db *gorm.DB) {
+        session := objects.FindSessionTx(db, ctx.GetCookie(SessionCookie))
+        if session == nil || !session.Pending {
+            return
+        }
+        user = &objects.User{}
+        if user.GetByIdTx(db, session.UserID) != nil {
+            user = nil
+        }
+    })
+    return user
 }
 
 func LogoutUser(ctx *iris.Context) {
-    CurrentUser(ctx).Logout()
-    ctx.Session().Delete("SessionID")
+    if user := CurrentUser(ctx); user != nil {
+        user.Logout()
+    }
+    if session := CurrentSession(ctx); session != nil {
+        Queries(ctx).Delete(session)
+    }
+    ctx.Set("sdb-session", nil)
+    setSessionCookie(ctx, "", time.Unix(0, 0))
+}
+
+/*
+ Logs the admin in as another user. The admin is remembered in the session, so they can switch back later
+ */
+func StartImpersonation(ctx *iris.Context, admin *objects.User, user *objects.User) {
+    LogoutUser(ctx)
+    user.Login()
+    session, plain := objects.NewSession(*user, ctx.RequestHeader("User-Agent"), ctx.RemoteAddr(), false)
+    session.ImpersonatorID = admin.ID
+    session.ExpiresAt = time.Now().Add(objects.ImpersonationLifetime)
+    Queries(ctx).Save(session)
+    setSessionCookie(ctx, plain, session.ExpiresAt)
+    ctx.Set("sdb-session", session)
+}
+
+/*
+ Ends an impersonation and logs the admin back in. Returns the admin, or nil if the session isn't an impersonation
+ */
+func StopImpersonation(ctx *iris.Context) *objects.User {
+    admin := Impersonator(ctx)
+    if admin == nil {
+        return nil
+    }
+    LogoutUser(ctx)
+    LoginUser(ctx, admin)
+    return admin
+}
+
+/*
+ Returns the admin who is logged in as someone else with the session of the request, or nil
+ */
+func Impersonator(ctx *iris.Context) *objects.User {
+    session := CurrentSession(ctx)
+    if session == nil || session.ImpersonatorID == 0 {
+        return nil
+    }
+    admin := &objects.User{}
+    authQueries(ctx, func(db *gorm.DB) {
+        if admin.GetByIdTx(db, session.ImpersonatorID) != nil {
+            admin = nil
+        }
+    })
+    return admin
+}
+
+/*
+ Blocks a route while an admin is logged in as someone else, for sensitive actions like changing the password or the email address
+ */
+func NoImpersonation(ctx *iris.Context) {
+    if RejectImpersonation(ctx) {
+        return
+    }
+    ctx.Next()
+}
+
+/*
+ Writes an error and returns true if an admin is logged in as someone else. For routes that only block some of their actions
+ */
+func RejectImpersonation(ctx *iris.Context) bool {
+    if Impersonator(ctx) == nil {
+        return false
+    }
+    utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You can't do this while impersonating another user.").Code(1065))
+    return true
+}
+
+/*
+ Marks every response that is made while an admin is logged in as someone else
+ */
+func ImpersonationHeader(ctx *iris.Context) {
+    if admin := Impersonator(ctx); admin != nil {
+        ctx.SetHeader("X-Impersonated-By", admin.Username)
+    }
+    ctx.Next()
 }
 
+/*
+ Returns the session of the request, or nil if the user isn't logged in
+ */
+func CurrentSession(ctx *iris.Context) *objects.Session {
+    if session, ok := ctx.Get("sdb-session").(*objects.Session); ok {
+        return session
+    }
+    var session *objects.Session
+    authQueries(ctx, func(db *gorm.DB) {
+        session = objects.FindSessionTx(db, ctx.GetCookie(SessionCookie))
+        if session == nil || session.Pending {
+            session = nil
+            return
+        }
+        session.TouchTx(db, ctx.RemoteAddr())
+    })
+    if session == nil {
+        return nil
+    }
+    ctx.Set("sdb-session", session)
+    return session
+}
+
+/*
+ Returns the logged in user, or nil. Suspended and banned users count as logged out
+ */
 func CurrentUser(ctx *iris.Context) *objects.User {
-    userID, err := ctx.Session().GetInt("SessionID")
-    if err == nil {
-        user := &objects.User{}
-        err = user.GetById(cast.ToUint(userID))
-        if err == nil {
-            return user
-        } else {
-            return nil
+    user := requestUser(ctx)
+    if user == nil || user.IsSanctioned() {
+        return nil
+    }
+    return user
+}
+
+/*
+ Returns the user the session or API token of the request belongs to, even if they are sanctioned
+ */
+func requestUser(ctx *iris.Context) *objects.User {
+    // Requests with an API token don't fall back to the session
+    userID := uint(0)
+    if BearerToken(ctx) != "" {
+        if token := CurrentToken(ctx); token != nil {
+            userID = token.UserID
         }
+    } else if session := CurrentSession(ctx); session != nil {
+        userID = session.UserID
     }
-    return nil
+    if userID == 0 {
+        return nil
+    }
+    user := &objects.User{}
+    authQueries(ctx, func(db *gorm.DB) {
+        if user.GetByIdTx(db, userID) != nil {
+            user = nil
+        }
+    })
+    return user
+}
+
+func startSession(ctx *iris.Context, user *objects.User, pending bool) *objects.Session {
+    session, plain := objects.NewSession(*user, ctx.RequestHeader("User-Agent"), ctx.RemoteAddr(), pending)
+    Queries(ctx).Save(session)
+    setSessionCookie(ctx, plain, session.ExpiresAt)
+    return session
+}
+
+func dropPendingSession(ctx *iris.Context) {
+    session := objects.FindSessionTx(Queries(ctx), ctx.GetCookie(SessionCookie))
+    if session != nil && session.Pending {
+        Queries(ctx).Delete(session)
+    }
+}
+
+func setSessionCookie(ctx *iris.Context, value string, expires time.Time) {
+    http.SetCookie(ctx.ResponseWriter, &http.Cookie{
+        Name: SessionCookie,
+        Value: value,
+        Path: "/",
+        Expires: expires,
+        HttpOnly: true,
+        Secure: app.Settings.Protocol == "https",
+    })
 }
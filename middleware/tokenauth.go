@@ -0,0 +1,63 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package middleware
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/jinzhu/gorm"
+    "gopkg.in/kataras/iris.v6"
+    "strings"
+)
+
+/*
+ Returns the plaintext token from the Authorization header, or an empty string
+ */
+func BearerToken(ctx *iris.Context) string {
+    header := ctx.RequestHeader("Authorization")
+    if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+        return strings.TrimSpace(header[7:])
+    }
+    return ""
+}
+
+/*
+ Returns the API token the request was authenticated with, or nil for session based requests
+ */
+func CurrentToken(ctx *iris.Context) *objects.Token {
+    if token, ok := ctx.Get("sdb-token").(*objects.Token); ok {
+        return token
+    }
+    var token *objects.Token
+    authQueries(ctx, func(db *gorm.DB) {
+        token = objects.FindTokenTx(db, BearerToken(ctx))
+        if token != nil {
+            token.TouchTx(db, ctx.RemoteAddr())
+        }
+    })
+    if token == nil {
+        return nil
+    }
+    ctx.Set("sdb-token", token)
+    return token
+}
+
+/*
+ Checks whether the scopes of a token allow using an ability with the given parameters
+ */
+func tokenAllows(lookup paramLookup, token *objects.Token, ability string, params []string) bool {
+    scopes := token.GetScopes()
+    constraints, ok := scopes[ability]
+    if !ok {
+        return false
+    }
+    if len(constraints) == 0 {
+        return true
+    }
+    return matchParams(lookup, ability, params, scopes)
+}
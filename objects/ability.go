@@ -8,37 +8,9 @@
 
 package objects
 
-import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-)
-
 type Ability struct {
     Model
 
     Name  string `gorm:"size:128;unique_index;not null" json:"name" spacedock:"lock"`
     Roles []Role `gorm:"many2many:role_abilities" json:"-" spacedock:"lock"`
-}
-
-func (s *Ability) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Roles), "Roles")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
 }
\ No newline at end of file
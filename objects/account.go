@@ -0,0 +1,196 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "archive/zip"
+    "bytes"
+    "encoding/json"
+    "log"
+    "strconv"
+    "time"
+)
+
+/*
+ Bundles everything we store about a user into a zip archive of JSON files
+ */
+func (user *User) Export() ([]byte, error) {
+    files := map[string]interface{}{}
+
+    // Profile
+    profile := user.Format(true)
+    profile["twoFactor"] = user.TotpEnabled
+    files["profile.json"] = profile
+
+    // Mods and their versions
+    var mods []Mod
+    app.Database.Where("user_id = ?", user.ID).Find(&mods)
+    output := make([]map[string]interface{}, len(mods))
+    for i,element := range mods {
+        output[i] = utils.ToMap(element)
+    }
+    files["mods.json"] = output
+
+    // Ratings
+    var ratings []Rating
+    app.Database.Where("user_id = ?", user.ID).Find(&ratings)
+    output = make([]map[string]interface{}, len(ratings))
+    for i,element := range ratings {
+        output[i] = utils.ToMap(element)
+        output[i]["mod_name"] = element.Mod.Name
+    }
+    files["ratings.json"] = output
+
+    // Follows
+    output = make([]map[string]interface{}, len(user.Following))
+    for i,element := range user.Following {
+        output[i] = map[string]interface{}{"id": element.ID, "name": element.Name}
+    }
+    files["following.json"] = output
+
+    // Mod lists
+    var lists []ModList
+    app.Database.Where("user_id = ?", user.ID).Find(&lists)
+    output = make([]map[string]interface{}, len(lists))
+    for i,element := range lists {
+        output[i] = utils.ToMap(element)
+        items := make([]uint, len(element.Mods))
+        for j,item := range element.Mods {
+            items[j] = item.ModID
+        }
+        output[i]["mods"] = items
+    }
+    files["modlists.json"] = output
+
+    // Shared authorships
+    var authors []SharedAuthor
+    app.Database.Where("user_id = ?", user.ID).Find(&authors)
+    output = make([]map[string]interface{}, len(authors))
+    for i,element := range authors {
+        output[i] = utils.ToMap(element)
+        output[i]["mod_name"] = element.Mod.Name
+    }
+    files["shared-authors.json"] = output
+
+    // Pack everything
+    buffer := &bytes.Buffer{}
+    archive := zip.NewWriter(buffer)
+    for name, content := range files {
+        data, err := json.MarshalIndent(content, "", "    ")
+        if err != nil {
+            return nil, err
+        }
+        w, err := archive.Create(name)
+        if err != nil {
+            return nil, err
+        }
+        w.Write(data)
+    }
+    if err := archive.Close(); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+/*
+ Deletes the user and removes or anonymizes everything that belongs to them.
+ Mods with an accepted co-author are handed over to them, the others are removed
+ */
+func (user *User) Purge() {
+    // Mods
+    var mods []Mod
+    app.Database.Where("user_id = ?", user.ID).Find(&mods)
+    for _,mod := range mods {
+        var heir *SharedAuthor
+        for i,element := range mod.SharedAuthors {
+            if element.Accepted && element.UserID != user.ID {
+                heir = &mod.SharedAuthors[i]
+                break
+            }
+        }
+        if heir != nil {
+            app.Database.Model(&mod).UpdateColumn("user_id", heir.UserID)
+            app.Database.Delete(heir)
+        } else {
+            app.Database.Delete(&mod)
+            mod.RemoveOwnerRole(app.Database)
+        }
+        utils.ClearModCache(mod.Game.Short, mod.ID)
+    }
+
+    // Ratings stay, so the scores of the mods don't change
+    app.Database.Model(&Rating{}).Where("user_id = ?", user.ID).UpdateColumn("user_id", 0)
+
+    // Mod lists
+    var lists []ModList
+    app.Database.Where("user_id = ?", user.ID).Find(&lists)
+    for _,element := range lists {
+        app.Database.Where("mod_list_id = ?", element.ID).Delete(ModListItem{})
+        app.Database.Delete(&element)
+        element.RemoveOwnerRole(app.Database)
+    }
+
+    // Everything else
+    app.Database.Where("user_id = ?", user.ID).Delete(SharedAuthor{})
+    app.Database.Where("user_id = ?", user.ID).Delete(DigestEntry{})
+    app.Database.Where("user_id = ?", user.ID).Delete(Token{})
+    app.Database.Where("user_id = ?", user.ID).Delete(OAuthConsent{})
+    app.Database.Where("user_id = ?", user.ID).Delete(OAuthRefreshToken{})
+    app.Database.Where("user_id = ?", user.ID).Delete(OAuthCode{})
+    RevokeSessions(user.ID, 0)
+    var clients []OAuthClient
+    app.Database.Where("owner_id = ?", user.ID).Find(&clients)
+    for _,element := range clients {
+        element.Revoke()
+    }
+    app.Database.Model(user).Association("Following").Clear()
+
+    // Roles. The personal role is only used by this user
+    personal := &Role{}
+    app.Database.Where("name = ?", user.Username).First(personal)
+    app.Database.Model(user).Association("Roles").Clear()
+    if personal.Name == user.Username {
+        personal.DeleteTx(app.Database)
+    }
+
+    // The row stays for references, but without personal data
+    id := strconv.Itoa(int(user.ID))
+    user.Username = "deleted-" + id
+    user.Email = "deleted-" + id + "@invalid"
+    user.Description = ""
+    user.Password = ""
+    user.Public = false
+    user.ShowEmail = false
+    user.DisableTwoFactor()
+    user.PendingEmail = ""
+    user.PreviousEmail = ""
+    user.Meta = "{}"
+    user.DeletionScheduledAt = nil
+    app.NoAssociations(func() { app.Database.Save(user) })
+    app.Database.Delete(user)
+    utils.ClearUserCache(user.ID)
+    log.Printf("* Deleted user account %s", id)
+}
+
+/*
+ Deletes the accounts whose grace period is over
+ */
+func PurgeDeletedUsers() {
+    var users []User
+    app.Database.Where("deletion_scheduled_at < ?", time.Now()).Find(&users)
+    for _,element := range users {
+        element.Purge()
+    }
+}
+
+func init() {
+    app.RegisterJob("account-deletion", time.Hour, PurgeDeletedUsers)
+}
@@ -0,0 +1,49 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "testing"
+)
+
+func TestPurgeFreesTheRoles(t *testing.T) {
+    game, _, mod := createTestMod(t)
+    user := &mod.User
+    user.AddRole(user.Username).AddAbility("logged-in")
+    if err := mod.AddOwnerRole(app.Database); err != nil {
+        t.Fatal(err)
+    }
+    list := NewModList("List " + game.Short, *user, *game)
+    app.Database.Save(list)
+    if err := list.AddOwnerRole(app.Database); err != nil {
+        t.Fatal(err)
+    }
+    username := user.Username
+    user.Purge()
+
+    for _,name := range []string{username, mod.Name, list.Name} {
+        count := 0
+        app.Database.Unscoped().Model(&Role{}).Where("name = ?", name).Count(&count)
+        if count != 0 {
+            t.Errorf("The role %s is still stored after the purge", name)
+        }
+    }
+
+    // The username can be registered again
+    again := NewUser(username, username + "@example.org", "password")
+    app.Database.Save(again)
+    role, err := again.AddRoleTx(app.Database, username)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if role.ID == 0 || len(role.Abilities) != 0 || len(role.Params) != 0 {
+        t.Errorf("The new personal role has the id %d, %d abilities and %d parameters, expected a new and empty role", role.ID, len(role.Abilities), len(role.Params))
+    }
+}
\ No newline at end of file
@@ -0,0 +1,73 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "errors"
+    "time"
+)
+
+/*
+ A record of a privileged action. Entries are never changed after they were written, they only get removed once they are older than the retention period
+ */
+type AuditEntry struct {
+    Model
+
+    ActorID        uint `gorm:"index" json:"actor" spacedock:"lock"`
+    ImpersonatorID uint `json:"impersonator" spacedock:"lock"`
+    Action         string `gorm:"size:64;index" json:"action" spacedock:"lock"`
+    TargetType     string `gorm:"size:32;index" json:"target_type" spacedock:"lock"`
+    TargetID       uint `gorm:"index" json:"target_id" spacedock:"lock"`
+    Changes        string `gorm:"size:100000" json:"changes" spacedock:"lock;json"`
+    IP             string `gorm:"size:64" json:"ip" spacedock:"lock"`
+}
+
+func NewAuditEntry(actor uint, impersonator uint, action string, targetType string, targetID uint, changes map[string]interface{}, ip string) *AuditEntry {
+    if changes == nil {
+        changes = map[string]interface{}{}
+    }
+    a := &AuditEntry{
+        ActorID: actor,
+        ImpersonatorID: impersonator,
+        Action: action,
+        TargetType: targetType,
+        TargetID: targetID,
+        Changes: utils.DumpJSON(changes),
+        IP: ip,
+    }
+    a.Meta = "{}"
+    return a
+}
+
+/*
+ The audit log is append-only. UpdateColumn skips this hook, which is only used to remove old IP addresses
+ */
+func (s *AuditEntry) BeforeUpdate() error {
+    return errors.New("Audit entries can't be changed")
+}
+
+/*
+ Removes the IP addresses and then the entries themselves once they are older than configured
+ */
+func CleanAuditLog() {
+    if days := app.Settings.AuditIPRetention; days > 0 {
+        cutoff := time.Now().Add(-time.Hour * 24 * time.Duration(days))
+        app.Database.Model(&AuditEntry{}).Where("created_at < ?", cutoff).Where("ip <> ?", "").UpdateColumn("ip", "")
+    }
+    if days := app.Settings.AuditRetention; days > 0 {
+        cutoff := time.Now().Add(-time.Hour * 24 * time.Duration(days))
+        app.Database.Unscoped().Where("created_at < ?", cutoff).Delete(AuditEntry{})
+    }
+}
+
+func init() {
+    app.RegisterJob("audit-retention", time.Hour * 24, CleanAuditLog)
+}
\ No newline at end of file
@@ -0,0 +1,369 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+/*
+ The datatypes as they were when the schema migrations were introduced. The first migration creates the tables from them,
+ so it produces the same schema no matter how the datatypes in objects change later. Don't edit them, add a migration instead.
+ Only the columns and the join tables matter here, so relations that don't have a join table are left out
+ */
+package baseline
+
+import (
+    "time"
+)
+
+type Model struct {
+    ID        uint `gorm:"primary_key"`
+    CreatedAt time.Time
+    UpdatedAt time.Time
+    DeletedAt *time.Time `sql:"index"`
+    Meta      string `gorm:"size:4096"`
+}
+
+type Ability struct {
+    Model
+
+    Name  string `gorm:"size:128;unique_index;not null"`
+    Roles []Role `gorm:"many2many:role_abilities"`
+}
+
+type AuditEntry struct {
+    Model
+
+    ActorID        uint `gorm:"index"`
+    ImpersonatorID uint
+    Action         string `gorm:"size:64;index"`
+    TargetType     string `gorm:"size:32;index"`
+    TargetID       uint `gorm:"index"`
+    Changes        string `gorm:"size:100000"`
+    IP             string `gorm:"size:64"`
+}
+
+type DigestEntry struct {
+    Model
+
+    UserID    uint
+    ModID     uint
+    VersionID uint
+}
+
+type DownloadEvent struct {
+    Model
+
+    ModID     uint
+    VersionID uint
+    Downloads int
+}
+
+type FollowEvent struct {
+    Model
+
+    ModID  uint
+    Events int
+    Delta  int
+}
+
+type ReferralEvent struct {
+    Model
+
+    ModID  uint
+    Events int
+    Host   string `gorm:"size:128"`
+}
+
+type Featured struct {
+    Model
+
+    ModID uint
+}
+
+type Game struct {
+    Model
+
+    Name             string `gorm:"size:1024;unique_index;not null"`
+    Active           bool
+    Altname          string `gorm:"size:1024"`
+    Rating           float32
+    Releasedate      time.Time
+    Short            string `gorm:"size:1024"`
+    PublisherID      uint
+    Description      string `gorm:"size:100000"`
+    ShortDescription string `gorm:"size:1000"`
+}
+
+type GameVersion struct {
+    Model
+
+    GameID          uint
+    FriendlyVersion string `gorm:"size:128;"`
+    Beta            bool
+}
+
+type Invite struct {
+    Model
+
+    Code        string `gorm:"size:64;unique_index"`
+    CreatedByID uint
+    Note        string `gorm:"size:1024"`
+    MaxUses     int
+    Uses        int
+    ExpiresAt   *time.Time
+}
+
+type Lockout struct {
+    Model
+
+    Kind      string `gorm:"size:8;index"`
+    Subject   string `gorm:"size:128;index"`
+    IP        string `gorm:"size:64"`
+    ExpiresAt time.Time
+}
+
+type Mod struct {
+    Model
+
+    UserID           uint
+    GameID           uint
+    Name             string `gorm:"size:1024;unique_index;not null"`
+    Description      string `gorm:"size:100000"`
+    ShortDescription string `gorm:"size:1000"`
+    Approved         bool
+    Published        bool
+    License          string `gorm:"size:512"`
+    DefaultVersionID uint
+    Followers        []User `gorm:"many2many:mod_followers"`
+    TotalScore       float64 `gorm:"not null"`
+    DownloadCount    int64
+}
+
+type ModList struct {
+    Model
+
+    UserID           uint
+    GameID           uint
+    Description      string `gorm:"size:100000"`
+    ShortDescription string `gorm:"size:1000"`
+    Name             string `gorm:"size:1024;unique_index;not null"`
+}
+
+type ModListItem struct {
+    Model
+
+    ModID     uint
+    ModListID uint
+    SortIndex uint
+}
+
+type ModVersion struct {
+    Model
+
+    ModID           uint
+    FriendlyVersion string `gorm:"size:64;"`
+    Beta            bool
+    GameVersionID   uint
+    DownloadPath    string `gorm:"size:512"`
+    Changelog       string `gorm:"size:10000"`
+    SortIndex       int
+    FileSize        int64
+}
+
+type OAuthClient struct {
+    Model
+
+    OwnerID      uint
+    Name         string `gorm:"size:128"`
+    Homepage     string `gorm:"size:256"`
+    Identifier   string `gorm:"size:64;unique_index"`
+    SecretHash   string `gorm:"size:64"`
+    RedirectURIs string `gorm:"size:4096"`
+}
+
+type OAuthConsent struct {
+    Model
+
+    UserID   uint
+    ClientID uint
+    Scopes   string `gorm:"size:4096"`
+}
+
+type OAuthCode struct {
+    Model
+
+    Hash        string `gorm:"size:64;unique_index"`
+    UserID      uint
+    ClientID    uint
+    RedirectURI string `gorm:"size:512"`
+    Scopes      string `gorm:"size:4096"`
+    Challenge   string `gorm:"size:128"`
+    ExpiresAt   time.Time
+}
+
+type OAuthRefreshToken struct {
+    Model
+
+    Hash      string `gorm:"size:64;unique_index"`
+    UserID    uint
+    ClientID  uint
+    TokenID   uint
+    Scopes    string `gorm:"size:4096"`
+    ExpiresAt time.Time
+}
+
+type Publisher struct {
+    Model
+
+    Name             string `gorm:"size:1024;unique_index;not null"`
+    Description      string `gorm:"size:100000"`
+    ShortDescription string `gorm:"size:1000"`
+}
+
+type Rating struct {
+    Model
+
+    UserID uint
+    ModID  uint
+    Score  float64 `gorm:"not null"`
+}
+
+type Role struct {
+    Model
+
+    Name        string `gorm:"size:128;unique_index;not null"`
+    Description string `gorm:"size:1024"`
+    Abilities   []Ability `gorm:"many2many:role_abilities"`
+    Users       []User `gorm:"many2many:role_users"`
+}
+
+type RoleParam struct {
+    Model
+
+    RoleID  uint `gorm:"index"`
+    Ability string `gorm:"size:128;index"`
+    Param   string `gorm:"size:128"`
+    Value   string `gorm:"size:1024"`
+    Match   string `gorm:"size:8"`
+}
+
+type Sanction struct {
+    Model
+
+    UserID      uint
+    IssuerID    uint
+    Kind        string `gorm:"size:16"`
+    Reason      string `gorm:"size:4096"`
+    HideContent bool
+    ExpiresAt   *time.Time
+    LiftedAt    *time.Time
+    LiftedByID  uint
+    Appeal      string `gorm:"size:10000"`
+}
+
+type Session struct {
+    Model
+
+    UserID         uint
+    Hash           string `gorm:"size:64;unique_index"`
+    Pending        bool
+    UserAgent      string `gorm:"size:512"`
+    IP             string `gorm:"size:64"`
+    LastSeenAt     time.Time
+    ExpiresAt      time.Time
+    ImpersonatorID uint
+}
+
+type SharedAuthor struct {
+    Model
+
+    UserID   uint
+    ModID    uint
+    Accepted bool `gorm:"not null"`
+}
+
+type Token struct {
+    Model
+
+    UserID     uint
+    Name       string `gorm:"size:128"`
+    Hash       string `gorm:"size:64;unique_index"`
+    Prefix     string `gorm:"size:16"`
+    Scopes     string `gorm:"size:4096"`
+    ExpiresAt  *time.Time
+    LastUsedAt *time.Time
+    LastUsedIP string `gorm:"size:64"`
+    ClientID   uint
+}
+
+type User struct {
+    Model
+
+    Username            string `gorm:"size:128;unique_index;not null"`
+    Email               string `gorm:"size:256;unique_index;not null"`
+    ShowEmail           bool
+    Public              bool
+    Password            string `gorm:"size:128"`
+    Description         string `gorm:"size:10000"`
+    Confirmation        string `gorm:"size:128"`
+    PasswordReset       string `gorm:"size:128"`
+    PasswordResetExpiry time.Time
+    Roles               []Role `gorm:"many2many:role_users"`
+    Following           []Mod `gorm:"many2many:mod_followers"`
+    UpdateNotifications string `gorm:"size:16"`
+    DigestSentAt        time.Time
+    TotpSecret          string `gorm:"size:64"`
+    TotpEnabled         bool
+    TotpLastStep        int64
+    RecoveryCodes       string `gorm:"size:1024"`
+    PendingEmail        string `gorm:"size:256"`
+    PreviousEmail       string `gorm:"size:256"`
+    EmailConfirmation   string `gorm:"size:128"`
+    EmailCancel         string `gorm:"size:128"`
+    EmailChangeExpiry   time.Time
+    EmailCancelExpiry   time.Time
+    DeletionScheduledAt *time.Time
+    AwaitingApproval    bool
+    InviteID            uint
+    Banned              bool
+    SuspendedUntil      *time.Time
+    ContentHidden       bool
+}
+
+/*
+ Returns an instance of every datatype of the baseline schema
+ */
+func Models() []interface{} {
+    return []interface{}{
+        &Ability{},
+        &AuditEntry{},
+        &DigestEntry{},
+        &DownloadEvent{},
+        &FollowEvent{},
+        &ReferralEvent{},
+        &Featured{},
+        &Game{},
+        &GameVersion{},
+        &Mod{},
+        &ModList{},
+        &ModListItem{},
+        &Invite{},
+        &Lockout{},
+        &ModVersion{},
+        &OAuthClient{},
+        &OAuthCode{},
+        &OAuthConsent{},
+        &OAuthRefreshToken{},
+        &Publisher{},
+        &Rating{},
+        &Role{},
+        &RoleParam{},
+        &Sanction{},
+        &Session{},
+        &SharedAuthor{},
+        &Token{},
+        &User{},
+    }
+}
\ No newline at end of file
@@ -0,0 +1,117 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/spf13/cast"
+    "time"
+)
+
+/*
+ How a user wants to be informed about updates of the mods they follow
+ */
+const (
+    NotifyImmediate = "immediate"
+    NotifyDaily     = "daily"
+    NotifyWeekly    = "weekly"
+)
+
+var NotifyModes = []string{NotifyImmediate, NotifyDaily, NotifyWeekly}
+
+/*
+ A mod update that is waiting to be sent to a user as part of a digest email
+ */
+type DigestEntry struct {
+    Model
+
+    User      User `json:"-" spacedock:"lock"`
+    UserID    uint `json:"user" spacedock:"lock"`
+    Mod       Mod `json:"-" spacedock:"lock"`
+    ModID     uint `json:"mod" spacedock:"lock"`
+    Version   ModVersion `json:"-" spacedock:"lock"`
+    VersionID uint `json:"version" spacedock:"lock"`
+}
+
+func NewDigestEntry(user User, mod Mod, version ModVersion) *DigestEntry {
+    d := &DigestEntry{
+        UserID: user.ID,
+        ModID: mod.ID,
+        VersionID: version.ID,
+    }
+    d.Meta = "{}"
+    return d
+}
+
+/*
+ Returns whether the user wants a digest instead of one email per update
+ */
+func (user *User) WantsDigest() bool {
+    return user.UpdateNotifications == NotifyDaily || user.UpdateNotifications == NotifyWeekly
+}
+
+/*
+ The time that has to pass between two digest emails for this user
+ */
+func (user *User) DigestInterval() time.Duration {
+    if user.UpdateNotifications == NotifyWeekly {
+        return time.Hour * 24 * 7
+    }
+    return time.Hour * 24
+}
+
+/*
+ Sends the pending digest emails of every user whose digest interval has passed
+ */
+func SendDigests() {
+    var users []User
+    app.Database.Where("update_notifications IN (?)", []string{NotifyDaily, NotifyWeekly}).Find(&users)
+    for _,user := range users {
+        if time.Since(user.DigestSentAt) < user.DigestInterval() {
+            continue
+        }
+        var entries []DigestEntry
+        app.Database.Where("user_id = ?", user.ID).Order("created_at asc").Find(&entries)
+        if len(entries) == 0 {
+            continue
+        }
+        ids := make([]uint, len(entries))
+        items := []utils.DigestItem{}
+        for i,entry := range entries {
+            ids[i] = entry.ID
+            if entry.Mod.ID != entry.ModID || entry.Version.ID != entry.VersionID {
+                continue
+            }
+            err, modURL := entry.Mod.Game.GetValue("modURL")
+            if err != nil {
+                modURL = ""
+            }
+            items = append(items, utils.DigestItem{
+                ModID: entry.Mod.ID,
+                ModName: entry.Mod.Name,
+                ModURL: cast.ToString(modURL),
+                FriendlyVersion: entry.Version.FriendlyVersion,
+                GameName: entry.Mod.Game.Name,
+                GameVersion: entry.Version.GameVersion.FriendlyVersion,
+                Changelog: entry.Version.Changelog,
+            })
+        }
+        if len(items) > 0 {
+            utils.SendDigest(user.Username, user.Email, user.UpdateNotifications, items)
+        }
+        app.Database.Where("id IN (?)", ids).Delete(DigestEntry{})
+        user.DigestSentAt = time.Now()
+        app.Database.Save(&user)
+    }
+}
+
+func init() {
+    app.RegisterJob("digest", time.Hour, SendDigests)
+}
@@ -10,7 +10,9 @@ package objects
 
 import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "log"
+    "time"
 )
 
 type DownloadEvent struct {
@@ -21,30 +23,7 @@ type DownloadEvent struct {
     Version ModVersion `json:"-" spacedock:"lock"`
     VersionID uint `json:"version" spacedock:"lock"`
     Downloads int `json:"downloads" spacedock:"lock"`
-}
-
-func (s *DownloadEvent) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Mod), "Mod")
-    app.Database.Related(&(s.Version), "Version")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
+    Hour time.Time `json:"hour" spacedock:"lock"`
 }
 
 func NewDownloadEvent(mod Mod, version ModVersion) *DownloadEvent {
@@ -54,11 +33,52 @@ func NewDownloadEvent(mod Mod, version ModVersion) *DownloadEvent {
         Version: version,
         VersionID: version.ID,
         Downloads: 0,
+        Hour: DownloadHour(time.Now()),
     }
     d.Meta = "{}"
     return d
 }
 
+/*
+ Returns the hour a download at the given time is counted in
+ */
+func DownloadHour(at time.Time) time.Time {
+    return at.UTC().Truncate(time.Hour)
+}
+
+/*
+ Counts a download of a mod version. The counters are increased by the database, so concurrent downloads can't overwrite each other.
+ Downloads are grouped into one event per version and hour
+ */
+func CountDownload(mod *Mod, version *ModVersion) {
+    app.Database.Model(&Mod{}).Where("id = ?", mod.ID).UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+    mod.DownloadCount += 1
+    if err := AddDownloads(app.Database, mod.ID, version.ID, time.Now(), 1); err != nil {
+        log.Printf("Failed to count a download of the version %d: %s", version.ID, err)
+    }
+}
+
+/*
+ Adds downloads to the event of a version for the hour of at. A unique index allows only one event per version and hour,
+ so if two downloads create it at the same time, the one that loses adds itself to the event of the other
+ */
+func AddDownloads(db *gorm.DB, modID uint, versionID uint, at time.Time, count int) error {
+    hour := DownloadHour(at)
+    bucket := db.Model(&DownloadEvent{}).Where("mod_id = ? AND version_id = ? AND hour = ?", modID, versionID, hour)
+    result := bucket.UpdateColumn("downloads", gorm.Expr("downloads + ?", count))
+    if result.Error != nil || result.RowsAffected > 0 {
+        return result.Error
+    }
+    download := &DownloadEvent{ModID: modID, VersionID: versionID, Downloads: count, Hour: hour}
+    download.CreatedAt = at
+    download.UpdatedAt = at
+    download.Meta = "{}"
+    if db.Set("gorm:save_associations", false).Create(download).Error == nil {
+        return nil
+    }
+    return bucket.UpdateColumn("downloads", gorm.Expr("downloads + ?", count)).Error
+}
+
 /* ========================================= */
 
 type FollowEvent struct {
@@ -70,29 +90,6 @@ type FollowEvent struct {
     Delta int `json:"delta" spacedock:"lock"`
 }
 
-func (s *FollowEvent) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Mod), "Mod")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewFollowEvent(mod Mod) *FollowEvent {
     f := &FollowEvent{
         Mod: mod,
@@ -115,29 +112,6 @@ type ReferralEvent struct {
     Host string `json:"host" gorm:"size:128" spacedock:"lock"`
 }
 
-func (s *ReferralEvent) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Mod), "Mod")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewReferralEvent(mod Mod, host string) *ReferralEvent {
     r := &ReferralEvent{
         Mod: mod,
@@ -0,0 +1,53 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "sync"
+    "testing"
+)
+
+func TestCountDownloadConcurrently(t *testing.T) {
+    _, gameVersion, mod := createTestMod(t)
+    version := NewModVersion(*mod, "1.0", *gameVersion, "/content/mod.zip", false)
+    app.Database.Save(version)
+
+    const downloads = 50
+    var wait sync.WaitGroup
+    for i := 0; i < downloads; i++ {
+        wait.Add(1)
+        go func() {
+            defer wait.Done()
+            local := *mod
+            CountDownload(&local, version)
+        }()
+    }
+    wait.Wait()
+
+    stored := &Mod{}
+    app.Database.Where("id = ?", mod.ID).First(stored)
+    if stored.DownloadCount != downloads {
+        t.Errorf("The mod has %d downloads, expected %d", stored.DownloadCount, downloads)
+    }
+    events := []DownloadEvent{}
+    app.Database.Where("mod_id = ?", mod.ID).Find(&events)
+    sum := 0
+    hours := map[int64]bool{}
+    for _,element := range events {
+        sum += element.Downloads
+        if hours[element.Hour.Unix()] {
+            t.Errorf("There is more than one event for the hour %s", element.Hour)
+        }
+        hours[element.Hour.Unix()] = true
+    }
+    if sum != downloads {
+        t.Errorf("The download events add up to %d, expected %d", sum, downloads)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,504 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "archive/tar"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/jinzhu/gorm"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+)
+
+/*
+ The version of the export format. Imports refuse exports with a newer one
+ */
+const ExportFormat = 1
+
+/*
+ The mods of a game in a form that doesn't depend on the ids of an instance. Users and game versions are referenced by name.
+ It is the first entry of the export archive, followed by the files of the versions
+ */
+type GameExport struct {
+    Format       int `json:"format"`
+    Created      time.Time `json:"created"`
+    Source       string `json:"source"`
+    Game         ExportedGame `json:"game"`
+    GameVersions []ExportedGameVersion `json:"game_versions"`
+    Mods         []ExportedMod `json:"mods"`
+}
+
+type ExportedGame struct {
+    Name             string `json:"name"`
+    Short            string `json:"short"`
+    Description      string `json:"description"`
+    ShortDescription string `json:"short_description"`
+}
+
+type ExportedGameVersion struct {
+    FriendlyVersion string `json:"friendly_version"`
+    Beta            bool `json:"beta"`
+}
+
+type ExportedMod struct {
+    Name             string `json:"name"`
+    Author           string `json:"author"`
+    SharedAuthors    []ExportedAuthor `json:"shared_authors"`
+    Description      string `json:"description"`
+    ShortDescription string `json:"short_description"`
+    License          string `json:"license"`
+    Published        bool `json:"published"`
+    Meta             string `json:"meta"`
+    Created          time.Time `json:"created"`
+    DefaultVersion   string `json:"default_version"`
+    Versions         []ExportedVersion `json:"versions"`
+}
+
+type ExportedAuthor struct {
+    Username string `json:"username"`
+    Accepted bool `json:"accepted"`
+}
+
+/*
+ A version of a mod. File is the name of its entry in the archive, empty if the file was missing on the exporting instance
+ */
+type ExportedVersion struct {
+    FriendlyVersion string `json:"friendly_version"`
+    GameVersion     string `json:"game_version"`
+    Beta            bool `json:"beta"`
+    Changelog       string `json:"changelog"`
+    SortIndex       int `json:"sort_index"`
+    Created         time.Time `json:"created"`
+    File            string `json:"file"`
+    Size            int64 `json:"size"`
+    Checksum        string `json:"checksum"`
+}
+
+/*
+ How an import treats what doesn't exist on this instance
+ */
+type ImportOptions struct {
+    DryRun         bool
+    FallbackUser   string
+    CreateVersions bool
+}
+
+/*
+ What an import did, or would do in a dry run. Conflicts are everything that couldn't be imported as it was exported
+ */
+type ImportReport struct {
+    Mods         []string `json:"mods"`
+    Versions     int `json:"versions"`
+    GameVersions []string `json:"game_versions"`
+    Conflicts    []string `json:"conflicts"`
+}
+
+/*
+ Writes all mods of a game into an export archive. Returns the versions whose files are missing, they are exported without them
+ */
+func ExportGame(game *Game, out io.Writer) ([]string, error) {
+    export := GameExport{
+        Format: ExportFormat,
+        Created: time.Now(),
+        Source: app.Settings.SiteName,
+        Game: ExportedGame{Name: game.Name, Short: game.Short, Description: game.Description, ShortDescription: game.ShortDescription},
+    }
+    versions := []GameVersion{}
+    if err := app.Database.Where("game_id = ?", game.ID).Order("id").Find(&versions).Error; err != nil {
+        return nil, err
+    }
+    for _,element := range versions {
+        export.GameVersions = append(export.GameVersions, ExportedGameVersion{FriendlyVersion: element.FriendlyVersion, Beta: element.Beta})
+    }
+    mods := []Mod{}
+    err := WithRelations(app.Database, Mod{}, "User", "DefaultVersion", "Versions", "Versions.GameVersion", "SharedAuthors", "SharedAuthors.User").
+        Where("game_id = ?", game.ID).
+        Order("id").
+        Find(&mods).Error
+    if err != nil {
+        return nil, err
+    }
+
+    // Describe the mods, the files are added afterwards
+    missing := []string{}
+    files := map[string]string{}
+    for _,mod := range mods {
+        exported := ExportedMod{
+            Name: mod.Name,
+            Author: mod.User.Username,
+            SharedAuthors: []ExportedAuthor{},
+            Description: mod.Description,
+            ShortDescription: mod.ShortDescription,
+            License: mod.License,
+            Published: mod.Published,
+            Meta: mod.Meta,
+            Created: mod.CreatedAt,
+            DefaultVersion: mod.DefaultVersion.FriendlyVersion,
+        }
+        for _,element := range mod.SharedAuthors {
+            exported.SharedAuthors = append(exported.SharedAuthors, ExportedAuthor{Username: element.User.Username, Accepted: element.Accepted})
+        }
+        for _,element := range mod.Versions {
+            version := ExportedVersion{
+                FriendlyVersion: element.FriendlyVersion,
+                GameVersion: element.GameVersion.FriendlyVersion,
+                Beta: element.Beta,
+                Changelog: element.Changelog,
+                SortIndex: element.SortIndex,
+                Created: element.CreatedAt,
+            }
+            source := filepath.Join(app.Settings.Storage, filepath.FromSlash(element.DownloadPath))
+            size, checksum, err := fileInfo(source)
+            if err != nil {
+                missing = append(missing, mod.Name + " " + element.FriendlyVersion)
+            } else {
+                version.File = "files/" + strconv.Itoa(int(mod.ID)) + "/" + strconv.Itoa(int(element.ID)) + ".zip"
+                version.Size = size
+                version.Checksum = checksum
+                files[version.File] = source
+            }
+            exported.Versions = append(exported.Versions, version)
+        }
+        export.Mods = append(export.Mods, exported)
+    }
+
+    // Write the archive
+    compressed := gzip.NewWriter(out)
+    archive := tar.NewWriter(compressed)
+    data, err := json.MarshalIndent(export, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    if err := archive.WriteHeader(&tar.Header{Name: "export.json", Mode: 0644, Size: int64(len(data)), ModTime: export.Created}); err != nil {
+        return nil, err
+    }
+    if _, err := archive.Write(data); err != nil {
+        return nil, err
+    }
+    for _,mod := range export.Mods {
+        for _,version := range mod.Versions {
+            if version.File == "" {
+                continue
+            }
+            if err := addExportFile(archive, version, files[version.File]); err != nil {
+                return nil, err
+            }
+        }
+    }
+    if err := archive.Close(); err != nil {
+        return nil, err
+    }
+    return missing, compressed.Close()
+}
+
+func addExportFile(archive *tar.Writer, version ExportedVersion, source string) error {
+    file, err := os.Open(source)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    if err := archive.WriteHeader(&tar.Header{Name: version.File, Mode: 0644, Size: version.Size, ModTime: version.Created}); err != nil {
+        return err
+    }
+    _, err = io.CopyN(archive, file, version.Size)
+    return err
+}
+
+func fileInfo(path string) (int64, string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, "", err
+    }
+    defer file.Close()
+    hash := sha256.New()
+    size, err := io.Copy(hash, file)
+    if err != nil {
+        return 0, "", err
+    }
+    return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+ A file of the archive and where it is stored on this instance
+ */
+type importFile struct {
+    path     string
+    checksum string
+    found    bool
+    replaced string
+}
+
+/*
+ Imports the mods of an export archive into a game. Authors and game versions are matched by name. Mods whose name is taken,
+ or whose author doesn't exist and has no fallback, are skipped. Everything is written in one transaction
+ */
+func ImportGame(game *Game, in io.Reader, options ImportOptions) (*ImportReport, error) {
+    compressed, err := gzip.NewReader(in)
+    if err != nil {
+        return nil, err
+    }
+    defer compressed.Close()
+    archive := tar.NewReader(compressed)
+    header, err := archive.Next()
+    if err != nil {
+        return nil, err
+    }
+    if header.Name != "export.json" {
+        return nil, errors.New("The archive doesn't start with export.json")
+    }
+    export := &GameExport{}
+    if err := json.NewDecoder(archive).Decode(export); err != nil {
+        return nil, err
+    }
+    if export.Format > ExportFormat {
+        return nil, fmt.Errorf("The export uses format %d, this version only supports %d", export.Format, ExportFormat)
+    }
+    report := &ImportReport{Mods: []string{}, GameVersions: []string{}, Conflicts: []string{}}
+
+    // Game versions
+    gameVersions := map[string]*GameVersion{}
+    existing := []GameVersion{}
+    app.Database.Where("game_id = ?", game.ID).Find(&existing)
+    for i := range existing {
+        gameVersions[existing[i].FriendlyVersion] = &existing[i]
+    }
+    created := []*GameVersion{}
+    for _,element := range export.GameVersions {
+        if _,ok := gameVersions[element.FriendlyVersion]; ok {
+            continue
+        }
+        if !options.CreateVersions {
+            report.Conflicts = append(report.Conflicts, "The game version " + element.FriendlyVersion + " doesn't exist, versions of mods for it are skipped")
+            continue
+        }
+        version := NewGameVersion(element.FriendlyVersion, *game, element.Beta)
+        gameVersions[element.FriendlyVersion] = version
+        created = append(created, version)
+        report.GameVersions = append(report.GameVersions, element.FriendlyVersion)
+    }
+
+    // Users
+    var fallback *User
+    if options.FallbackUser != "" {
+        fallback = &User{}
+        app.Database.Where("username = ?", options.FallbackUser).First(fallback)
+        if fallback.Username != options.FallbackUser {
+            return nil, errors.New("The fallback user " + options.FallbackUser + " doesn't exist")
+        }
+    }
+    users := map[string]*User{}
+    findUser := func(username string) *User {
+        if user, ok := users[username]; ok {
+            return user
+        }
+        user := &User{}
+        app.Database.Where("username = ?", username).First(user)
+        if user.Username != username {
+            user = nil
+        }
+        users[username] = user
+        return user
+    }
+
+    // Check which mods can be imported
+    mods := []ExportedMod{}
+    for _,element := range export.Mods {
+        taken := &Mod{}
+        app.Database.Unscoped().Where("name = ?", element.Name).First(taken)
+        if taken.Name == element.Name {
+            report.Conflicts = append(report.Conflicts, "A mod with the name " + element.Name + " already exists, it is skipped")
+            continue
+        }
+        if findUser(element.Author) == nil {
+            if fallback == nil {
+                report.Conflicts = append(report.Conflicts, "The author " + element.Author + " of " + element.Name + " doesn't exist, the mod is skipped")
+                continue
+            }
+            report.Conflicts = append(report.Conflicts, "The author " + element.Author + " of " + element.Name + " doesn't exist, it belongs to " + fallback.Username + " instead")
+            users[element.Author] = fallback
+        }
+        for _,author := range element.SharedAuthors {
+            if findUser(author.Username) == nil {
+                report.Conflicts = append(report.Conflicts, "The shared author " + author.Username + " of " + element.Name + " doesn't exist, they are skipped")
+            }
+        }
+        for _,version := range element.Versions {
+            if _,ok := gameVersions[version.GameVersion]; !ok {
+                report.Conflicts = append(report.Conflicts, "The version " + version.FriendlyVersion + " of " + element.Name + " is for the missing game version " + version.GameVersion + ", it is skipped")
+            } else if version.File == "" {
+                report.Conflicts = append(report.Conflicts, "The version " + version.FriendlyVersion + " of " + element.Name + " has no file, it is skipped")
+            } else {
+                report.Versions += 1
+            }
+        }
+        mods = append(mods, element)
+        report.Mods = append(report.Mods, element.Name)
+    }
+    if options.DryRun {
+        return report, nil
+    }
+
+    files := map[string]*importFile{}
+    err = app.Transaction(func(work *app.UnitOfWork) error {
+        for _,element := range created {
+            if err := work.DB.Save(element).Error; err != nil {
+                return err
+            }
+        }
+        for _,element := range mods {
+            if err := importMod(work.DB, game, element, users, gameVersions, files); err != nil {
+                return fmt.Errorf("%s: %s", element.Name, err)
+            }
+        }
+
+        // The files follow the description
+        for {
+            header, err := archive.Next()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return err
+            }
+            file, ok := files[header.Name]
+            if !ok {
+                continue
+            }
+            if err := writeImportFile(work, file, archive); err != nil {
+                return err
+            }
+        }
+        for name, file := range files {
+            if !file.found {
+                return errors.New("The archive doesn't contain " + name)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    for _,file := range files {
+        if file.replaced != "" {
+            _ = os.Remove(file.replaced)
+        }
+    }
+    return report, nil
+}
+
+func importMod(db *gorm.DB, game *Game, element ExportedMod, users map[string]*User, gameVersions map[string]*GameVersion, files map[string]*importFile) error {
+    user := users[element.Author]
+    mod := NewMod(element.Name, *user, *game, element.License)
+    mod.Description = element.Description
+    mod.ShortDescription = element.ShortDescription
+    mod.Published = element.Published
+    mod.CreatedAt = element.Created
+    if element.Meta != "" {
+        mod.Meta = element.Meta
+    }
+    if err := db.Set("gorm:save_associations", false).Save(mod).Error; err != nil {
+        return err
+    }
+    if err := mod.AddOwnerRole(db); err != nil {
+        return err
+    }
+    for _,author := range element.SharedAuthors {
+        shared := users[author.Username]
+        if shared == nil {
+            continue
+        }
+        entry := NewSharedAuthor(*shared, *mod)
+        entry.Accepted = author.Accepted
+        if err := db.Set("gorm:save_associations", false).Save(entry).Error; err != nil {
+            return err
+        }
+        if author.Accepted {
+            if _,err := shared.AddRoleTx(db, mod.Name); err != nil {
+                return err
+            }
+        }
+    }
+    for _,version := range element.Versions {
+        gameVersion, ok := gameVersions[version.GameVersion]
+        if !ok || version.File == "" {
+            continue
+        }
+        path := ModVersionPath(*user, *mod, version.FriendlyVersion)
+        modversion := NewModVersion(*mod, version.FriendlyVersion, *gameVersion, "", version.Beta)
+        modversion.DownloadPath = path
+        modversion.Changelog = version.Changelog
+        modversion.SortIndex = version.SortIndex
+        modversion.FileSize = version.Size
+        modversion.CreatedAt = version.Created
+        if err := db.Set("gorm:save_associations", false).Save(modversion).Error; err != nil {
+            return err
+        }
+        if version.FriendlyVersion == element.DefaultVersion {
+            mod.DefaultVersionID = modversion.ID
+        }
+        files[version.File] = &importFile{path: path, checksum: version.Checksum}
+    }
+    if mod.DefaultVersionID == 0 {
+        return nil
+    }
+    return db.Model(mod).UpdateColumn("default_version_id", mod.DefaultVersionID).Error
+}
+
+/*
+ Writes a file into the storage and checks it against the checksum of the export. The file only replaces an existing one once it
+ is complete, and the existing one is put back if the import is rolled back
+ */
+func writeImportFile(work *app.UnitOfWork, file *importFile, content io.Reader) error {
+    target := filepath.Join(app.Settings.Storage, filepath.FromSlash(file.path))
+    upload := target + ".upload"
+    previous := target + ".old"
+    os.MkdirAll(filepath.Dir(target), os.ModePerm)
+    out, err := os.OpenFile(upload, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(upload)
+    hash := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(out, hash), content); err != nil {
+        out.Close()
+        return err
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+    if hex.EncodeToString(hash.Sum(nil)) != file.checksum {
+        return errors.New("The file " + file.path + " doesn't match its checksum")
+    }
+    if _, err := os.Stat(target); err == nil {
+        if err := os.Rename(target, previous); err != nil {
+            return err
+        }
+        work.OnRollback(func() {
+            _ = os.Rename(previous, target)
+        })
+        file.replaced = previous
+    }
+    if err := os.Rename(upload, target); err != nil {
+        return err
+    }
+    work.OnRollback(func() {
+        _ = os.Remove(target)
+    })
+    file.found = true
+    return nil
+}
\ No newline at end of file
@@ -8,11 +8,6 @@
 
 package objects
 
-import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-)
-
 type Featured struct {
     Model
 
@@ -20,28 +15,6 @@ type Featured struct {
     ModID  uint `json:"mod_id" spacedock:"lock"`
 }
 
-func (s *Featured) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Mod), "Mod")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewFeatured(mod Mod) *Featured {
     f := &Featured{
         Mod: mod,
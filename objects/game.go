@@ -9,8 +9,6 @@
 package objects
 
 import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "time"
 )
 
@@ -32,32 +30,6 @@ type Game struct {
     Versions         []GameVersion `json:"-" spacedock:"lock"`
 }
 
-func (s *Game) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Publisher))
-    app.Database.Model(s).Related(&(s.Mods))
-    app.Database.Model(s).Related(&(s.Modlists))
-    app.Database.Model(s).Related(&(s.Versions))
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewGame(name string, publisher Publisher, short string) *Game {
     game := &Game {
         Name: name,
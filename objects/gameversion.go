@@ -8,11 +8,6 @@
 
 package objects
 
-import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-)
-
 type GameVersion struct {
     Model
 
@@ -22,29 +17,6 @@ type GameVersion struct {
     Beta            bool `json:"beta"`
 }
 
-func (s *GameVersion) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Game), "Game")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewGameVersion(friendly_version string, game Game, beta bool) *GameVersion {
     gv := &GameVersion{
         FriendlyVersion: friendly_version,
@@ -8,27 +8,10 @@
 
 package objects
 
-import "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-
 /*
- This function creates tables for all datatypes
+ This function registers the relations and the schema migrations of all datatypes
  */
 func init() {
-    app.CreateTable(&Ability{})
-    app.CreateTable(&DownloadEvent{})
-    app.CreateTable(&FollowEvent{})
-    app.CreateTable(&ReferralEvent{})
-    app.CreateTable(&Featured{})
-    app.CreateTable(&Game{})
-    app.CreateTable(&GameVersion{})
-    app.CreateTable(&Mod{})
-    app.CreateTable(&ModList{})
-    app.CreateTable(&ModListItem{})
-    app.CreateTable(&ModVersion{})
-    app.CreateTable(&Publisher{})
-    app.CreateTable(&Rating{})
-    app.CreateTable(&Role{})
-    app.CreateTable(&SharedAuthor{})
-    app.CreateTable(&Token{})
-    app.CreateTable(&User{})
+    registerRelations()
+    registerMigrations()
 }
\ No newline at end of file
@@ -0,0 +1,74 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "time"
+)
+
+/*
+ An invite code that allows registering an account when registration is invite-only
+ */
+type Invite struct {
+    Model
+
+    Code        string `gorm:"size:64;unique_index" json:"code" spacedock:"lock"`
+    CreatedBy   User `json:"-" spacedock:"lock"`
+    CreatedByID uint `json:"created_by" spacedock:"lock"`
+    Note        string `gorm:"size:1024" json:"note"`
+    MaxUses     int `json:"max_uses"`
+    Uses        int `json:"uses" spacedock:"lock"`
+    ExpiresAt   *time.Time `json:"expires" spacedock:"lock"`
+}
+
+func NewInvite(creator User, maxUses int) *Invite {
+    code, err := utils.RandomHex(12)
+    if err != nil {
+        panic(err)
+    }
+    i := &Invite{
+        Code: code,
+        CreatedByID: creator.ID,
+        MaxUses: maxUses,
+        Uses: 0,
+    }
+    i.Meta = "{}"
+    return i
+}
+
+/*
+ Returns whether the invite can still be used
+ */
+func (invite *Invite) IsValid() bool {
+    if invite.ExpiresAt != nil && invite.ExpiresAt.Before(time.Now()) {
+        return false
+    }
+    return invite.MaxUses == 0 || invite.Uses < invite.MaxUses
+}
+
+/*
+ Uses up the invite with the given code. This is done in one query, so two registrations can't use the last slot at the same time.
+ Returns the invite, or nil if the code is invalid
+ */
+func RedeemInvite(code string) *Invite {
+    invite := &Invite{}
+    app.Database.Where("code = ?", code).First(invite)
+    if code == "" || invite.Code != code || !invite.IsValid() {
+        return nil
+    }
+    result := app.Database.Model(invite).Where("max_uses = 0 OR uses < max_uses").UpdateColumn("uses", gorm.Expr("uses + 1"))
+    if result.RowsAffected != 1 {
+        return nil
+    }
+    invite.Uses += 1
+    return invite
+}
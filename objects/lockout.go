@@ -0,0 +1,62 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "time"
+)
+
+/*
+ What a lockout applies to
+ */
+const (
+    LockoutUser = "user"
+    LockoutIP   = "ip"
+)
+
+/*
+ Blocks logins for a username or from an IP address after too many failed attempts.
+ Cleared lockouts are soft deleted, their ID is used to start counting the failed attempts from zero again
+ */
+type Lockout struct {
+    Model
+
+    Kind      string `gorm:"size:8;index" json:"kind" spacedock:"lock"`
+    Subject   string `gorm:"size:128;index" json:"subject" spacedock:"lock"`
+    IP        string `gorm:"size:64" json:"ip" spacedock:"lock"`
+    ExpiresAt time.Time `json:"expires" spacedock:"lock"`
+}
+
+func NewLockout(kind string, subject string, ip string, duration time.Duration) *Lockout {
+    l := &Lockout{
+        Kind: kind,
+        Subject: subject,
+        IP: ip,
+        ExpiresAt: time.Now().Add(duration),
+    }
+    l.Meta = "{}"
+    return l
+}
+
+/*
+ Returns the most recent lockout for a username or IP address, including cleared and expired ones. Returns nil if there never was one
+ */
+func LatestLockout(kind string, subject string) *Lockout {
+    lockout := &Lockout{}
+    app.Database.Unscoped().Where("kind = ?", kind).Where("subject = ?", subject).Order("id desc").First(lockout)
+    if lockout.Subject != subject {
+        return nil
+    }
+    return lockout
+}
+
+func (lockout *Lockout) IsActive() bool {
+    return lockout.DeletedAt == nil && lockout.ExpiresAt.After(time.Now())
+}
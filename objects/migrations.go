@@ -0,0 +1,232 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects/baseline"
+    "fmt"
+    "github.com/jinzhu/gorm"
+    "time"
+)
+
+/*
+ The schema migrations of the datatypes. New columns get their own migration, with app.AddColumn as Up and app.DropColumn as Down,
+ instead of relying on the first one
+ */
+func registerMigrations() {
+    app.RegisterMigration(1, "create tables", createTables, nil)
+    app.RegisterMigration(2, "move role parameters into their own table", MigrateRoleParams, RestoreRoleParams)
+    app.RegisterMigration(3, "add mirrors", addMirrors, removeMirrors)
+    app.RegisterMigration(4, "count downloads in hourly events", bucketDownloadEvents, unbucketDownloadEvents)
+    app.RegisterMigration(5, "remove deleted roles", removeDeletedRoles, keepDeletedRoles)
+    app.RegisterMigration(6, "hash plaintext tokens", hashPlaintextTokens, nil)
+}
+
+/*
+ Creates the tables that don't exist yet, and adds the columns that databases from before the migrations are missing.
+ It uses the datatypes from the time the migrations were introduced, newer columns and tables come from the later migrations
+ */
+func createTables(db *gorm.DB) error {
+    return db.AutoMigrate(baseline.Models()...).Error
+}
+
+func addMirrors(db *gorm.DB) error {
+    if !db.HasTable(&Mirror{}) {
+        if err := db.CreateTable(&Mirror{}).Error; err != nil {
+            return err
+        }
+    }
+    for _,field := range []string{"MirrorID", "Origin", "OriginID"} {
+        if err := app.AddColumn(db, &Mod{}, field); err != nil {
+            return err
+        }
+    }
+    return app.AddColumn(db, &ModVersion{}, "OriginID")
+}
+
+func removeMirrors(db *gorm.DB) error {
+    for _,column := range []string{"mirror_id", "origin", "origin_id"} {
+        if err := app.DropColumn(db, &Mod{}, column); err != nil {
+            return err
+        }
+    }
+    if err := app.DropColumn(db, &ModVersion{}, "origin_id"); err != nil {
+        return err
+    }
+    return db.DropTableIfExists(&Mirror{}).Error
+}
+
+/*
+ Moves every download event into the hour it was created in, merges events that end up in the same hour,
+ and makes sure there is only one event per version and hour from now on
+ */
+func bucketDownloadEvents(db *gorm.DB) error {
+    if err := app.AddColumn(db, &DownloadEvent{}, "Hour"); err != nil {
+        return err
+    }
+    if db.Dialect().HasIndex("download_events", "idx_download_events_hour") {
+        return nil
+    }
+    type bucket struct {
+        id        uint
+        downloads int
+        hour      time.Time
+    }
+    rows, err := db.Table("download_events").Select("id, mod_id, version_id, downloads, created_at").Order("id").Rows()
+    if err != nil {
+        return err
+    }
+    buckets := map[string]*bucket{}
+    merged := []uint{}
+    for rows.Next() {
+        var id, modID, versionID uint
+        var downloads int
+        var created time.Time
+        if err := rows.Scan(&id, &modID, &versionID, &downloads, &created); err != nil {
+            rows.Close()
+            return err
+        }
+        hour := DownloadHour(created)
+        key := fmt.Sprintf("%d-%d-%d", modID, versionID, hour.Unix())
+        if element, ok := buckets[key]; ok {
+            element.downloads += downloads
+            merged = append(merged, id)
+        } else {
+            buckets[key] = &bucket{id, downloads, hour}
+        }
+    }
+    rows.Close()
+    for _,element := range buckets {
+        err := db.Table("download_events").Where("id = ?", element.id).UpdateColumns(map[string]interface{}{"downloads": element.downloads, "hour": element.hour}).Error
+        if err != nil {
+            return err
+        }
+    }
+    for len(merged) > 0 {
+        batch := merged
+        if len(batch) > 500 {
+            batch = batch[:500]
+        }
+        merged = merged[len(batch):]
+        if err := db.Exec("DELETE FROM download_events WHERE id IN (?)", batch).Error; err != nil {
+            return err
+        }
+    }
+    return db.Model(&DownloadEvent{}).AddUniqueIndex("idx_download_events_hour", "mod_id", "version_id", "hour").Error
+}
+
+func unbucketDownloadEvents(db *gorm.DB) error {
+    if db.Dialect().HasIndex("download_events", "idx_download_events_hour") {
+        if err := db.Model(&DownloadEvent{}).RemoveIndex("idx_download_events_hour").Error; err != nil {
+            return err
+        }
+    }
+    return app.DropColumn(db, &DownloadEvent{}, "hour")
+}
+
+/*
+ Roles used to be deleted softly, which kept their names taken. Nothing references them anymore, so they are removed for good
+ */
+func removeDeletedRoles(db *gorm.DB) error {
+    roles := []Role{}
+    if err := db.Unscoped().Where("deleted_at IS NOT NULL").Find(&roles).Error; err != nil {
+        return err
+    }
+    for i := range roles {
+        if err := roles[i].DeleteTx(db); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*
+ The removed roles were unused, so there is nothing to bring back
+ */
+func keepDeletedRoles(db *gorm.DB) error {
+    return nil
+}
+
+/*
+ Tokens used to be stored in plain text. They are hashed like new ones, so they keep lifting the request limit, and the plaintext is dropped.
+ They belong to no user and have no scopes, so they still can't authenticate anything. The plaintext is gone, so this can't be rolled back
+ */
+func hashPlaintextTokens(db *gorm.DB) error {
+    table := db.NewScope(&Token{}).TableName()
+    if !db.Dialect().HasColumn(table, "token") {
+        return nil
+    }
+    rows, err := db.Table(table).Select("id, token").Where("token IS NOT NULL AND token <> ''").Rows()
+    if err != nil {
+        return err
+    }
+    plain := map[uint]string{}
+    for rows.Next() {
+        var id uint
+        var token string
+        if err := rows.Scan(&id, &token); err != nil {
+            rows.Close()
+            return err
+        }
+        plain[id] = token
+    }
+    rows.Close()
+    for id, token := range plain {
+        prefix := token
+        if len(prefix) > 12 {
+            prefix = prefix[:12]
+        }
+        err := db.Table(table).Where("id = ?", id).UpdateColumns(map[string]interface{}{"hash": HashToken(token), "prefix": prefix}).Error
+        if err != nil {
+            return err
+        }
+    }
+    if err := db.Table(table).Where("scopes IS NULL OR scopes = ''").UpdateColumn("scopes", "{}").Error; err != nil {
+        return err
+    }
+    return app.DropColumn(db, &Token{}, "token")
+}
+
+/*
+ Returns an instance of every datatype that is stored in its own table
+ */
+func Models() []interface{} {
+    return []interface{}{
+        &Ability{},
+        &AuditEntry{},
+        &DigestEntry{},
+        &DownloadEvent{},
+        &FollowEvent{},
+        &ReferralEvent{},
+        &Featured{},
+        &Game{},
+        &GameVersion{},
+        &Mod{},
+        &ModList{},
+        &ModListItem{},
+        &Invite{},
+        &Lockout{},
+        &Mirror{},
+        &ModVersion{},
+        &OAuthClient{},
+        &OAuthCode{},
+        &OAuthConsent{},
+        &OAuthRefreshToken{},
+        &Publisher{},
+        &Rating{},
+        &Role{},
+        &RoleParam{},
+        &Sanction{},
+        &Session{},
+        &SharedAuthor{},
+        &Token{},
+        &User{},
+    }
+}
\ No newline at end of file
@@ -0,0 +1,428 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "archive/zip"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/jinzhu/gorm"
+    "github.com/spf13/cast"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+ A subscription to a game on another SpaceDock backend. Its published mods and their versions are pulled periodically,
+ stored in the local game and owned by the local user of the mirror
+ */
+type Mirror struct {
+    Model
+
+    Origin     string `json:"origin" gorm:"size:512;not null" spacedock:"lock"`
+    RemoteGame string `json:"remote_game" gorm:"size:128;not null" spacedock:"lock"`
+    Game       Game `json:"-" spacedock:"lock"`
+    GameID     uint `json:"game" spacedock:"lock"`
+    User       User `json:"-" spacedock:"lock"`
+    UserID     uint `json:"user" spacedock:"lock"`
+    Enabled    bool `json:"enabled"`
+    SyncedAt   *time.Time `json:"synced_at" spacedock:"lock"`
+    LastError  string `json:"last_error" gorm:"size:4096" spacedock:"lock"`
+}
+
+func NewMirror(origin string, remoteGame string, game Game, user User) *Mirror {
+    mirror := &Mirror{
+        Origin: strings.TrimRight(origin, "/"),
+        RemoteGame: remoteGame,
+        Game: game,
+        GameID: game.ID,
+        User: user,
+        UserID: user.ID,
+        Enabled: true,
+    }
+    mirror.Meta = "{}"
+    return mirror
+}
+
+/*
+ What a sync of a mirror changed. Conflicts are mods and versions that couldn't be mirrored, they are tried again by the next sync
+ */
+type MirrorReport struct {
+    Mods      []string `json:"mods"`
+    Updated   int `json:"updated"`
+    Versions  int `json:"versions"`
+    Conflicts []string `json:"conflicts"`
+}
+
+/*
+ The parts of the public API of the origin that are mirrored
+ */
+type remoteMod struct {
+    ID               uint `json:"id"`
+    Name             string `json:"name"`
+    User             interface{} `json:"user"`
+    Description      string `json:"description"`
+    ShortDescription string `json:"short_description"`
+    License          string `json:"license"`
+    Published        bool `json:"published"`
+    DefaultVersionID uint `json:"default_version_id"`
+}
+
+type remoteVersion struct {
+    ID              uint `json:"id"`
+    Created         time.Time `json:"created"`
+    FriendlyVersion string `json:"friendly_version"`
+    Beta            bool `json:"beta"`
+    GameVersion     struct {
+        FriendlyVersion string `json:"friendly_version"`
+        Beta            bool `json:"beta"`
+    } `json:"gameversion"`
+    DownloadPath    string `json:"download_path"`
+    Changelog       string `json:"changelog"`
+    SortIndex       int `json:"sort_index"`
+    FileSize        int64 `json:"file_size"`
+}
+
+/*
+ A version whose file was downloaded, but that isn't stored yet
+ */
+type mirroredVersion struct {
+    remote remoteVersion
+    path   string
+    upload string
+}
+
+// Syncs can be started by the job and by admins at the same time
+var mirrorLock sync.Mutex
+
+var mirrorClient = &http.Client{Timeout: time.Minute * 10}
+
+/*
+ Pulls the published mods of the remote game and the versions that weren't mirrored yet. Mods that were removed here are not pulled again,
+ and neither are mods whose name is taken by a local mod. Versions that were removed on the origin are kept
+ */
+func SyncMirror(mirror *Mirror) (*MirrorReport, error) {
+    mirrorLock.Lock()
+    defer mirrorLock.Unlock()
+
+    report := &MirrorReport{Mods: []string{}, Conflicts: []string{}}
+    mods := []remoteMod{}
+    err := mirror.fetch("/api/mods/" + url.PathEscape(mirror.RemoteGame) + "?expand=user", &mods)
+    if err == nil {
+        for _,element := range mods {
+            if err := mirror.syncMod(element, report); err != nil {
+                report.Conflicts = append(report.Conflicts, element.Name + ": " + err.Error())
+            }
+        }
+    }
+
+    // Remember the outcome, so admins can see failing mirrors
+    now := time.Now()
+    mirror.SyncedAt = &now
+    mirror.LastError = ""
+    if err != nil {
+        mirror.LastError = err.Error()
+    } else if len(report.Conflicts) > 0 {
+        mirror.LastError = strings.Join(report.Conflicts, "\n")
+    }
+    mirror.LastError = utils.Truncate(mirror.LastError, 4096)
+    app.Database.Model(mirror).UpdateColumns(map[string]interface{}{"synced_at": mirror.SyncedAt, "last_error": mirror.LastError})
+    if err != nil {
+        return nil, err
+    }
+    if len(report.Mods) > 0 || report.Updated > 0 || report.Versions > 0 {
+        utils.ClearModCache(mirror.Game.Short, 0)
+    }
+    return report, nil
+}
+
+/*
+ Syncs all enabled mirrors
+ */
+func SyncMirrors() {
+    mirrors := []Mirror{}
+    app.Database.Where("enabled = ?", true).Find(&mirrors)
+    for i := range mirrors {
+        logMirrorSync(&mirrors[i])
+    }
+}
+
+/*
+ Syncs a mirror in a goroutine. The outcome ends up in SyncedAt and LastError of the mirror
+ */
+func StartMirrorSync(mirror *Mirror) {
+    go func() {
+        defer func() {
+            if r := recover(); r != nil {
+                log.Printf("* Mirror %s/%s failed: %v", mirror.Origin, mirror.RemoteGame, r)
+            }
+        }()
+        logMirrorSync(mirror)
+    }()
+}
+
+func logMirrorSync(mirror *Mirror) {
+    report, err := SyncMirror(mirror)
+    if err != nil {
+        log.Printf("* Mirror %s/%s failed: %s", mirror.Origin, mirror.RemoteGame, err)
+        return
+    }
+    if len(report.Mods) > 0 || report.Versions > 0 {
+        log.Printf("* Mirror %s/%s added %d mods and %d versions", mirror.Origin, mirror.RemoteGame, len(report.Mods), report.Versions)
+    }
+}
+
+/*
+ Checks that the origin is reachable and knows the remote game
+ */
+func (mirror *Mirror) Check() error {
+    parsed, err := url.Parse(mirror.Origin)
+    if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+        return errors.New("The origin has to be an http or https URL")
+    }
+    game := map[string]interface{}{}
+    return mirror.fetch("/api/games/" + url.PathEscape(mirror.RemoteGame), &game)
+}
+
+/*
+ Requests a route of the public API of the origin and decodes its data
+ */
+func (mirror *Mirror) fetch(route string, data interface{}) error {
+    response, err := mirrorClient.Get(mirror.Origin + route)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+    body := struct {
+        Error   bool `json:"error"`
+        Reasons []string `json:"reasons"`
+        Data    json.RawMessage `json:"data"`
+    }{}
+    if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+        return fmt.Errorf("%s returned an invalid response (%s)", route, response.Status)
+    }
+    if body.Error || response.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s failed: %s", route, strings.Join(body.Reasons, ", "))
+    }
+    return json.Unmarshal(body.Data, data)
+}
+
+func (mirror *Mirror) syncMod(remote remoteMod, report *MirrorReport) error {
+    mod := &Mod{}
+    app.Database.Unscoped().Where("mirror_id = ? AND origin_id = ?", mirror.ID, remote.ID).First(mod)
+    if mod.ID != 0 && mod.DeletedAt != nil {
+        return nil
+    }
+    created := mod.ID == 0
+    if created && !remote.Published {
+        return nil
+    }
+    if created {
+        taken := &Mod{}
+        app.Database.Unscoped().Where("name = ?", remote.Name).First(taken)
+        if taken.Name == remote.Name {
+            return errors.New("A local mod uses the same name")
+        }
+        mod = NewMod(remote.Name, mirror.User, mirror.Game, remote.License)
+        mod.MirrorID = mirror.ID
+        mod.Origin = mirror.Origin
+        mod.OriginID = remote.ID
+        if author, ok := remote.User.(map[string]interface{}); ok {
+            mod.SetValue("origin_author", cast.ToString(author["username"]))
+        }
+    }
+    changed := created || mod.Description != remote.Description || mod.ShortDescription != remote.ShortDescription ||
+        mod.License != remote.License || mod.Published != remote.Published
+    mod.Description = remote.Description
+    mod.ShortDescription = remote.ShortDescription
+    mod.License = remote.License
+    mod.Published = remote.Published
+
+    // Download the new versions before touching the database, so the transaction stays short
+    // Unpublished mods only have their state synced, the origin doesn't list their versions
+    versions := []remoteVersion{}
+    if remote.Published {
+        if err := mirror.fetch("/api/mods/" + url.PathEscape(mirror.RemoteGame) + "/" + strconv.Itoa(int(remote.ID)) + "/versions", &versions); err != nil {
+            return err
+        }
+    }
+    existing := map[uint]uint{}
+    if !created {
+        local := []ModVersion{}
+        app.Database.Unscoped().Where("mod_id = ? AND origin_id <> 0", mod.ID).Find(&local)
+        for _,element := range local {
+            existing[element.OriginID] = element.ID
+        }
+    }
+    downloads := []*mirroredVersion{}
+    defer func() {
+        for _,element := range downloads {
+            _ = os.Remove(element.upload)
+        }
+    }()
+    for _,element := range versions {
+        if _,ok := existing[element.ID]; ok {
+            continue
+        }
+        download, err := mirror.download(mod, element)
+        if err != nil {
+            report.Conflicts = append(report.Conflicts, remote.Name + " " + element.FriendlyVersion + ": " + err.Error())
+            continue
+        }
+        downloads = append(downloads, download)
+    }
+    if !changed && len(downloads) == 0 && existing[remote.DefaultVersionID] == mod.DefaultVersionID {
+        return nil
+    }
+
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if created {
+            if err := work.DB.Set("gorm:save_associations", false).Save(mod).Error; err != nil {
+                return err
+            }
+            if err := mod.AddOwnerRole(work.DB); err != nil {
+                return err
+            }
+        } else if changed {
+            // Only the synced columns, downloads and ratings change the mod while its files are pulled
+            synced := map[string]interface{}{
+                "description": mod.Description,
+                "short_description": mod.ShortDescription,
+                "license": mod.License,
+                "published": mod.Published,
+                "updated_at": time.Now(),
+            }
+            if err := work.DB.Model(mod).UpdateColumns(synced).Error; err != nil {
+                return err
+            }
+        }
+        for _,element := range downloads {
+            gameVersion, err := mirror.gameVersion(work.DB, element.remote)
+            if err != nil {
+                return err
+            }
+            modversion := NewModVersion(*mod, element.remote.FriendlyVersion, *gameVersion, "", element.remote.Beta)
+            modversion.DownloadPath = element.path
+            modversion.Changelog = element.remote.Changelog
+            modversion.SortIndex = element.remote.SortIndex
+            modversion.FileSize = element.remote.FileSize
+            modversion.OriginID = element.remote.ID
+            modversion.CreatedAt = element.remote.Created
+            if err := work.DB.Set("gorm:save_associations", false).Save(modversion).Error; err != nil {
+                return err
+            }
+            existing[element.remote.ID] = modversion.ID
+
+            // Move the file last, like a regular upload
+            target := filepath.Join(app.Settings.Storage, filepath.FromSlash(element.path))
+            if err := os.Rename(element.upload, target); err != nil {
+                return err
+            }
+            work.OnRollback(func() {
+                _ = os.Remove(target)
+            })
+        }
+        if id, ok := existing[remote.DefaultVersionID]; ok && id != mod.DefaultVersionID {
+            mod.DefaultVersionID = id
+            if err := work.DB.Model(mod).UpdateColumn("default_version_id", id).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    if created {
+        report.Mods = append(report.Mods, mod.Name)
+    } else if changed {
+        report.Updated += 1
+    }
+    report.Versions += len(downloads)
+    return nil
+}
+
+/*
+ Downloads the file of a version next to where it will be stored
+ */
+func (mirror *Mirror) download(mod *Mod, version remoteVersion) (*mirroredVersion, error) {
+    if version.DownloadPath == "" {
+        return nil, errors.New("The version has no file")
+    }
+    path := ModVersionPath(mirror.User, *mod, version.FriendlyVersion)
+    target := filepath.Join(app.Settings.Storage, filepath.FromSlash(path))
+    os.MkdirAll(filepath.Dir(target), os.ModePerm)
+    download := &mirroredVersion{remote: version, path: path, upload: target + ".upload"}
+
+    response, err := mirrorClient.Get(mirror.Origin + "/content/" + version.DownloadPath)
+    if err != nil {
+        return nil, err
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return nil, errors.New("The file couldn't be downloaded (" + response.Status + ")")
+    }
+    out, err := os.OpenFile(download.upload, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+    if err != nil {
+        return nil, err
+    }
+    size, err := io.Copy(out, response.Body)
+    out.Close()
+    if err == nil && version.FileSize != 0 && size != version.FileSize {
+        err = errors.New("The file is incomplete")
+    }
+    if err == nil {
+        var archive *zip.ReadCloser
+        if archive, err = zip.OpenReader(download.upload); err == nil {
+            archive.Close()
+        }
+    }
+    if err != nil {
+        _ = os.Remove(download.upload)
+        return nil, err
+    }
+    download.remote.FileSize = size
+    return download, nil
+}
+
+/*
+ Returns the local game version of a mirrored version. Game versions that don't exist here yet are created
+ */
+func (mirror *Mirror) gameVersion(db *gorm.DB, version remoteVersion) (*GameVersion, error) {
+    gameVersion := &GameVersion{}
+    db.Where("game_id = ? AND friendly_version = ?", mirror.GameID, version.GameVersion.FriendlyVersion).First(gameVersion)
+    if gameVersion.ID != 0 {
+        return gameVersion, nil
+    }
+    if version.GameVersion.FriendlyVersion == "" {
+        return nil, errors.New("The version " + version.FriendlyVersion + " has no game version")
+    }
+    gameVersion = NewGameVersion(version.GameVersion.FriendlyVersion, mirror.Game, version.GameVersion.Beta)
+    if err := db.Set("gorm:save_associations", false).Save(gameVersion).Error; err != nil {
+        return nil, err
+    }
+    return gameVersion, nil
+}
+
+func init() {
+    if app.Settings.MirrorInterval > 0 {
+        app.RegisterJob("mirror", time.Minute * time.Duration(app.Settings.MirrorInterval), SyncMirrors)
+    }
+}
\ No newline at end of file
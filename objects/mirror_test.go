@@ -0,0 +1,202 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "archive/zip"
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+/*
+ Serves the parts of the public API that mirrors use, with one game called remote
+ */
+type testOrigin struct {
+    lock     sync.Mutex
+    mods     []remoteMod
+    versions map[uint][]remoteVersion
+    file     []byte
+    fetched  func()
+}
+
+func (origin *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    origin.lock.Lock()
+    defer origin.lock.Unlock()
+    if strings.HasPrefix(r.URL.Path, "/content/") {
+        w.Write(origin.file)
+        return
+    }
+    var data interface{}
+    switch r.URL.Path {
+    case "/api/mods/remote":
+        data = origin.mods
+    default:
+        for id, versions := range origin.versions {
+            if r.URL.Path == "/api/mods/remote/" + strconv.Itoa(int(id)) + "/versions" {
+                data = versions
+                if origin.fetched != nil {
+                    origin.fetched()
+                }
+            }
+        }
+    }
+    if data == nil {
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]interface{}{"error": true, "reasons": []string{"Not found"}})
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"error": false, "data": data})
+}
+
+func (origin *testOrigin) addVersion(mod uint, id uint, version string, gameVersion string) {
+    origin.lock.Lock()
+    defer origin.lock.Unlock()
+    remote := remoteVersion{ID: id, Created: time.Now(), FriendlyVersion: version, DownloadPath: "mod-" + version + ".zip"}
+    remote.GameVersion.FriendlyVersion = gameVersion
+    origin.versions[mod] = append(origin.versions[mod], remote)
+    for i := range origin.mods {
+        if origin.mods[i].ID == mod {
+            origin.mods[i].DefaultVersionID = id
+        }
+    }
+}
+
+func TestSyncMirror(t *testing.T) {
+    storage, err := ioutil.TempDir("", "sdb-mirror")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(storage)
+    previous := app.Settings.Storage
+    app.Settings.Storage = storage
+    defer func() {
+        app.Settings.Storage = previous
+    }()
+
+    // A valid zip file for all versions
+    buffer := &bytes.Buffer{}
+    archive := zip.NewWriter(buffer)
+    entry, _ := archive.Create("readme.txt")
+    entry.Write([]byte("mirrored"))
+    archive.Close()
+
+    game, _, local := createTestMod(t)
+    user := NewUser("mirror" + game.Short, "mirror" + game.Short + "@example.com", "password")
+    app.Database.Save(user)
+    name := "Mirrored " + game.Short
+    origin := &testOrigin{
+        mods: []remoteMod{
+            {ID: 1, Name: name, User: map[string]interface{}{"username": "author"}, License: "MIT", Published: true},
+            {ID: 2, Name: local.Name, License: "MIT", Published: true},
+            {ID: 3, Name: "Unpublished " + game.Short, License: "MIT"},
+        },
+        versions: map[uint][]remoteVersion{1: {}, 2: {}},
+        file: buffer.Bytes(),
+    }
+    origin.addVersion(1, 10, "1.0", "1.0")
+    server := httptest.NewServer(origin)
+    defer server.Close()
+
+    created := NewMirror(server.URL, "remote", *game, *user)
+    app.Database.Save(created)
+
+    // Syncs work on mirrors the way they are loaded from the database
+    mirror := &Mirror{}
+    app.Database.Where("id = ?", created.ID).First(mirror)
+    report, err := SyncMirror(mirror)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Mods) != 1 || report.Mods[0] != name || report.Versions != 1 {
+        t.Errorf("The first sync added %v and %d versions, expected %s and 1 version", report.Mods, report.Versions, name)
+    }
+    if len(report.Conflicts) != 1 || !strings.Contains(report.Conflicts[0], local.Name) {
+        t.Errorf("The first sync reported the conflicts %v, expected one for %s", report.Conflicts, local.Name)
+    }
+    stored := &Mirror{}
+    app.Database.Where("id = ?", mirror.ID).First(stored)
+    if stored.SyncedAt == nil || !strings.Contains(stored.LastError, "same name") {
+        t.Errorf("The mirror wasn't updated after the sync, synced at %v with the error %q", stored.SyncedAt, stored.LastError)
+    }
+    mod := &Mod{}
+    app.Database.Where("mirror_id = ? AND origin_id = ?", mirror.ID, 1).First(mod)
+    if mod.Name != name || mod.UserID != user.ID || mod.GameID != game.ID {
+        t.Fatalf("The mirrored mod is %q of user %d in game %d, expected %q of user %d in game %d", mod.Name, mod.UserID, mod.GameID, name, user.ID, game.ID)
+    }
+
+    // A new version on the origin, for a game version that doesn't exist here yet
+    origin.addVersion(1, 11, "1.1", "2.0")
+    report, err = SyncMirror(mirror)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Mods) != 0 || report.Versions != 1 {
+        t.Errorf("The second sync added %v and %d versions, expected no mods and 1 version", report.Mods, report.Versions)
+    }
+    versions := []ModVersion{}
+    app.Database.Where("mod_id = ?", mod.ID).Find(&versions)
+    if len(versions) != 2 {
+        t.Fatalf("The mirrored mod has %d versions, expected 2", len(versions))
+    }
+    for _,element := range versions {
+        if _, err := os.Stat(filepath.Join(storage, filepath.FromSlash(element.DownloadPath))); err != nil {
+            t.Errorf("The file of %s is missing: %s", element.FriendlyVersion, err)
+        }
+        if element.OriginID == 11 {
+            app.Database.Where("id = ?", mod.ID).First(mod)
+            if mod.DefaultVersionID != element.ID {
+                t.Errorf("The default version is %d, expected the new version %d", mod.DefaultVersionID, element.ID)
+            }
+        }
+    }
+    gameVersion := &GameVersion{}
+    app.Database.Where("game_id = ? AND friendly_version = ?", game.ID, "2.0").First(gameVersion)
+    if gameVersion.ID == 0 {
+        t.Error("The game version 2.0 wasn't created")
+    }
+
+    // Nothing changed on the origin
+    report, err = SyncMirror(mirror)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(report.Mods) != 0 || report.Updated != 0 || report.Versions != 0 {
+        t.Errorf("The third sync changed %v, %d mods and %d versions, expected nothing", report.Mods, report.Updated, report.Versions)
+    }
+
+    // A changed description, while the mirrored mod is downloaded here during the sync
+    origin.lock.Lock()
+    origin.mods[0].Description = "Changed"
+    origin.fetched = func() {
+        app.Database.Model(&Mod{}).Where("id = ?", mod.ID).UpdateColumn("download_count", 5)
+    }
+    origin.lock.Unlock()
+    report, err = SyncMirror(mirror)
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.Database.Where("id = ?", mod.ID).First(mod)
+    if report.Updated != 1 || mod.Description != "Changed" {
+        t.Errorf("The fourth sync updated %d mods and left the description %q, expected 1 mod and the new description", report.Updated, mod.Description)
+    }
+    if mod.DownloadCount != 5 {
+        t.Errorf("The mirrored mod has %d downloads after the sync, expected 5", mod.DownloadCount)
+    }
+}
\ No newline at end of file
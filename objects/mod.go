@@ -9,8 +9,8 @@
 package objects
 
 import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "strconv"
 )
 
 type Mod struct {
@@ -37,43 +37,46 @@ type Mod struct {
     Ratings          []Rating `json:"-" spacedock:"lock"`
     TotalScore       float64 `json:"total_score" gorm:"not null" spacedock:"lock"`
     DownloadCount    int64 `json:"download_count" spacedock:"lock"`
+    MirrorID         uint `json:"mirror" spacedock:"lock"`
+    Origin           string `json:"origin" gorm:"size:512" spacedock:"lock"`
+    OriginID         uint `json:"origin_id" spacedock:"lock"`
 }
 
-func (s *Mod) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.User), "User")
-    app.Database.Model(s).Related(&(s.Game), "Game")
-    app.Database.Model(s).Related(&(s.DefaultVersion), "DefaultVersion")
-    app.Database.Model(s).Related(&(s.Versions), "Versions")
-    app.Database.Model(s).Related(&(s.Followers), "Followers")
-    app.Database.Model(s).Related(&(s.Ratings), "Ratings")
-    app.Database.Model(s).Related(&(s.SharedAuthors), "SharedAuthors")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
+/*
+ Columns that are changed in place by downloads and ratings. Saving a mod that was loaded earlier must not write them back
+ */
+var ModCounters = []string{"download_count", "total_score"}
 
 func (mod *Mod) CalculateScore() {
     score := float64(0)
+    count := 0
     for _,element := range mod.Ratings {
+        // Ratings of sanctioned users can be hidden
+        if element.User.HidesContent() {
+            continue
+        }
         score = score + element.Score
+        count += 1
+    }
+    if count == 0 {
+        mod.TotalScore = 0
+        return
     }
-    mod.TotalScore = score / float64(len(mod.Ratings))
+    mod.TotalScore = score / float64(count)
+}
+
+/*
+ Returns whether the mod is hidden because its owner was sanctioned
+ */
+func (mod *Mod) IsHidden() bool {
+    return mod.User.HidesContent()
+}
+
+/*
+ Returns whether the mod was pulled from another instance by a mirror. Mirrored mods can only be changed on their origin
+ */
+func (mod *Mod) IsMirrored() bool {
+    return mod.MirrorID != 0
 }
 
 func NewMod(name string, user User, game Game, license string) *Mod {
@@ -93,4 +96,33 @@ func NewMod(name string, user User, game Game, license string) *Mod {
     }
     mod.Meta = "{}"
     return mod
+}
+
+/*
+ Gives the owner of the mod a role that allows editing and removing it
+ */
+func (mod *Mod) AddOwnerRole(db *gorm.DB) error {
+    role, err := mod.User.AddRoleTx(db, mod.Name)
+    if err != nil {
+        return err
+    }
+    for _,ability := range []string{"mods-edit", "mods-remove"} {
+        if _,err := role.AddAbilityTx(db, ability); err != nil {
+            return err
+        }
+    }
+    if err := role.AddParamTx(db, "mods-edit", "modid", strconv.Itoa(int(mod.ID))); err != nil {
+        return err
+    }
+    return role.AddParamTx(db, "mods-remove", "name", mod.Name)
+}
+
+/*
+ Takes back the role of the owner. Call this after the mod was deleted
+ */
+func (mod *Mod) RemoveOwnerRole(db *gorm.DB) error {
+    return RemoveOwnerRole(db, &mod.User, mod.Name, []RoleParam{
+        {Ability: "mods-edit", Param: "modid", Value: strconv.Itoa(int(mod.ID))},
+        {Ability: "mods-remove", Param: "name", Value: mod.Name},
+    })
 }
\ No newline at end of file
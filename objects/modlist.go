@@ -9,8 +9,8 @@
 package objects
 
 import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "strconv"
 )
 
 type ModList struct {
@@ -26,31 +26,6 @@ type ModList struct {
     Mods             []ModListItem `json:"-" spacedock:"lock"`
 }
 
-func (s *ModList) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.User), "User")
-    app.Database.Model(s).Related(&(s.Game), "Game")
-    app.Database.Model(s).Related(&(s.Mods), "Mods")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewModList(name string, user User, game Game) *ModList {
     modlist := &ModList{
         User: user,
@@ -63,4 +38,33 @@ func NewModList(name string, user User, game Game) *ModList {
     }
     modlist.Meta = "{}"
     return modlist
+}
+
+/*
+ Gives the owner of the list a role that allows editing and removing it
+ */
+func (modlist *ModList) AddOwnerRole(db *gorm.DB) error {
+    role, err := modlist.User.AddRoleTx(db, modlist.Name)
+    if err != nil {
+        return err
+    }
+    for _,ability := range []string{"lists-edit", "lists-remove"} {
+        if _,err := role.AddAbilityTx(db, ability); err != nil {
+            return err
+        }
+    }
+    if err := role.AddParamTx(db, "lists-edit", "listsid", strconv.Itoa(int(modlist.ID))); err != nil {
+        return err
+    }
+    return role.AddParamTx(db, "lists-remove", "name", modlist.Name)
+}
+
+/*
+ Takes back the role of the owner. Call this after the list was deleted
+ */
+func (modlist *ModList) RemoveOwnerRole(db *gorm.DB) error {
+    return RemoveOwnerRole(db, &modlist.User, modlist.Name, []RoleParam{
+        {Ability: "lists-edit", Param: "listsid", Value: strconv.Itoa(int(modlist.ID))},
+        {Ability: "lists-remove", Param: "name", Value: modlist.Name},
+    })
 }
\ No newline at end of file
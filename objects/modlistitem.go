@@ -8,11 +8,6 @@
 
 package objects
 
-import (
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-)
-
 type ModListItem struct {
     Model
 
@@ -23,30 +18,6 @@ type ModListItem struct {
     SortIndex uint `json:"sort_index" spacedock:"lock"`
 }
 
-func (s *ModListItem) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Mod), "Mod")
-    app.Database.Model(s).Related(&(s.ModList), "ModList")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
-}
-
 func NewModListItem(mod Mod, list ModList) *ModListItem {
     modlistitem := &ModListItem{
         Mod: mod,
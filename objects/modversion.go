@@ -10,9 +10,11 @@ package objects
 
 import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
-    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/kennygrant/sanitize"
     "os"
     "path/filepath"
+    "strconv"
+    "strings"
 )
 
 type ModVersion struct {
@@ -27,29 +29,7 @@ type ModVersion struct {
     Changelog       string `json:"changelog" gorm:"size:10000"`
     SortIndex       int `json:"sort_index" spacedock:"lock"`
     FileSize        int64 `json:"file_size" spacedock:"lock"`
-}
-
-func (s *ModVersion) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.GameVersion), "GameVersion")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
+    OriginID        uint `json:"origin_id" spacedock:"lock"`
 }
 
 func NewModVersion(mod Mod, friendly_version string, gameversion GameVersion, download_path string, beta bool) *ModVersion {
@@ -76,4 +56,13 @@ func NewModVersion(mod Mod, friendly_version string, gameversion GameVersion, do
         }
     }
     return mv
+}
+
+/*
+ Returns where the file of a version is stored, relative to the storage directory
+ */
+func ModVersionPath(user User, mod Mod, version string) string {
+    filename := sanitize.BaseName(mod.Name) + "-" + sanitize.BaseName(version) + ".zip"
+    base_path := filepath.Join(sanitize.BaseName(user.Username) + "_" + strconv.Itoa(int(user.ID)), sanitize.BaseName(mod.Name))
+    return strings.Replace(filepath.Join(base_path, filename), "\\", "/", -1)
 }
\ No newline at end of file
@@ -0,0 +1,290 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "strings"
+    "time"
+)
+
+/*
+ How long the different OAuth credentials stay valid
+ */
+const (
+    OAuthCodeLifetime    = time.Minute * 10
+    OAuthAccessLifetime  = time.Hour
+    OAuthRefreshLifetime = time.Hour * 24 * 90
+)
+
+/*
+ A third party application that can ask users for access to their account.
+ Public clients (mod managers running on the users machine) don't have a secret and have to use PKCE.
+ */
+type OAuthClient struct {
+    Model
+
+    Owner        User `json:"-" spacedock:"lock"`
+    OwnerID      uint `json:"owner" spacedock:"lock"`
+    Name         string `gorm:"size:128" json:"name"`
+    Homepage     string `gorm:"size:256" json:"homepage"`
+    Identifier   string `gorm:"size:64;unique_index" json:"client_id" spacedock:"lock"`
+    SecretHash   string `gorm:"size:64" json:"-" spacedock:"lock"`
+    RedirectURIs string `gorm:"size:4096" json:"redirect_uris"`
+}
+
+/*
+ Creates a new client. Returns the client and the plaintext secret, which is empty for public clients
+ */
+func NewOAuthClient(owner User, name string, redirectURIs []string, confidential bool) (*OAuthClient, string) {
+    identifier, err := utils.RandomHex(16)
+    if err != nil {
+        panic(err)
+    }
+    c := &OAuthClient{
+        OwnerID: owner.ID,
+        Name: name,
+        Identifier: identifier,
+        RedirectURIs: strings.Join(redirectURIs, " "),
+    }
+    c.Meta = "{}"
+    secret := ""
+    if confidential {
+        secret, err = utils.RandomHex(32)
+        if err != nil {
+            panic(err)
+        }
+        c.SecretHash = HashToken(secret)
+    }
+    return c, secret
+}
+
+/*
+ Looks up a client by its public client_id. Returns nil if it doesn't exist
+ */
+func FindOAuthClient(identifier string) *OAuthClient {
+    if identifier == "" {
+        return nil
+    }
+    client := &OAuthClient{}
+    app.Database.Where("identifier = ?", identifier).First(client)
+    if client.Identifier != identifier {
+        return nil
+    }
+    return client
+}
+
+func (client *OAuthClient) IsConfidential() bool {
+    return client.SecretHash != ""
+}
+
+func (client *OAuthClient) CheckSecret(secret string) bool {
+    return !client.IsConfidential() || (secret != "" && HashToken(secret) == client.SecretHash)
+}
+
+func (client *OAuthClient) GetRedirectURIs() []string {
+    return strings.Fields(client.RedirectURIs)
+}
+
+func (client *OAuthClient) HasRedirectURI(uri string) bool {
+    e,_ := utils.ArrayContains(uri, client.GetRedirectURIs())
+    return e
+}
+
+/*
+ Removes the client together with everything that was issued to it
+ */
+func (client *OAuthClient) Revoke() {
+    app.Database.Where("client_id = ?", client.ID).Delete(OAuthCode{})
+    app.Database.Where("client_id = ?", client.ID).Delete(OAuthRefreshToken{})
+    app.Database.Where("client_id = ?", client.ID).Delete(OAuthConsent{})
+    app.Database.Where("client_id = ?", client.ID).Delete(Token{})
+    app.Database.Delete(client)
+}
+
+/*
+ Records which scopes a user has granted to a client
+ */
+type OAuthConsent struct {
+    Model
+
+    User     User `json:"-" spacedock:"lock"`
+    UserID   uint `json:"user" spacedock:"lock"`
+    Client   OAuthClient `json:"-" spacedock:"lock"`
+    ClientID uint `json:"client" spacedock:"lock"`
+    Scopes   string `gorm:"size:4096" json:"scopes" spacedock:"lock"`
+}
+
+func NewOAuthConsent(user User, client OAuthClient, scopes []string) *OAuthConsent {
+    c := &OAuthConsent{
+        UserID: user.ID,
+        ClientID: client.ID,
+        Scopes: strings.Join(scopes, " "),
+    }
+    c.Meta = "{}"
+    return c
+}
+
+/*
+ Returns whether the consent already covers all of the given scopes
+ */
+func (consent *OAuthConsent) Covers(scopes []string) bool {
+    granted := strings.Fields(consent.Scopes)
+    for _,scope := range scopes {
+        if e,_ := utils.ArrayContains(scope, granted); !e {
+            return false
+        }
+    }
+    return true
+}
+
+/*
+ A short lived authorization code that can be exchanged for an access token once
+ */
+type OAuthCode struct {
+    Model
+
+    Hash          string `gorm:"size:64;unique_index" json:"-" spacedock:"lock"`
+    UserID        uint `json:"user" spacedock:"lock"`
+    ClientID      uint `json:"client" spacedock:"lock"`
+    RedirectURI   string `gorm:"size:512" json:"redirect_uri" spacedock:"lock"`
+    Scopes        string `gorm:"size:4096" json:"scopes" spacedock:"lock"`
+    Challenge     string `gorm:"size:128" json:"-" spacedock:"lock"`
+    ExpiresAt     time.Time `json:"expires" spacedock:"lock"`
+}
+
+/*
+ Creates a new authorization code. Returns the code object and the plaintext code
+ */
+func NewOAuthCode(user User, client OAuthClient, redirectURI string, scopes []string, challenge string) (*OAuthCode, string) {
+    plain, err := utils.RandomHex(32)
+    if err != nil {
+        panic(err)
+    }
+    c := &OAuthCode{
+        Hash: HashToken(plain),
+        UserID: user.ID,
+        ClientID: client.ID,
+        RedirectURI: redirectURI,
+        Scopes: strings.Join(scopes, " "),
+        Challenge: challenge,
+        ExpiresAt: time.Now().Add(OAuthCodeLifetime),
+    }
+    c.Meta = "{}"
+    return c, plain
+}
+
+/*
+ Looks up an authorization code of a client and removes it, so it can't be used twice. Returns nil if it is invalid,
+ or if a concurrent request redeemed it first
+ */
+func RedeemOAuthCode(plain string, client OAuthClient) *OAuthCode {
+    if plain == "" {
+        return nil
+    }
+    code := &OAuthCode{}
+    hash := HashToken(plain)
+    app.Database.Where("hash = ? AND client_id = ?", hash, client.ID).First(code)
+    if code.Hash != hash {
+        return nil
+    }
+    if app.Database.Where("hash = ? AND client_id = ?", hash, client.ID).Delete(&OAuthCode{}).RowsAffected != 1 {
+        return nil
+    }
+    if code.ExpiresAt.Before(time.Now()) {
+        return nil
+    }
+    return code
+}
+
+/*
+ A long lived token that lets a client request new access tokens. Refresh tokens are rotated on every use
+ */
+type OAuthRefreshToken struct {
+    Model
+
+    Hash      string `gorm:"size:64;unique_index" json:"-" spacedock:"lock"`
+    UserID    uint `json:"user" spacedock:"lock"`
+    ClientID  uint `json:"client" spacedock:"lock"`
+    TokenID   uint `json:"token" spacedock:"lock"`
+    Scopes    string `gorm:"size:4096" json:"scopes" spacedock:"lock"`
+    ExpiresAt time.Time `json:"expires" spacedock:"lock"`
+}
+
+/*
+ Looks up a refresh token of a client and removes it together with the access token it belongs to. Returns nil if it is invalid,
+ or if a concurrent request redeemed it first. Tokens of other clients are left alone, so a leaked token can't revoke their grants
+ */
+func RedeemOAuthRefreshToken(plain string, client OAuthClient) *OAuthRefreshToken {
+    if plain == "" {
+        return nil
+    }
+    refresh := &OAuthRefreshToken{}
+    hash := HashToken(plain)
+    app.Database.Where("hash = ? AND client_id = ?", hash, client.ID).First(refresh)
+    if refresh.Hash != hash {
+        return nil
+    }
+
+    // Only the request that actually removes the token may issue new ones
+    if app.Database.Where("hash = ? AND client_id = ?", hash, client.ID).Delete(&OAuthRefreshToken{}).RowsAffected != 1 {
+        return nil
+    }
+    app.Database.Where("id = ?", refresh.TokenID).Delete(Token{})
+    if refresh.ExpiresAt.Before(time.Now()) {
+        return nil
+    }
+    return refresh
+}
+
+/*
+ Issues an access token and a refresh token for a client. The scopes are abilities of the user.
+ Returns the access token object and the plaintext access and refresh tokens
+ */
+func IssueOAuthTokens(user User, client OAuthClient, scopes []string) (*Token, string, string) {
+    token, access := NewToken(user, client.Name)
+    token.ClientID = client.ID
+    expiry := time.Now().Add(OAuthAccessLifetime)
+    token.ExpiresAt = &expiry
+    s := map[string]map[string][]string{}
+    for _,scope := range scopes {
+        s[scope] = map[string][]string{}
+    }
+    token.SetScopes(s)
+    app.Database.Save(token)
+
+    plain, err := utils.RandomHex(32)
+    if err != nil {
+        panic(err)
+    }
+    refresh := &OAuthRefreshToken{
+        Hash: HashToken(plain),
+        UserID: user.ID,
+        ClientID: client.ID,
+        TokenID: token.ID,
+        Scopes: strings.Join(scopes, " "),
+        ExpiresAt: time.Now().Add(OAuthRefreshLifetime),
+    }
+    refresh.Meta = "{}"
+    app.Database.Save(refresh)
+    return token, access, plain
+}
+
+/*
+ Removes expired authorization codes and refresh tokens
+ */
+func CleanupOAuth() {
+    app.Database.Where("expires_at < ?", time.Now()).Delete(OAuthCode{})
+    app.Database.Where("expires_at < ?", time.Now()).Delete(OAuthRefreshToken{})
+}
+
+func init() {
+    app.RegisterJob("oauth-cleanup", time.Hour, CleanupOAuth)
+}
@@ -0,0 +1,52 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "log"
+    "os"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestMain(m *testing.M) {
+    if err := app.Migrate(); err != nil {
+        log.Fatalf("* %s", err)
+    }
+
+    // The cache belongs to the middleware, which isn't loaded here
+    utils.InvalidFunc = func(cacheKey string) {}
+    os.Exit(m.Run())
+}
+
+/*
+ Creates a game with one version, and a published mod of a new user. The names are unique, so the tests don't collide with earlier runs
+ */
+func createTestMod(t *testing.T) (*Game, *GameVersion, *Mod) {
+    suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+    publisher := NewPublisher("Publisher " + suffix)
+    app.Database.Save(publisher)
+    game := NewGame("Game " + suffix, *publisher, "game-" + suffix)
+    game.Active = true
+    app.Database.Save(game)
+    version := NewGameVersion("1.0", *game, false)
+    app.Database.Save(version)
+    user := NewUser("user" + suffix, "user" + suffix + "@example.com", "password")
+    app.Database.Save(user)
+    mod := NewMod("Mod " + suffix, *user, *game, "MIT")
+    mod.Published = true
+    app.Database.Save(mod)
+    if mod.ID == 0 {
+        t.Fatal("Failed to create the mod")
+    }
+    return game, version, mod
+}
\ No newline at end of file
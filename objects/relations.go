@@ -0,0 +1,195 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "errors"
+    "reflect"
+    "strings"
+)
+
+/*
+ The relations that are loaded for every query of a type, unless the query picks its own.
+ Relations of the loaded objects are only loaded if they are listed here too, so a single query never pulls in more than this
+ */
+var defaultRelations = map[reflect.Type][]string{
+    reflect.TypeOf(DigestEntry{}): {"Mod", "Mod.Game", "Version", "Version.GameVersion"},
+    reflect.TypeOf(Featured{}): {"Mod", "Mod.User", "Mod.Game", "Mod.DefaultVersion"},
+    reflect.TypeOf(Game{}): {"Versions"},
+    reflect.TypeOf(Mirror{}): {"Game", "User"},
+    reflect.TypeOf(Mod{}): {"User", "Game", "DefaultVersion", "DefaultVersion.GameVersion", "Versions", "Versions.GameVersion", "Followers", "Ratings", "Ratings.User", "SharedAuthors", "SharedAuthors.User"},
+    reflect.TypeOf(ModList{}): {"User", "Game", "Mods"},
+    reflect.TypeOf(ModListItem{}): {"Mod"},
+    reflect.TypeOf(ModVersion{}): {"GameVersion"},
+    reflect.TypeOf(OAuthConsent{}): {"Client"},
+    reflect.TypeOf(Rating{}): {"User", "Mod"},
+    reflect.TypeOf(Role{}): {"Abilities", "Params"},
+    reflect.TypeOf(SharedAuthor{}): {"User", "Mod"},
+    reflect.TypeOf(Token{}): {"User"},
+    reflect.TypeOf(User{}): {"Roles", "Roles.Abilities", "Roles.Params", "Following"},
+}
+
+/*
+ The relations clients can ask for with ?include= and ?expand=. Everything else, like the followers of a mod, can only be loaded by the backend itself
+ */
+var includableRelations = map[reflect.Type][]string{
+    reflect.TypeOf(Featured{}): {"Mod"},
+    reflect.TypeOf(Game{}): {"Publisher", "Versions"},
+    reflect.TypeOf(GameVersion{}): {"Game"},
+    reflect.TypeOf(Mod{}): {"User", "Game", "DefaultVersion", "Versions", "SharedAuthors"},
+    reflect.TypeOf(ModList{}): {"User", "Game", "Mods"},
+    reflect.TypeOf(ModVersion{}): {"GameVersion"},
+    reflect.TypeOf(Publisher{}): {"Games"},
+    reflect.TypeOf(SharedAuthor{}): {"User", "Mod"},
+    reflect.TypeOf(User{}): {"Roles"},
+}
+
+/*
+ Preloads the relations of a query in batches, one query per relation instead of one per object
+ */
+func preloadRelations(scope *gorm.Scope) {
+    if _,nested := scope.Get("spacedock:nested"); nested {
+        return
+    }
+
+    // The queries for the relations don't load anything on their own
+    scope.Set("spacedock:nested", true)
+    model := scope.GetModelStruct().ModelType
+    relations := defaultRelations[model]
+    if value, ok := scope.Get("spacedock:relations"); ok {
+        set := value.(relationSet)
+        relations = nil
+        if set.model == model {
+            relations = set.relations
+        }
+    }
+    for _,element := range relations {
+        scope.Search.Preload(element)
+    }
+}
+
+func registerRelations() {
+    app.Database.Callback().Query().Before("gorm:query").Register("spacedock:relations", preloadRelations)
+}
+
+/*
+ The relations a database handle loads for one type
+ */
+type relationSet struct {
+    model     reflect.Type
+    relations []string
+}
+
+/*
+ Returns a database handle that loads exactly the given relations of the model instead of its defaults.
+ Other types are loaded without any relations
+ */
+func WithRelations(db *gorm.DB, model interface{}, relations ...string) *gorm.DB {
+    return db.Set("spacedock:relations", relationSet{reflect.Indirect(reflect.ValueOf(model)).Type(), relations})
+}
+
+/*
+ Turns include names like "versions" or "default_version.gameversion" into the relations that have to be loaded for a type.
+ The names are the ones used in the JSON output, or the field name in snake case for relations that aren't part of it
+ */
+func ResolveIncludes(model interface{}, names []string) ([]string, error) {
+    root := reflect.Indirect(reflect.ValueOf(model)).Type()
+    relations := []string{}
+    for _,name := range names {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        current := root
+        path := []string{}
+        for _,part := range strings.Split(name, ".") {
+            field, ok := includableField(current, part)
+            if !ok {
+                return nil, errors.New("Unknown relation: " + name)
+            }
+            path = append(path, field.Name)
+            current = field.Type
+            if current.Kind() == reflect.Slice {
+                current = current.Elem()
+            }
+        }
+        relations = append(relations, strings.Join(path, "."))
+    }
+    return relations, nil
+}
+
+/*
+ Adds the expanded relations to the output of an object. The names have to be checked with ResolveIncludes first, so the relations are loaded
+ */
+func ExpandRelations(value interface{}, output map[string]interface{}, names []string) {
+    for _,name := range names {
+        expandRelation(reflect.Indirect(reflect.ValueOf(value)), output, strings.Split(strings.TrimSpace(name), "."))
+    }
+}
+
+func expandRelation(value reflect.Value, output map[string]interface{}, path []string) {
+    field, ok := includableField(value.Type(), path[0])
+    if !ok {
+        return
+    }
+    relation := value.FieldByIndex(field.Index)
+    if relation.Kind() == reflect.Slice {
+        items, ok := output[path[0]].([]map[string]interface{})
+        if !ok {
+            items = make([]map[string]interface{}, relation.Len())
+            for i := range items {
+                items[i] = FormatRelation(relation.Index(i).Interface())
+            }
+            output[path[0]] = items
+        }
+        if len(path) > 1 {
+            for i := range items {
+                expandRelation(relation.Index(i), items[i], path[1:])
+            }
+        }
+        return
+    }
+    item, ok := output[path[0]].(map[string]interface{})
+    if !ok {
+        item = FormatRelation(relation.Interface())
+        output[path[0]] = item
+    }
+    if len(path) > 1 {
+        expandRelation(relation, item, path[1:])
+    }
+}
+
+/*
+ Formats a related object for the output. Users only show what their public profile shows, so expanding a relation never reveals more than the user endpoints
+ */
+func FormatRelation(value interface{}) map[string]interface{} {
+    if user, ok := value.(User); ok {
+        if !user.Public {
+            return map[string]interface{}{"id": user.ID, "username": user.Username}
+        }
+        return user.Format(false)
+    }
+    return utils.ToMap(value)
+}
+
+func includableField(model reflect.Type, name string) (reflect.StructField, bool) {
+    for _,element := range includableRelations[model] {
+        field, ok := model.FieldByName(element)
+        if !ok {
+            continue
+        }
+        if tag := field.Tag.Get("json"); (tag != "-" && tag == name) || gorm.ToDBName(field.Name) == name {
+            return field, true
+        }
+    }
+    return reflect.StructField{}, false
+}
\ No newline at end of file
@@ -11,65 +11,90 @@ package objects
 import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
-    "encoding/json"
+    "github.com/jinzhu/gorm"
 )
 
 type Role struct {
     Model
 
-    Name      string `gorm:"size:128;unique_index;not null" spacedock:"lock"`
-    Params    string `gorm:"size:4096" spacedock:"json" spacedock:"lock"`
-    Abilities []Ability `gorm:"many2many:role_abilities" json"-" spacedock:"lock"`
-    Users     []User `gorm:"many2many:role_users" json"-" spacedock:"lock"`
+    Name        string `gorm:"size:128;unique_index;not null" spacedock:"lock"`
+    Description string `gorm:"size:1024" json:"description"`
+    Params      []RoleParam `json:"-" spacedock:"lock"`
+    Abilities   []Ability `gorm:"many2many:role_abilities" json:"-" spacedock:"lock"`
+    Users       []User `gorm:"many2many:role_users" json:"-" spacedock:"lock"`
 }
 
-func (s *Role) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
+func NewRole(name string, description string) *Role {
+    role := &Role{
+        Name: name,
+        Description: description,
+        Params: []RoleParam{},
     }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Abilities), "Abilities")
-    app.Database.Model(s).Related(&(s.Users), "Users")
+    role.Meta = "{}"
+    return role
+}
 
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
+/*
+ Returns whether the user has the role. Compares IDs, so it works no matter which associations were loaded
+ */
+func (role *Role) HasUser(user User) bool {
+    for _,element := range user.Roles {
+        if element.ID == role.ID {
+            return true
+        }
     }
-    app.DBRecursionLock.Unlock()
+    return false
 }
 
 func (role *Role) AddAbility(name string) *Ability {
+    ability, _ := role.AddAbilityTx(app.Database, name)
+    return ability
+}
+
+/*
+ Adds the ability through the given database handle, for example the one of a transaction
+ */
+func (role *Role) AddAbilityTx(db *gorm.DB, name string) (*Ability, error) {
     ability := &Ability {}
-    app.Database.Where("name = ?", name).First(ability)
+    db.Where("name = ?", name).First(ability)
     if ability.Name != name {
         ability.Name = name
         ability.Meta = "{}"
-        app.Database.Save(ability)
+        if err := db.Save(ability).Error; err != nil {
+            return ability, err
+        }
     }
     role.Abilities = append(role.Abilities, *ability)
-    app.Database.Save(role).Save(ability)
-    return &role.Abilities[len(role.Abilities) - 1]
+    if err := db.Save(role).Error; err != nil {
+        return ability, err
+    }
+    if err := db.Save(ability).Error; err != nil {
+        return ability, err
+    }
+    return &role.Abilities[len(role.Abilities) - 1], nil
 }
 
 func (role *Role) RemoveAbility(name string) {
+    role.RemoveAbilityTx(app.Database, name)
+}
+
+/*
+ Removes the ability through the given database handle, for example the one of a transaction
+ */
+func (role *Role) RemoveAbilityTx(db *gorm.DB, name string) error {
     ability := &Ability {}
-    app.Database.Where("name = ?", name).First(ability)
+    db.Where("name = ?", name).First(ability)
     if ability.Name == "" {
-        return
+        return nil
     }
-    if e,i := utils.ArrayContains(ability, role.Abilities); e {
-        role.Abilities = append(role.Abilities[:i], role.Abilities[i + 1:]...)
-        app.Database.Save(role)
+    abilities := []Ability{}
+    for _,element := range role.Abilities {
+        if element.ID != ability.ID {
+            abilities = append(abilities, element)
+        }
     }
+    role.Abilities = abilities
+    return db.Model(role).Association("Abilities").Delete(ability).Error
 }
 
 func (role *Role) HasAbility(name string) bool {
@@ -82,60 +107,177 @@ func (role *Role) HasAbility(name string) bool {
     return e
 }
 
-func (role *Role) GetParams(ability string, param string) []string {
-    var temp map[string]map[string][]string
-    err := json.Unmarshal([]byte(role.Params), &temp)
-    if err != nil {
-        return nil
-    }
-    if _,ok := temp[ability]; ok {
-        if _,ok := temp[ability][param]; ok {
-            return temp[ability][param]
+/*
+ Returns the parameters of the role for an ability and a route parameter
+ */
+func (role *Role) GetParams(ability string, param string) []RoleParam {
+    value := []RoleParam{}
+    for _,element := range role.Params {
+        if element.Ability == ability && element.Param == param {
+            value = append(value, element)
         }
     }
-    return nil
+    return value
 }
 
-func (role *Role) AddParam(ability string, param string, value string) error  {
-    var temp map[string]map[string][]string
-    err := json.Unmarshal([]byte(role.Params), &temp)
-    if err != nil {
-        return err
-    }
-    if _,ok := temp[ability]; !ok {
-        temp[ability] = map[string][]string{}
+/*
+ Adds a parameter the way the code creates them: ".*" allows everything, every other value has to match exactly
+ */
+func (role *Role) AddParam(ability string, param string, value string) error {
+    return role.AddParamTx(app.Database, ability, param, value)
+}
+
+/*
+ Adds the parameter through the given database handle, for example the one of a transaction
+ */
+func (role *Role) AddParamTx(db *gorm.DB, ability string, param string, value string) error {
+    match := MatchExact
+    if value == ".*" {
+        match = MatchRegex
     }
-    if _,ok := temp[ability][param]; !ok {
-        temp[ability][param] = []string{}
+    return role.addParam(db, ability, param, value, match)
+}
+
+func (role *Role) AddParamMatch(ability string, param string, value string, match string) error {
+    return role.addParam(app.Database, ability, param, value, match)
+}
+
+func (role *Role) addParam(db *gorm.DB, ability string, param string, value string, match string) error {
+    if err := ValidateRoleParam(param, value, match); err != nil {
+        return err
     }
-    if ok,_ := utils.ArrayContains(value, temp[ability][param]); !ok {
-        temp[ability][param] = append(temp[ability][param], value)
+    for _,element := range role.GetParams(ability, param) {
+        if element.Value == value && element.Match == match {
+            return nil
+        }
     }
-    val,err := json.Marshal(temp)
-    if err != nil {
+    p := NewRoleParam(*role, ability, param, value, match)
+    if err := db.Save(p).Error; err != nil {
         return err
     }
-    role.Params = string(val)
+    role.Params = append(role.Params, *p)
     return nil
 }
 
 func (role *Role) RemoveParam(ability string, param string, value string) error {
-    var temp map[string]map[string][]string
-    err := json.Unmarshal([]byte(role.Params), &temp)
-    if err != nil {
-        return err
+    return role.RemoveParamTx(app.Database, ability, param, value)
+}
+
+/*
+ Removes the parameter through the given database handle, for example the one of a transaction
+ */
+func (role *Role) RemoveParamTx(db *gorm.DB, ability string, param string, value string) error {
+    params := []RoleParam{}
+    for _,element := range role.Params {
+        if element.Ability == ability && element.Param == param && element.Value == value {
+            if err := db.Delete(&element).Error; err != nil {
+                return err
+            }
+        } else {
+            params = append(params, element)
+        }
     }
-    if _,ok := temp[ability]; ok {
-        if _,ok := temp[ability][param]; ok {
-            if ok,index := utils.ArrayContains(value, temp[ability][param]); ok {
-                temp[ability][param] = append(temp[ability][param][:index], temp[ability][param][index+1:]...)
+    role.Params = params
+    return nil
+}
+
+/*
+ Takes back the owner role of a mod or a list. Only the given parameters are removed, and the abilities that no parameter refers to anymore.
+ The user keeps the role if they own something else of the same name, and the role is only deleted once nothing is left in it
+ and nothing else is named like it
+ */
+func RemoveOwnerRole(db *gorm.DB, user *User, name string, params []RoleParam) error {
+    role := &Role{}
+    db.Where("name = ?", name).First(role)
+    if role.ID == 0 || role.Name != name {
+        return nil
+    }
+    for _,element := range params {
+        if err := role.RemoveParamTx(db, element.Ability, element.Param, element.Value); err != nil {
+            return err
+        }
+    }
+    for _,element := range params {
+        needed := false
+        for _,param := range role.Params {
+            needed = needed || param.Ability == element.Ability
+        }
+        if !needed {
+            if err := role.RemoveAbilityTx(db, element.Ability); err != nil {
+                return err
             }
         }
     }
-    val,err := json.Marshal(temp)
-    if err != nil {
+
+    // Other mods and lists of the user with the same name still need the role
+    owned := 0
+    for _,model := range []interface{}{&Mod{}, &ModList{}} {
+        count := 0
+        db.Model(model).Where("name = ? AND user_id = ?", name, user.ID).Count(&count)
+        owned += count
+    }
+    if owned == 0 && user.Username != name {
+        if err := user.RemoveRoleTx(db, name); err != nil {
+            return err
+        }
+    }
+    if len(role.Params) > 0 || len(role.Abilities) > 0 || len(role.Owners(db)) > 0 {
+        return nil
+    }
+    return role.DeleteTx(db)
+}
+
+/*
+ Deletes the role with its parameters and memberships through the given database handle. The row is removed for good,
+ since its name would stay taken by the unique index otherwise
+ */
+func (role *Role) DeleteTx(db *gorm.DB) error {
+    if err := db.Unscoped().Where("role_id = ?", role.ID).Delete(RoleParam{}).Error; err != nil {
         return err
     }
-    role.Params = string(val)
-    return nil
+    for _,association := range []string{"Abilities", "Users"} {
+        if err := db.Model(role).Association(association).Clear().Error; err != nil {
+            return err
+        }
+    }
+    return db.Unscoped().Delete(role).Error
+}
+
+/*
+ Returns what the role belongs to. The roles of users, games, mods and mod lists are named after them, and the code finds them by that name
+ */
+func (role *Role) Owners(db *gorm.DB) []string {
+    owners := []string{}
+    checks := []struct {
+        owner  string
+        model  interface{}
+        column string
+    }{
+        {"user", &User{}, "username"},
+        {"game", &Game{}, "short"},
+        {"mod", &Mod{}, "name"},
+        {"list", &ModList{}, "name"},
+    }
+    for _,element := range checks {
+        count := 0
+        db.Model(element.model).Where(element.column + " = ?", role.Name).Count(&count)
+        if count > 0 {
+            owners = append(owners, element.owner)
+        }
+    }
+    return owners
+}
+
+/*
+ Groups the parameters by ability and route parameter, for displaying them
+ */
+func (role *Role) ParamMap() map[string]map[string][]map[string]string {
+    value := map[string]map[string][]map[string]string{}
+    for _,element := range role.Params {
+        if _,ok := value[element.Ability]; !ok {
+            value[element.Ability] = map[string][]map[string]string{}
+        }
+        value[element.Ability][element.Param] = append(value[element.Ability][element.Param], map[string]string{"value": element.Value, "match": element.Match})
+    }
+    return value
 }
\ No newline at end of file
@@ -0,0 +1,217 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "encoding/json"
+    "errors"
+    "github.com/jinzhu/gorm"
+    "github.com/spf13/cast"
+    "log"
+    "regexp"
+    "strings"
+)
+
+/*
+ How the value of a role parameter is compared with the value from the request
+ */
+const (
+    MatchExact  = "exact"
+    MatchPrefix = "prefix"
+    MatchRegex  = "regex"
+)
+
+var MatchModes = []string{MatchExact, MatchPrefix, MatchRegex}
+
+/*
+ Limits an ability of a role to certain values of a route parameter, for example the mods-edit ability to one modid
+ */
+type RoleParam struct {
+    Model
+
+    RoleID  uint `gorm:"index" json:"role" spacedock:"lock"`
+    Ability string `gorm:"size:128;index" json:"ability" spacedock:"lock"`
+    Param   string `gorm:"size:128" json:"param" spacedock:"lock"`
+    Value   string `gorm:"size:1024" json:"value" spacedock:"lock"`
+    Match   string `gorm:"size:8" json:"match" spacedock:"lock"`
+}
+
+func NewRoleParam(role Role, ability string, param string, value string, match string) *RoleParam {
+    p := &RoleParam{
+        RoleID: role.ID,
+        Ability: ability,
+        Param: param,
+        Value: value,
+        Match: match,
+    }
+    p.Meta = "{}"
+    return p
+}
+
+/*
+ Checks that a parameter can be stored
+ */
+func ValidateRoleParam(param string, value string, match string) error {
+    if param == "" || len(param) > 128 {
+        return errors.New("The parameter name is invalid.")
+    }
+    if value == "" || len(value) > 1024 {
+        return errors.New("The parameter value is invalid.")
+    }
+    switch match {
+    case MatchExact, MatchPrefix:
+        return nil
+    case MatchRegex:
+        if _, err := regexp.Compile(value); err != nil {
+            return errors.New("The regular expression is invalid: " + err.Error())
+        }
+        return nil
+    }
+    return errors.New("The match mode must be one of exact, prefix or regex.")
+}
+
+/*
+ Guesses the match mode of a value that was stored without one. Values without special characters are meant literally
+ */
+func GuessMatch(value string) string {
+    if regexp.QuoteMeta(value) != value {
+        return MatchRegex
+    }
+    return MatchExact
+}
+
+/*
+ Returns whether a value from the request is allowed by the parameter. Regular expressions have to match the whole value
+ */
+func (p *RoleParam) Matches(value string) (bool, error) {
+    if value == "" {
+        return false, nil
+    }
+    switch p.Match {
+    case MatchExact:
+        return p.Value == value, nil
+    case MatchPrefix:
+        return strings.HasPrefix(value, p.Value), nil
+    case MatchRegex:
+        r, err := regexp.Compile("^(?:" + p.Value + ")$")
+        if err != nil {
+            return false, err
+        }
+        return r.MatchString(value), nil
+    }
+    return false, errors.New("Unknown match mode " + p.Match)
+}
+
+/*
+ Converts the JSON blobs that were stored in roles.params before the parameters got their own table.
+ Values that contain no special characters were always meant literally, everything else stays a regular expression
+ */
+func MigrateRoleParams(db *gorm.DB) error {
+    if !db.Dialect().HasColumn("roles", "params") {
+        return nil
+    }
+    rows, err := db.Table("roles").Select("id, params").Rows()
+    if err != nil {
+        return err
+    }
+    legacy := map[uint]string{}
+    for rows.Next() {
+        var id uint
+        var params *string
+        if err := rows.Scan(&id, &params); err == nil && params != nil {
+            legacy[id] = *params
+        }
+    }
+    rows.Close()
+
+    for id, params := range legacy {
+        role := Role{}
+        role.ID = id
+        for ability, values := range utils.LoadJSON(params) {
+            for param, list := range cast.ToStringMap(values) {
+                for _,value := range cast.ToStringSlice(list) {
+                    match := GuessMatch(value)
+                    if ValidateRoleParam(param, value, match) != nil {
+                        log.Printf("* Skipped the invalid parameter %s.%s=%s of role %d", ability, param, value, id)
+                        continue
+                    }
+                    if err := db.Save(NewRoleParam(role, ability, param, value, match)).Error; err != nil {
+                        return err
+                    }
+                }
+            }
+        }
+    }
+    log.Printf("* Migrated the parameters of %d roles", len(legacy))
+    return db.Model(&Role{}).DropColumn("params").Error
+}
+
+/*
+ The column that held the parameters of a role as JSON before they got their own table
+ */
+type legacyRoleParams struct {
+    Params string `gorm:"size:4096"`
+}
+
+func (legacyRoleParams) TableName() string {
+    return "roles"
+}
+
+/*
+ Moves the parameters back into the JSON blobs of roles.params, undoing MigrateRoleParams. The blobs only know regular expressions
+ that match anywhere in the value, so the values are anchored to keep allowing the same things
+ */
+func RestoreRoleParams(db *gorm.DB) error {
+    if err := app.AddColumn(db, &legacyRoleParams{}, "Params"); err != nil {
+        return err
+    }
+    params := []RoleParam{}
+    if err := db.Find(&params).Error; err != nil {
+        return err
+    }
+    legacy := map[uint]map[string]map[string][]string{}
+    for _,element := range params {
+        value := element.Value
+        switch element.Match {
+        case MatchExact:
+            if GuessMatch(value) != MatchExact {
+                value = "^" + regexp.QuoteMeta(value) + "$"
+            }
+        case MatchPrefix:
+            value = "^" + regexp.QuoteMeta(value) + ".*"
+        case MatchRegex:
+            if value != ".*" {
+                value = "^(?:" + value + ")$"
+            }
+        }
+        if _,ok := legacy[element.RoleID]; !ok {
+            legacy[element.RoleID] = map[string]map[string][]string{}
+        }
+        if _,ok := legacy[element.RoleID][element.Ability]; !ok {
+            legacy[element.RoleID][element.Ability] = map[string][]string{}
+        }
+        legacy[element.RoleID][element.Ability][element.Param] = append(legacy[element.RoleID][element.Ability][element.Param], value)
+    }
+    if err := db.Table("roles").UpdateColumn("params", "{}").Error; err != nil {
+        return err
+    }
+    for id, values := range legacy {
+        blob, err := json.Marshal(values)
+        if err != nil {
+            return err
+        }
+        if err := db.Table("roles").Where("id = ?", id).UpdateColumn("params", string(blob)).Error; err != nil {
+            return err
+        }
+    }
+    log.Printf("* Restored the parameters of %d roles", len(legacy))
+    return db.Exec("DELETE FROM role_params").Error
+}
\ No newline at end of file
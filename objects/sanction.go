@@ -0,0 +1,174 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "time"
+)
+
+/*
+ The kinds of sanctions
+ */
+const (
+    SanctionSuspension = "suspension"
+    SanctionBan        = "ban"
+)
+
+/*
+ A suspension or ban of a user. The records are kept after a sanction ends or gets lifted, so admins can see the history of an account
+ */
+type Sanction struct {
+    Model
+
+    User        User `json:"-" spacedock:"lock"`
+    UserID      uint `json:"user" spacedock:"lock"`
+    Issuer      User `json:"-" spacedock:"lock"`
+    IssuerID    uint `json:"issuer" spacedock:"lock"`
+    Kind        string `gorm:"size:16" json:"kind" spacedock:"lock"`
+    Reason      string `gorm:"size:4096" json:"reason" spacedock:"lock"`
+    HideContent bool `json:"hide_content" spacedock:"lock"`
+    ExpiresAt   *time.Time `json:"expires" spacedock:"lock"`
+    LiftedAt    *time.Time `json:"lifted" spacedock:"lock"`
+    LiftedByID  uint `json:"lifted_by" spacedock:"lock"`
+    Appeal      string `gorm:"size:10000" json:"appeal"`
+}
+
+func NewSanction(user User, issuer User, kind string, reason string, hideContent bool) *Sanction {
+    s := &Sanction{
+        UserID: user.ID,
+        IssuerID: issuer.ID,
+        Kind: kind,
+        Reason: reason,
+        HideContent: hideContent,
+    }
+    s.Meta = "{}"
+    return s
+}
+
+func (sanction *Sanction) IsActive() bool {
+    if sanction.LiftedAt != nil {
+        return false
+    }
+    return sanction.ExpiresAt == nil || sanction.ExpiresAt.After(time.Now())
+}
+
+/*
+ Returns the sanction that currently applies to the user, or nil
+ */
+func ActiveSanction(userID uint) *Sanction {
+    var sanctions []Sanction
+    app.Database.Where("user_id = ?", userID).Where("lifted_at IS NULL").Order("created_at desc").Find(&sanctions)
+    for i,element := range sanctions {
+        if element.IsActive() {
+            return &sanctions[i]
+        }
+    }
+    return nil
+}
+
+/*
+ Returns whether the user is suspended or banned right now
+ */
+func (user *User) IsSanctioned() bool {
+    return user.Banned || (user.SuspendedUntil != nil && user.SuspendedUntil.After(time.Now()))
+}
+
+/*
+ Returns whether the mods and ratings of the user are hidden from everyone else
+ */
+func (user *User) HidesContent() bool {
+    return user.ContentHidden && user.IsSanctioned()
+}
+
+/*
+ Suspends or bans the user. A suspension without duration is turned into a ban
+ */
+func (user *User) Sanction(sanction *Sanction, duration time.Duration) {
+    if duration > 0 && sanction.Kind == SanctionSuspension {
+        expiry := time.Now().Add(duration)
+        sanction.ExpiresAt = &expiry
+    } else {
+        sanction.Kind = SanctionBan
+        sanction.ExpiresAt = nil
+    }
+    app.Database.Save(sanction)
+    user.applySanctions()
+    RevokeSessions(user.ID, 0)
+}
+
+/*
+ Ends a sanction before it runs out
+ */
+func (user *User) LiftSanction(sanction *Sanction, admin User) {
+    now := time.Now()
+    sanction.LiftedAt = &now
+    sanction.LiftedByID = admin.ID
+    app.Database.Save(sanction)
+    user.applySanctions()
+}
+
+/*
+ Copies the state of the active sanction into the user, so permission checks don't need another query
+ */
+func (user *User) applySanctions() {
+    hidden := user.ContentHidden
+    user.Banned = false
+    user.SuspendedUntil = nil
+    user.ContentHidden = false
+    if sanction := ActiveSanction(user.ID); sanction != nil {
+        user.Banned = sanction.Kind == SanctionBan
+        user.SuspendedUntil = sanction.ExpiresAt
+        user.ContentHidden = sanction.HideContent
+    }
+    app.NoAssociations(func() { app.Database.Save(user) })
+    if hidden != user.ContentHidden {
+        user.refreshContent()
+    }
+    utils.ClearUserCache(user.ID)
+}
+
+/*
+ Recalculates the scores of the mods the user rated and clears the caches of their mods after their content was hidden or shown again
+ */
+func (user *User) refreshContent() {
+    var ratings []Rating
+    app.Database.Where("user_id = ?", user.ID).Find(&ratings)
+    for _,element := range ratings {
+        mod := &Mod{}
+        app.Database.Where("id = ?", element.ModID).First(mod)
+        if mod.ID != element.ModID {
+            continue
+        }
+        mod.CalculateScore()
+        app.Database.Model(mod).UpdateColumn("total_score", mod.TotalScore)
+        utils.ClearModCache(mod.Game.Short, mod.ID)
+    }
+    var mods []Mod
+    app.Database.Where("user_id = ?", user.ID).Find(&mods)
+    for _,element := range mods {
+        utils.ClearModCache(element.Game.Short, element.ID)
+    }
+}
+
+/*
+ Expired suspensions are cleared from the users, so their content shows up again
+ */
+func ExpireSanctions() {
+    var users []User
+    app.Database.Where("suspended_until < ?", time.Now()).Find(&users)
+    for _,element := range users {
+        element.applySanctions()
+    }
+}
+
+func init() {
+    app.RegisterJob("sanction-expiry", time.Minute * 10, ExpireSanctions)
+}
\ No newline at end of file
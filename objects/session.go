@@ -0,0 +1,133 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "time"
+)
+
+/*
+ How long a login waits for the second factor
+ */
+const PendingSessionLifetime = time.Minute * 5
+
+/*
+ How long an admin can stay logged in as another user
+ */
+const ImpersonationLifetime = time.Hour
+
+/*
+ A login session of a user. Only a hash of the session ID is stored, the plaintext lives in the cookie.
+ Pending sessions belong to logins that still need the two-factor authentication code
+ */
+type Session struct {
+    Model
+
+    UserID         uint `json:"user" spacedock:"lock"`
+    Hash           string `gorm:"size:64;unique_index" json:"-" spacedock:"lock"`
+    Pending        bool `json:"-" spacedock:"lock"`
+    UserAgent      string `gorm:"size:512" json:"user_agent" spacedock:"lock"`
+    IP             string `gorm:"size:64" json:"ip" spacedock:"lock"`
+    LastSeenAt     time.Time `json:"last_seen" spacedock:"lock"`
+    ExpiresAt      time.Time `json:"expires" spacedock:"lock"`
+    ImpersonatorID uint `json:"-" spacedock:"lock"`
+}
+
+/*
+ Creates a new session for a user. Returns the session and the plaintext session ID for the cookie
+ */
+func NewSession(user User, userAgent string, ip string, pending bool) (*Session, string) {
+    plain, err := utils.RandomHex(32)
+    if err != nil {
+        panic(err)
+    }
+    days := app.Settings.SessionLifetime
+    if days <= 0 {
+        days = 30
+    }
+    lifetime := time.Hour * 24 * time.Duration(days)
+    if pending {
+        lifetime = PendingSessionLifetime
+    }
+    userAgent = utils.Truncate(userAgent, 512)
+    s := &Session{
+        UserID: user.ID,
+        Hash: HashToken(plain),
+        Pending: pending,
+        UserAgent: userAgent,
+        IP: ip,
+        LastSeenAt: time.Now(),
+        ExpiresAt: time.Now().Add(lifetime),
+    }
+    s.Meta = "{}"
+    return s, plain
+}
+
+/*
+ Looks up a session by the plaintext ID from the cookie. Returns nil if it doesn't exist or is expired
+ */
+func FindSession(plain string) *Session {
+    return FindSessionTx(app.Database, plain)
+}
+
+/*
+ Looks up the session through the given database handle
+ */
+func FindSessionTx(db *gorm.DB, plain string) *Session {
+    if plain == "" {
+        return nil
+    }
+    session := &Session{}
+    hash := HashToken(plain)
+    db.Where("hash = ?", hash).First(session)
+    if session.Hash != hash || session.ExpiresAt.Before(time.Now()) {
+        return nil
+    }
+    return session
+}
+
+/*
+ Records that the session was used. To save database writes, this only happens once per minute
+ */
+func (session *Session) Touch(ip string) {
+    session.TouchTx(app.Database, ip)
+}
+
+/*
+ Records the use of the session through the given database handle
+ */
+func (session *Session) TouchTx(db *gorm.DB, ip string) {
+    if time.Since(session.LastSeenAt) < time.Minute && session.IP == ip {
+        return
+    }
+    session.LastSeenAt = time.Now()
+    session.IP = ip
+    db.Model(session).UpdateColumns(map[string]interface{}{"last_seen_at": session.LastSeenAt, "ip": ip})
+}
+
+/*
+ Logs a user out everywhere, except for the session with the given ID (pass 0 to remove all of them)
+ */
+func RevokeSessions(userID uint, except uint) {
+    app.Database.Where("user_id = ?", userID).Where("id <> ?", except).Delete(Session{})
+}
+
+/*
+ Removes expired sessions
+ */
+func CleanupSessions() {
+    app.Database.Where("expires_at < ?", time.Now()).Delete(Session{})
+}
+
+func init() {
+    app.RegisterJob("session-cleanup", time.Hour, CleanupSessions)
+}
@@ -9,28 +9,118 @@
 package objects
 
 import (
-    "crypto/md5"
-    "crypto/rand"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "crypto/sha256"
     "encoding/hex"
+    "encoding/json"
+    "github.com/jinzhu/gorm"
+    "time"
 )
 
+/*
+ A personal access token. Only a hash of the token is stored, the plaintext is shown once on creation.
+ Scopes limit the abilities and their parameters with regular expressions: {"ability": {"param": ["regex"]}}
+ Tokens that were issued to an OAuth client have a ClientID, personal tokens don't.
+ */
 type Token struct {
     Model
 
-    Token  string `gorm:"size:32" spacedock:"lock" json:"token"`
+    User       User `json:"-" spacedock:"lock"`
+    UserID     uint `json:"user" spacedock:"lock"`
+    Name       string `gorm:"size:128" json:"name"`
+    Hash       string `gorm:"size:64;unique_index" json:"-" spacedock:"lock"`
+    Prefix     string `gorm:"size:16" json:"prefix" spacedock:"lock"`
+    Scopes     string `gorm:"size:4096" json:"scopes" spacedock:"json"`
+    ExpiresAt  *time.Time `json:"expires" spacedock:"lock"`
+    LastUsedAt *time.Time `json:"last_used" spacedock:"lock"`
+    LastUsedIP string `gorm:"size:64" json:"last_used_ip" spacedock:"lock"`
+    ClientID   uint `json:"client" spacedock:"lock"`
 }
 
-func NewToken() *Token {
-    key := make([]byte, 64)
-    _, err := rand.Read(key)
+/*
+ Creates a new token for a user. Returns the token object and the plaintext token
+ */
+func NewToken(user User, name string) (*Token, string) {
+    secret, err := utils.RandomHex(32)
     if err != nil {
         panic(err) // aahhh
     }
-    hash := md5.New()
-    hash.Write(key)
+    plain := "sdb_" + secret
     t := &Token{
-        Token:string(hex.EncodeToString(hash.Sum(nil))),
+        UserID: user.ID,
+        Name: name,
+        Hash: HashToken(plain),
+        Prefix: plain[:12],
+        Scopes: "{}",
     }
     t.Meta = "{}"
-    return t
-}
\ No newline at end of file
+    return t, plain
+}
+
+func HashToken(plain string) string {
+    sum := sha256.Sum256([]byte(plain))
+    return hex.EncodeToString(sum[:])
+}
+
+/*
+ Looks up a token by its plaintext value. Returns nil if the token doesn't exist or is expired
+ */
+func FindToken(plain string) *Token {
+    return FindTokenTx(app.Database, plain)
+}
+
+/*
+ Looks up the token through the given database handle
+ */
+func FindTokenTx(db *gorm.DB, plain string) *Token {
+    if plain == "" {
+        return nil
+    }
+    token := &Token{}
+    hash := HashToken(plain)
+    db.Where("hash = ?", hash).First(token)
+    if token.Hash != hash || token.IsExpired() {
+        return nil
+    }
+    return token
+}
+
+func (token *Token) IsExpired() bool {
+    return token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now())
+}
+
+func (token *Token) GetScopes() map[string]map[string][]string {
+    var temp map[string]map[string][]string
+    err := json.Unmarshal([]byte(token.Scopes), &temp)
+    if err != nil || temp == nil {
+        return map[string]map[string][]string{}
+    }
+    return temp
+}
+
+func (token *Token) SetScopes(scopes map[string]map[string][]string) error {
+    val,err := json.Marshal(scopes)
+    if err != nil {
+        return err
+    }
+    token.Scopes = string(val)
+    return nil
+}
+
+/*
+ Records that the token was used
+ */
+func (token *Token) Touch(ip string) {
+    token.TouchTx(app.Database, ip)
+}
+
+/*
+ Records the use of the token through the given database handle
+ */
+func (token *Token) TouchTx(db *gorm.DB, ip string) {
+    now := time.Now()
+    token.LastUsedAt = &now
+    token.LastUsedIP = ip
+    db.Model(token).UpdateColumns(map[string]interface{}{"last_used_at": now, "last_used_ip": ip})
+}
@@ -0,0 +1,44 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestHashPlaintextTokens(t *testing.T) {
+    // A token the way it was stored before they were hashed
+    if err := app.Database.Exec("ALTER TABLE tokens ADD token VARCHAR(32)").Error; err != nil {
+        t.Fatal(err)
+    }
+    plain := strconv.FormatInt(time.Now().UnixNano(), 16)
+    if err := app.Database.Exec("INSERT INTO tokens (created_at, updated_at, meta, token) VALUES (?, ?, ?, ?)", time.Now(), time.Now(), `{"ips":["127.0.0.1"]}`, plain).Error; err != nil {
+        t.Fatal(err)
+    }
+
+    if err := hashPlaintextTokens(app.Database); err != nil {
+        t.Fatal(err)
+    }
+    if app.Database.Dialect().HasColumn("tokens", "token") {
+        t.Error("The plaintext column wasn't dropped")
+    }
+    token := FindToken(plain)
+    if token == nil {
+        t.Fatal("The token can't be found by its plaintext anymore")
+    }
+    if token.UserID != 0 || len(token.GetScopes()) != 0 {
+        t.Errorf("The token belongs to user %d with the scopes %v, expected no user and no scopes", token.UserID, token.GetScopes())
+    }
+    if _,ips := token.GetValue("ips"); ips == nil {
+        t.Error("The token lost the IP addresses it lifts the request limit for")
+    }
+}
\ No newline at end of file
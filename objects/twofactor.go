@@ -0,0 +1,128 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package objects
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jinzhu/gorm"
+    "strings"
+)
+
+/*
+ How many recovery codes a user gets when enabling two-factor authentication
+ */
+const RecoveryCodeCount = 10
+
+/*
+ Generates a new TOTP secret for the user. It is only used for logins after EnableTwoFactor was called
+ */
+func (user *User) NewTotpSecret() (string, error) {
+    secret, err := utils.NewTotpSecret()
+    if err != nil {
+        return "", err
+    }
+    user.TotpSecret = secret
+    user.TotpLastStep = 0
+    return secret, nil
+}
+
+/*
+ Returns the URI that authenticator apps use to add the account
+ */
+func (user *User) TotpURI() string {
+    issuer := app.Settings.SiteName
+    if issuer == "" {
+        issuer = "SpaceDock"
+    }
+    return utils.TotpURI(issuer, user.Username, user.TotpSecret)
+}
+
+/*
+ Checks a TOTP code against the secret of the user. A code is only accepted once
+ */
+func (user *User) CheckTotp(code string) bool {
+    if user.TotpSecret == "" {
+        return false
+    }
+    step, ok := utils.CheckTotp(user.TotpSecret, strings.TrimSpace(code), user.TotpLastStep)
+    if ok {
+        user.TotpLastStep = step
+    }
+    return ok
+}
+
+/*
+ Checks a code from an authenticator app or a recovery code. Recovery codes are removed after use
+ */
+func (user *User) CheckTwoFactor(code string) bool {
+    if user.CheckTotp(code) {
+        return true
+    }
+    hash := HashToken(strings.ToLower(strings.TrimSpace(code)))
+    codes := strings.Fields(user.RecoveryCodes)
+    if e,i := utils.ArrayContains(hash, codes); e {
+        user.RecoveryCodes = strings.Join(append(codes[:i], codes[i + 1:]...), " ")
+        return true
+    }
+    return false
+}
+
+/*
+ Replaces the recovery codes of the user. Returns the plaintext codes, only their hashes are stored
+ */
+func (user *User) NewRecoveryCodes() []string {
+    codes := make([]string, RecoveryCodeCount)
+    hashes := make([]string, RecoveryCodeCount)
+    for i := range codes {
+        code, err := utils.RandomHex(5)
+        if err != nil {
+            panic(err)
+        }
+        codes[i] = code[:5] + "-" + code[5:]
+        hashes[i] = HashToken(codes[i])
+    }
+    user.RecoveryCodes = strings.Join(hashes, " ")
+    return codes
+}
+
+/*
+ Removes every trace of two-factor authentication from the user
+ */
+func (user *User) DisableTwoFactor() {
+    user.TotpEnabled = false
+    user.TotpSecret = ""
+    user.TotpLastStep = 0
+    user.RecoveryCodes = ""
+}
+
+/*
+ Returns whether the user has to enable two-factor authentication before using their privileges.
+ This applies to admins and game admins if two-factor-admins is set in the config
+ */
+func (user *User) NeedsTwoFactorSetup() bool {
+    return user.NeedsTwoFactorSetupTx(app.Database)
+}
+
+/*
+ Checks the roles of the user through the given database handle
+ */
+func (user *User) NeedsTwoFactorSetupTx(db *gorm.DB) bool {
+    if !app.Settings.TwoFactorAdmins || user.TotpEnabled {
+        return false
+    }
+    abilities := user.GetAbilitiesTx(db)
+    for _,element := range user.Roles {
+        if element.Name == "admin" {
+            return true
+        }
+    }
+    e,_ := utils.ArrayContains("game-edit", abilities)
+    return e
+}
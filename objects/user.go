@@ -13,6 +13,7 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "errors"
     "github.com/jameskeane/bcrypt"
+    "github.com/jinzhu/gorm"
     "time"
 )
 
@@ -20,7 +21,7 @@ type User struct {
     Model
 
     Username            string `gorm:"size:128;unique_index;not null" json:"username"`
-    Email               string `gorm:"size:256;unique_index;not null" json:"email"`
+    Email               string `gorm:"size:256;unique_index;not null" json:"email" spacedock:"lock"`
     ShowEmail           bool `json:"showEmail"`
     Public              bool `json:"public"`
     Password            string `gorm:"size:128" json:"-" spacedock:"lock"`
@@ -31,32 +32,25 @@ type User struct {
     Roles               []Role `gorm:"many2many:role_users" json:"-" spacedock:"lock"`
     authed              bool
     SharedAuthors       []SharedAuthor `json:"-" spacedock:"lock"`
-    Following           []Mod `json"-" gorm:"many2many:mod_followers" spacedock:"lock"`
-}
-
-func (s *User) AfterFind() {
-    app.DBRecursionLock.Lock()
-    if _, ok := app.DBRecursion[utils.CurrentGoroutineID()]; !ok {
-        app.DBRecursion[utils.CurrentGoroutineID()] = 0
-    }
-    if app.DBRecursion[utils.CurrentGoroutineID()] >= app.DBRecursionMax {
-        app.DBRecursionLock.Unlock()
-        return
-    }
-    isRoot := app.DBRecursion[utils.CurrentGoroutineID()] == 0
-    app.DBRecursion[utils.CurrentGoroutineID()] += 1
-    app.DBRecursionLock.Unlock()
-
-    app.Database.Model(s).Related(&(s.Roles), "Roles")
-    app.Database.Model(s).Related(&(s.SharedAuthors), "SharedAuthors")
-    app.Database.Model(s).Related(&(s.Following), "Following")
-
-    app.DBRecursionLock.Lock()
-    app.DBRecursion[utils.CurrentGoroutineID()] -= 1
-    if isRoot {
-        delete(app.DBRecursion, utils.CurrentGoroutineID())
-    }
-    app.DBRecursionLock.Unlock()
+    Following           []Mod `json:"-" gorm:"many2many:mod_followers" spacedock:"lock"`
+    UpdateNotifications string `gorm:"size:16" json:"updateNotifications"`
+    DigestSentAt        time.Time `json:"-" spacedock:"lock"`
+    TotpSecret          string `gorm:"size:64" json:"-" spacedock:"lock"`
+    TotpEnabled         bool `json:"twoFactor" spacedock:"lock"`
+    TotpLastStep        int64 `json:"-" spacedock:"lock"`
+    RecoveryCodes       string `gorm:"size:1024" json:"-" spacedock:"lock"`
+    PendingEmail        string `gorm:"size:256" json:"-" spacedock:"lock"`
+    PreviousEmail       string `gorm:"size:256" json:"-" spacedock:"lock"`
+    EmailConfirmation   string `gorm:"size:128" json:"-" spacedock:"lock"`
+    EmailCancel         string `gorm:"size:128" json:"-" spacedock:"lock"`
+    EmailChangeExpiry   time.Time `json:"-" spacedock:"lock"`
+    EmailCancelExpiry   time.Time `json:"-" spacedock:"lock"`
+    DeletionScheduledAt *time.Time `json:"-" spacedock:"lock"`
+    AwaitingApproval    bool `json:"-" spacedock:"lock"`
+    InviteID            uint `json:"-" spacedock:"lock"`
+    Banned              bool `json:"-" spacedock:"lock"`
+    SuspendedUntil      *time.Time `json:"-" spacedock:"lock"`
+    ContentHidden       bool `json:"-" spacedock:"lock"`
 }
 
 func NewUser(name string, email string, password string) *User {
@@ -69,8 +63,12 @@ func NewUser(name string, email string, password string) *User {
         Confirmation: "",
         PasswordReset: "",
         PasswordResetExpiry: time.Now(),
+        EmailChangeExpiry: time.Now(),
+        EmailCancelExpiry: time.Now(),
         authed: false,
         Roles: []Role{},
+        UpdateNotifications: NotifyImmediate,
+        DigestSentAt: time.Now(),
     }
     user.SetPassword(password)
     user.Meta = "{}"
@@ -97,7 +95,14 @@ func (user *User) Logout() {
 }
 
 func (user *User) GetById(id uint) error {
-    app.Database.Where("id = ?", id).First(user)
+    return user.GetByIdTx(app.Database, id)
+}
+
+/*
+ Loads the user through the given database handle
+ */
+func (user *User) GetByIdTx(db *gorm.DB, id uint) error {
+    db.Where("id = ?", id).First(user)
     if user.ID != id {
         return errors.New("Invalid user ID")
     }
@@ -107,30 +112,57 @@ func (user *User) GetById(id uint) error {
 /* Login Interface End */
 
 func (user *User) AddRole(name string) *Role {
+    role, _ := user.AddRoleTx(app.Database, name)
+    return role
+}
+
+/*
+ Adds the role through the given database handle, for example the one of a transaction
+ */
+func (user *User) AddRoleTx(db *gorm.DB, name string) (*Role, error) {
     role := &Role {}
-    app.Database.Where("name = ?", name).First(role)
+    db.Where("name = ?", name).First(role)
     if role.Name != name {
         role.Name = name
-        role.Params = "{}"
         role.Meta = "{}"
-        app.Database.Save(role)
+        if err := db.Save(role).Error; err != nil {
+            return role, err
+        }
+    }
+    if err := db.Model(user).Related(&(user.Roles), "Roles").Error; err != nil {
+        return role, err
     }
-    app.Database.Model(user).Related(&(user.Roles), "Roles")
     user.Roles = append(user.Roles, *role)
-    app.Database.Save(user).Save(role)
-    return &user.Roles[len(user.Roles) - 1]
+    if err := db.Save(user).Error; err != nil {
+        return role, err
+    }
+    if err := db.Save(role).Error; err != nil {
+        return role, err
+    }
+    return &user.Roles[len(user.Roles) - 1], nil
 }
 
 func (user *User) RemoveRole(name string) {
+    user.RemoveRoleTx(app.Database, name)
+}
+
+/*
+ Removes the role through the given database handle, for example the one of a transaction
+ */
+func (user *User) RemoveRoleTx(db *gorm.DB, name string) error {
     role := &Role{}
-    app.Database.Where("name = ?", name).First(role)
+    db.Where("name = ?", name).First(role)
     if role.Name == "" {
-        return
+        return nil
     }
-    if e,i := utils.ArrayContains(role, user.Roles); e {
-        user.Roles = append(user.Roles[:i], user.Roles[i + 1:]...)
-        app.Database.Save(user)
+    roles := []Role{}
+    for _,element := range user.Roles {
+        if element.ID != role.ID {
+            roles = append(roles, element)
+        }
     }
+    user.Roles = roles
+    return db.Model(user).Association("Roles").Delete(role).Error
 }
 
 func (user *User) HasRole(name string) bool {
@@ -144,7 +176,14 @@ func (user *User) HasRole(name string) bool {
 }
 
 func (user *User) GetAbilities() []string {
-    app.Database.Model(user).Related(&(user.Roles), "Roles")
+    return user.GetAbilitiesTx(app.Database)
+}
+
+/*
+ Loads the roles of the user through the given database handle and returns the names of their abilities
+ */
+func (user *User) GetAbilitiesTx(db *gorm.DB) []string {
+    db.Model(user).Related(&(user.Roles), "Roles")
     value := []string{}
     for _,element := range user.Roles {
         for _,element2 := range element.Abilities {
@@ -171,6 +210,13 @@ func (user *User) Format(admin bool) map[string]interface{} {
             "public": user.Public,
             "description": user.Description,
             "roles": names,
+            "updateNotifications": user.UpdateNotifications,
+            "twoFactor": user.TotpEnabled,
+            "pendingEmail": utils.Ternary(user.EmailChangeExpiry.After(time.Now()), user.PendingEmail, ""),
+            "deletionScheduled": user.DeletionScheduledAt,
+            "awaitingApproval": user.AwaitingApproval,
+            "banned": user.Banned,
+            "suspendedUntil": user.SuspendedUntil,
             "meta": utils.LoadJSON(user.Meta),
         }
     } else {
@@ -193,7 +239,7 @@ func (user *User) Format(admin bool) map[string]interface{} {
             "public": user.Public,
             "description": user.Description,
             "roles": names,
-            "meta": utils.LoadJSON(user.Meta),
+            "meta": meta,
         }
     }
 }
\ No newline at end of file
@@ -15,6 +15,7 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
+    "strings"
 )
 
 /*
@@ -45,6 +46,38 @@ func AccessRegister() {
         middleware.NeedsPermission("access-edit", true),
         remove_ability,
     )
+    Register(GET, "/api/access/roles/:rolename",
+        middleware.NeedsPermission("access-view", true),
+        show_role,
+    )
+    Register(POST, "/api/access/roles/:rolename",
+        middleware.NeedsPermission("access-edit", true),
+        create_role,
+    )
+    Register(PUT, "/api/access/roles/:rolename",
+        middleware.NeedsPermission("access-edit", true),
+        edit_role,
+    )
+    Register(DELETE, "/api/access/roles/:rolename",
+        middleware.NeedsPermission("access-edit", true),
+        delete_role,
+    )
+    Register(GET, "/api/access/roles/:rolename/users",
+        middleware.NeedsPermission("access-view", true),
+        role_users,
+    )
+    Register(POST, "/api/access/roles/:rolename/users",
+        middleware.NeedsPermission("access-edit", true),
+        edit_role_users,
+    )
+    Register(GET, "/api/access/users/:userid",
+        middleware.NeedsPermission("access-view", true),
+        user_permissions,
+    )
+    Register(POST, "/api/access/check",
+        middleware.NeedsPermission("access-view", true),
+        check_permission,
+    )
     Register(POST, "/api/access/roles/:rolename/params",
         middleware.NeedsPermission("access-edit", true),
         add_param,
@@ -66,21 +99,7 @@ func list_roles(ctx *iris.Context) {
     app.Database.Find(&roles)
     output := make([]map[string]interface{}, len(roles))
     for i,element := range roles {
-        abilities := element.Abilities
-        abilitiesout := make([]map[string]interface{}, len(abilities))
-        for j,element2 := range abilities {
-            abilitiesout[j] = map[string]interface{} {
-                "id": element2.ID,
-                "name": element2.Name,
-                "meta": utils.LoadJSON(element2.Meta),
-            }
-        }
-        output[i] = map[string]interface{} {
-            "id": element.ID,
-            "name": element.Name,
-            "abilities": abilitiesout,
-            "meta": utils.LoadJSON(element.Meta),
-        }
+        output[i] = roleMap(element)
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(roles), "data": output})
 }
@@ -101,10 +120,12 @@ func assign_role(ctx *iris.Context) {
     app.Database.Where("id = ?", userid).First(user)
     if user.ID != userid {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid.").Code(2145))
+        return
     }
 
     // User is valid, assign the new role
     user.AddRole(rolename)
+    middleware.Audit(ctx, "role-assign", "user", user.ID, map[string]interface{}{"role": rolename})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
@@ -135,6 +156,7 @@ func remove_role(ctx *iris.Context) {
 
     // Everything is valid, remove the role
     user.RemoveRole(rolename)
+    middleware.Audit(ctx, "role-remove", "user", user.ID, map[string]interface{}{"role": rolename})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
@@ -179,6 +201,7 @@ func assign_ability(ctx *iris.Context) {
 
     // Role is valid, assign the new ability
     role.AddAbility(abname)
+    middleware.Audit(ctx, "ability-assign", "role", role.ID, map[string]interface{}{"ability": abname})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
@@ -221,13 +244,15 @@ func remove_ability(ctx *iris.Context) {
 
     // Remove the ability
     role.RemoveAbility(abname)
+    middleware.Audit(ctx, "ability-remove", "role", role.ID, map[string]interface{}{"ability": abname})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
 /*
  Path: /api/access/roles/:rolename/params/
  Method: POST
- Description: Adds a parameter for an ability. Required parameters: abname, param, value
+ Description: Adds a parameter for an ability. Required parameters: abname, param, value. Optional parameters: match (exact, prefix or regex).
+              Without match, values with special characters are regular expressions and everything else has to match exactly
  Abilities: access-edit
  */
 func add_param(ctx *iris.Context) {
@@ -236,6 +261,7 @@ func add_param(ctx *iris.Context) {
     abname := cast.ToString(utils.GetJSON(ctx,"abname"))
     param := cast.ToString(utils.GetJSON(ctx,"param"))
     value := cast.ToString(utils.GetJSON(ctx,"value"))
+    match := cast.ToString(utils.GetJSON(ctx,"match"))
 
     // Try to get the role
     role := &objects.Role{}
@@ -257,9 +283,15 @@ func add_param(ctx *iris.Context) {
         return
     }
 
-    // Both objects are valid, check if they are linked
-    role.AddParam(abname, param, value)
-    app.Database.Save(role)
+    // Both objects are valid, store the parameter
+    if match == "" {
+        match = objects.GuessMatch(value)
+    }
+    if err := role.AddParamMatch(abname, param, value, match); err != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error(err.Error()).Code(2109))
+        return
+    }
+    middleware.Audit(ctx, "param-add", "role", role.ID, map[string]interface{}{"ability": abname, "param": param, "value": value, "match": match})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
@@ -298,6 +330,310 @@ func remove_param(ctx *iris.Context) {
 
     // Both objects are valid, check if the param exists
     role.RemoveParam(abname, param, value)
+    middleware.Audit(ctx, "param-remove", "role", role.ID, map[string]interface{}{"ability": abname, "param": param, "value": value})
     app.Database.Save(role)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/access/roles/:rolename
+ Method: GET
+ Description: Displays a role with its description, abilities and parameters
+ Abilities: access-view
+ */
+func show_role(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    role := &objects.Role{}
+    app.Database.Preload("Users").Where("name = ?", rolename).First(role)
+    if role.Name != rolename {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The role does not exist.").Code(3030))
+        return
+    }
+    output := roleMap(*role)
+    output["params"] = role.ParamMap()
+    output["users"] = len(role.Users)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": output})
+}
+
+/*
+ Path: /api/access/roles/:rolename
+ Method: POST
+ Description: Creates a new role without users. Optional fields: description
+              The name can't be the one of a user, game, mod or list, since their roles are found by it
+ Abilities: access-edit
+ */
+func create_role(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    description := cast.ToString(utils.GetJSON(ctx, "description"))
+    if rolename == "" || len(rolename) > 128 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The role name is invalid.").Code(2108))
+        return
+    }
+    role := &objects.Role{}
+    app.Database.Where("name = ?", rolename).First(role)
+    if role.Name == rolename {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A role with this name already exists.").Code(3031))
+        return
+    }
+    role = objects.NewRole(rolename, description)
+    if owners := role.Owners(app.Database); len(owners) > 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The name belongs to a " + strings.Join(owners, ", ") + " and can't be used for another role.").Code(3032))
+        return
+    }
+    if err := app.Database.Save(role).Error; err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    middleware.Audit(ctx, "role-add", "role", role.ID, map[string]interface{}{"name": rolename})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": roleMap(*role)})
+}
+
+/*
+ Path: /api/access/roles/:rolename
+ Method: PUT
+ Description: Renames a role or changes its description. Optional fields: name, description
+              The roles of users, games, mods and lists are found by their name, so they can't be renamed, and no role can take such a name
+ Abilities: access-edit
+ */
+func edit_role(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    role := &objects.Role{}
+    app.Database.Where("name = ?", rolename).First(role)
+    if role.Name != rolename {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The role does not exist.").Code(3030))
+        return
+    }
+    before := roleMap(*role)
+    if name, ok := utils.GetFullJSON(ctx)["name"]; ok && cast.ToString(name) != role.Name {
+        newname := cast.ToString(name)
+        if owners := role.Owners(app.Database); len(owners) > 0 {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The role belongs to a " + strings.Join(owners, ", ") + " of the same name and can't be renamed.").Code(3032))
+            return
+        }
+        if newname == "" || len(newname) > 128 {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The role name is invalid.").Code(2108))
+            return
+        }
+        other := &objects.Role{}
+        app.Database.Where("name = ?", newname).First(other)
+        if other.Name == newname {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A role with this name already exists.").Code(3031))
+            return
+        }
+        if owners := objects.NewRole(newname, "").Owners(app.Database); len(owners) > 0 {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The name belongs to a " + strings.Join(owners, ", ") + " and can't be used for another role.").Code(3032))
+            return
+        }
+        role.Name = newname
+    }
+    if description, ok := utils.GetFullJSON(ctx)["description"]; ok {
+        role.Description = cast.ToString(description)
+    }
+    app.NoAssociations(func() { app.Database.Save(role) })
+    middleware.Audit(ctx, "role-edit", "role", role.ID, utils.Diff(before, roleMap(*role)))
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": roleMap(*role)})
+}
+
+/*
+ Path: /api/access/roles/:rolename
+ Method: DELETE
+ Description: Removes a role from all users and deletes it, together with its parameters.
+              The roles of users, games, mods and lists can't be deleted, they go away with what they belong to
+ Abilities: access-edit
+ */
+func delete_role(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    role := &objects.Role{}
+    app.Database.Where("name = ?", rolename).First(role)
+    if role.Name != rolename {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The role does not exist.").Code(3030))
+        return
+    }
+    if owners := role.Owners(app.Database); len(owners) > 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The role belongs to a " + strings.Join(owners, ", ") + " of the same name and can't be deleted.").Code(3032))
+        return
+    }
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        return role.DeleteTx(work.DB)
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    middleware.Audit(ctx, "role-remove", "role", role.ID, map[string]interface{}{"name": role.Name})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/access/roles/:rolename/users
+ Method: GET
+ Description: Lists the users that have the role
+ Abilities: access-view
+ */
+func role_users(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    role := &objects.Role{}
+    app.Database.Preload("Users").Where("name = ?", rolename).First(role)
+    if role.Name != rolename {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The role does not exist.").Code(3030))
+        return
+    }
+    output := make([]map[string]interface{}, len(role.Users))
+    for i,element := range role.Users {
+        output[i] = map[string]interface{} {
+            "id": element.ID,
+            "username": element.Username,
+        }
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/access/roles/:rolename/users
+ Method: POST
+ Description: Adds and removes several users at once. Optional fields: add, remove (lists of user IDs)
+ Abilities: access-edit
+ */
+func edit_role_users(ctx *iris.Context) {
+    rolename := ctx.GetString("rolename")
+    add := cast.ToSlice(utils.GetJSON(ctx, "add"))
+    remove := cast.ToSlice(utils.GetJSON(ctx, "remove"))
+    role := &objects.Role{}
+    app.Database.Where("name = ?", rolename).First(role)
+    if role.Name != rolename {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The role does not exist.").Code(3030))
+        return
+    }
+
+    // Check all users first, so nothing changes if one of them is wrong
+    users := map[uint]*objects.User{}
+    for _,element := range append(add, remove...) {
+        userid := cast.ToUint(element)
+        user := &objects.User{}
+        app.Database.Where("id = ?", userid).First(user)
+        if user.ID != userid || userid == 0 {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid " + cast.ToString(element) + " is invalid.").Code(2145))
+            return
+        }
+        users[userid] = user
+    }
+
+    added := []uint{}
+    removed := []uint{}
+    for _,element := range add {
+        user := users[cast.ToUint(element)]
+        if !role.HasUser(*user) {
+            app.Database.Model(user).Association("Roles").Append(role)
+            user.Roles = append(user.Roles, *role)
+            added = append(added, user.ID)
+        }
+    }
+    for _,element := range remove {
+        user := users[cast.ToUint(element)]
+        if role.HasUser(*user) {
+            app.Database.Model(user).Association("Roles").Delete(role)
+            removed = append(removed, user.ID)
+        }
+    }
+    for id := range users {
+        utils.ClearUserCache(id)
+    }
+    middleware.Audit(ctx, "role-members", "role", role.ID, map[string]interface{}{"added": added, "removed": removed})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "data": iris.Map{"added": added, "removed": removed}})
+}
+
+/*
+ Path: /api/access/users/:userid
+ Method: GET
+ Description: Displays the abilities a user effectively has, together with the roles that grant them and their parameters
+ Abilities: access-view
+ */
+func user_permissions(ctx *iris.Context) {
+    userid := cast.ToUint(ctx.GetString("userid"))
+    user := &objects.User{}
+    app.Database.Where("id = ?", userid).First(user)
+    if user.ID != userid {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The userid is invalid.").Code(2145))
+        return
+    }
+
+    // Loads the roles together with their abilities
+    user.GetAbilities()
+    roles := make([]string, len(user.Roles))
+    abilities := map[string]map[string]interface{}{}
+    for i,element := range user.Roles {
+        roles[i] = element.Name
+        params := element.ParamMap()
+        for _,element2 := range element.Abilities {
+            if _,ok := abilities[element2.Name]; !ok {
+                abilities[element2.Name] = map[string]interface{}{
+                    "name": element2.Name,
+                    "roles": []string{},
+                    "params": map[string]interface{}{},
+                }
+            }
+            abilities[element2.Name]["roles"] = append(abilities[element2.Name]["roles"].([]string), element.Name)
+            if value, ok := params[element2.Name]; ok {
+                abilities[element2.Name]["params"].(map[string]interface{})[element.Name] = value
+            }
+        }
+    }
+    output := []map[string]interface{}{}
+    for _,element := range abilities {
+        output = append(output, element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": iris.Map{
+        "user": user.ID,
+        "roles": roles,
+        "abilities": output,
+        "sanctioned": user.IsSanctioned(),
+        "needsTwoFactor": user.NeedsTwoFactorSetup(),
+    }})
+}
+
+/*
+ Path: /api/access/check
+ Method: POST
+ Description: Explains whether a user would get access to a page that needs an ability, without doing anything. Required fields: userid, ability. Optional fields: public, params (the route parameters, e.g. {"gameshort": "kerbal"})
+ Abilities: access-view
+ */
+func check_permission(ctx *iris.Context) {
+    userid := cast.ToUint(utils.GetJSON(ctx, "userid"))
+    ability := cast.ToString(utils.GetJSON(ctx, "ability"))
+    public := cast.ToBool(utils.GetJSON(ctx, "public"))
+    params := cast.ToStringMapString(utils.GetJSON(ctx, "params"))
+    user := &objects.User{}
+    app.Database.Where("id = ?", userid).First(user)
+    if user.ID != userid || userid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The userid is invalid.").Code(2145))
+        return
+    }
+    if ability == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The ability does not exist.").Code(2107))
+        return
+    }
+    status, trace := middleware.ExplainPermission(user, ability, public, params)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": iris.Map{
+        "allowed": status == 0,
+        "status": status,
+        "trace": trace,
+    }})
+}
+
+func roleMap(role objects.Role) map[string]interface{} {
+    abilities := make([]map[string]interface{}, len(role.Abilities))
+    for i,element := range role.Abilities {
+        abilities[i] = map[string]interface{} {
+            "id": element.ID,
+            "name": element.Name,
+            "meta": utils.LoadJSON(element.Meta),
+        }
+    }
+    return map[string]interface{} {
+        "id": role.ID,
+        "name": role.Name,
+        "description": role.Description,
+        "abilities": abilities,
+        "meta": utils.LoadJSON(role.Meta),
+    }
 }
\ No newline at end of file
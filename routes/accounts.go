@@ -26,9 +26,26 @@ import (
 func AccountsRegister() {
     Register(GET, "/api/confirm/:confirmation", confirm) // Maybe switch to POST too?
     Register(POST, "/api/login", login)
+    Register(POST, "/api/login/2fa", login_two_factor)
     Register(POST, "/api/logout", logout)
-    Register(POST, "/api/reset", reset)
-    Register(POST, "/api/reset/:username/:confirmation", reset_confirm)
+    Register(POST, "/api/reset", middleware.NoImpersonation, reset)
+    Register(POST, "/api/email/confirm/:confirmation", middleware.NoImpersonation, confirm_email)
+    Register(POST, "/api/email/cancel/:confirmation", middleware.NoImpersonation, cancel_email)
+    Register(POST, "/api/reset/:username/:confirmation", middleware.NoImpersonation, reset_confirm)
+    Register(GET, "/api/account/export",
+        middleware.NeedsPermission("logged-in", false),
+        account_export,
+    )
+    Register(POST, "/api/account/delete",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        account_delete,
+    )
+    Register(POST, "/api/account/delete/cancel",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        account_delete_cancel,
+    )
 }
 
 /*
@@ -50,7 +67,9 @@ func confirm(ctx *iris.Context) {
 
     // Everything is valid
     user.Confirmation = ""
-    middleware.LoginUser(ctx, user)
+    if !user.AwaitingApproval {
+        middleware.LoginUser(ctx, user)
+    }
     role := user.AddRole(user.Username)
     role.AddAbility("user-edit")
     role.AddAbility("mods-add")
@@ -70,6 +89,8 @@ func confirm(ctx *iris.Context) {
 /*
  Path: /api/login
  Method: POST
+ Description: Logs a user in. If two-factor authentication is enabled, the login has to be completed using /api/login/2fa,
+              unless the field code is sent along with the password.
  */
 func login(ctx *iris.Context) {
     // Grab information
@@ -85,13 +106,19 @@ func login(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You are already logged in").Code(3060))
         return
     }
+    if lockout := middleware.LoginLockout(ctx, username); lockout != nil {
+        utils.WriteJSON(ctx, iris.StatusTooManyRequests, utils.Error("Too many failed logins. Please try again after " + lockout.ExpiresAt.Format(time.RFC3339)).Code(3081))
+        return
+    }
     user := &objects.User{}
     app.Database.Where("username = ?", username).First(user)
     if user.Username != username {
+        middleware.LoginFailed(ctx, username, nil)
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Username or password is incorrect").Code(2175))
         return
     }
     if s,_ := bcrypt.Hash(password, user.Password); s != user.Password {
+        middleware.LoginFailed(ctx, username, user)
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Username or password is incorrect").Code(2175))
         return
     }
@@ -99,6 +126,59 @@ func login(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("User is not confirmed").Code(3055))
         return
     }
+    if user.AwaitingApproval {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("Your account is waiting for the approval of an admin").Code(3086))
+        return
+    }
+    if user.IsSanctioned() {
+        utils.WriteJSON(ctx, iris.StatusForbidden, middleware.SanctionError(user))
+        return
+    }
+    if user.TotpEnabled {
+        code := cast.ToString(utils.GetJSON(ctx, "code"))
+        if code == "" {
+            // Remember that the password was correct and wait for the second step
+            middleware.StartPendingLogin(ctx, user)
+            utils.WriteJSON(ctx, iris.StatusUnauthorized, utils.Error("Two-factor authentication code required").Code(1055))
+            return
+        }
+        if !user.CheckTwoFactor(code) {
+            middleware.LoginFailed(ctx, user.Username, user)
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+            return
+        }
+        app.Database.Save(user)
+    }
+    middleware.LoginUser(ctx, user)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
+
+/*
+ Path: /api/login/2fa
+ Method: POST
+ Description: Completes a login for users with two-factor authentication. Required fields: code (from the authenticator app, or a recovery code)
+ */
+func login_two_factor(ctx *iris.Context) {
+    code := cast.ToString(utils.GetJSON(ctx, "code"))
+    if middleware.CurrentUser(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You are already logged in").Code(3060))
+        return
+    }
+    user := middleware.PendingUser(ctx)
+    if user == nil || !user.TotpEnabled {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("There is no pending login. Please log in again.").Code(3077))
+        return
+    }
+    if lockout := middleware.LoginLockout(ctx, user.Username); lockout != nil {
+        utils.WriteJSON(ctx, iris.StatusTooManyRequests, utils.Error("Too many failed logins. Please try again after " + lockout.ExpiresAt.Format(time.RFC3339)).Code(3081))
+        return
+    }
+    if code == "" || !user.CheckTwoFactor(code) {
+        middleware.LoginFailed(ctx, user.Username, user)
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+        return
+    }
+    app.Database.Save(user)
     middleware.LoginUser(ctx, user)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
 }
@@ -118,6 +198,72 @@ func logout(ctx *iris.Context) {
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
 
+/*
+ Path: /api/email/confirm/:confirmation
+ Method: POST
+ Description: Confirms a new email address, using the code that was sent to it
+ */
+func confirm_email(ctx *iris.Context) {
+    confirmation := ctx.GetString("confirmation")
+    user := &objects.User{}
+    app.Database.Where("email_confirmation = ?", confirmation).First(user)
+    if confirmation == "" || user.EmailConfirmation != confirmation || user.EmailChangeExpiry.Before(time.Now()) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The email confirmation is invalid or expired").Code(3082))
+        return
+    }
+    other := &objects.User{}
+    app.Database.Where("email = ?", user.PendingEmail).First(other)
+    if other.ID != 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A user with this email already exists.").Code(4000))
+        return
+    }
+
+    // Swap the addresses, the old one can still undo this with the cancel link
+    user.PreviousEmail = user.Email
+    user.Email = user.PendingEmail
+    user.PendingEmail = ""
+    user.EmailConfirmation = ""
+    user.EmailChangeExpiry = time.Now()
+    app.Database.Save(user)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/email/cancel/:confirmation
+ Method: POST
+ Description: Cancels an email change, using the code that was sent to the old address. If the change was already confirmed,
+              the old address is restored and the user is logged out everywhere
+ */
+func cancel_email(ctx *iris.Context) {
+    confirmation := ctx.GetString("confirmation")
+    user := &objects.User{}
+    app.Database.Where("email_cancel = ?", confirmation).First(user)
+    if confirmation == "" || user.EmailCancel != confirmation || user.EmailCancelExpiry.Before(time.Now()) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The email confirmation is invalid or expired").Code(3082))
+        return
+    }
+    if user.PreviousEmail != "" {
+        other := &objects.User{}
+        app.Database.Where("email = ?", user.PreviousEmail).First(other)
+        if other.ID != 0 && other.ID != user.ID {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A user with this email already exists.").Code(4000))
+            return
+        }
+        user.Email = user.PreviousEmail
+        objects.RevokeSessions(user.ID, 0)
+    }
+    user.PendingEmail = ""
+    user.PreviousEmail = ""
+    user.EmailConfirmation = ""
+    user.EmailCancel = ""
+    user.EmailChangeExpiry = time.Now()
+    user.EmailCancelExpiry = time.Now()
+    app.Database.Save(user)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
 /*
  Path: /api/reset
  Method: POST
@@ -175,8 +321,91 @@ func reset_confirm(ctx *iris.Context) {
     user.PasswordReset = ""
     user.PasswordResetExpiry = time.Now()
     app.Database.Save(user)
+
+    // Whoever knew the old password shouldn't stay logged in
     if middleware.CurrentUser(ctx) != nil {
         middleware.LogoutUser(ctx)
     }
+    objects.RevokeSessions(user.ID, 0)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
+
+/*
+ Path: /api/account/export
+ Method: GET
+ Description: Returns a zip archive with all the data we store about the current user
+ */
+func account_export(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to export account data.").Code(1045))
+        return
+    }
+    user := middleware.CurrentUser(ctx)
+    data, err := user.Export()
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    ctx.SetHeader("Content-Type", "application/zip")
+    ctx.SetHeader("Content-Disposition", "attachment; filename=\"" + user.Username + "-export.zip\"")
+    ctx.Data(iris.StatusOK, data)
+}
+
+/*
+ Path: /api/account/delete
+ Method: POST
+ Description: Schedules the deletion of the current user. The account is deleted after the grace period, unless the deletion is cancelled.
+              Required fields: password. Optional fields: code (required with two-factor authentication)
+ */
+func account_delete(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to delete accounts.").Code(1045))
+        return
+    }
+    password := cast.ToString(utils.GetJSON(ctx, "password"))
+    code := cast.ToString(utils.GetJSON(ctx, "code"))
+    user := middleware.CurrentUser(ctx)
+    if user.DeletionScheduledAt != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The deletion of this account is already scheduled.").Code(3083))
+        return
+    }
+    if s,_ := bcrypt.Hash(password, user.Password); password == "" || s != user.Password {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The password is incorrect").Code(2175))
+        return
+    }
+    if user.TotpEnabled && !user.CheckTwoFactor(code) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+        return
+    }
+    days := app.Settings.DeletionGracePeriod
+    if days <= 0 {
+        days = 14
+    }
+    date := time.Now().Add(time.Hour * 24 * time.Duration(days))
+    user.DeletionScheduledAt = &date
+    app.Database.Save(user)
+    utils.SendDeletionNotice(user.Username, user.Email, date)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
+
+/*
+ Path: /api/account/delete/cancel
+ Method: POST
+ Description: Cancels the scheduled deletion of the current user
+ */
+func account_delete_cancel(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to delete accounts.").Code(1045))
+        return
+    }
+    user := middleware.CurrentUser(ctx)
+    if user.DeletionScheduledAt == nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The deletion of this account isn't scheduled.").Code(3084))
+        return
+    }
+    user.DeletionScheduledAt = nil
+    app.Database.Save(user)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
\ No newline at end of file
@@ -15,7 +15,11 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
+    "io/ioutil"
+    "log"
+    "os"
     "strconv"
+    "time"
 )
 
 /*
@@ -23,22 +27,112 @@ import (
  */
 func AdminRegister() {
     Register(POST, "/api/admin/impersonate/:userid",
+        middleware.NoImpersonation,
         middleware.NeedsPermission("admin-impersonate", true, "userid"),
         impersonate,
     )
+    Register(DELETE, "/api/admin/impersonate", stop_impersonating)
+    Register(GET, "/api/admin/audit",
+        middleware.NeedsPermission("admin-audit", true),
+        list_audit,
+    )
+    Register(GET, "/api/admin/lockouts",
+        middleware.NeedsPermission("admin-lockouts", true),
+        list_lockouts,
+    )
+    Register(DELETE, "/api/admin/lockouts",
+        middleware.NeedsPermission("admin-lockouts", true),
+        clear_lockout,
+    )
+    Register(GET, "/api/admin/invites",
+        middleware.NeedsPermission("admin-invites", true),
+        list_invites,
+    )
+    Register(POST, "/api/admin/invites",
+        middleware.NeedsPermission("admin-invites", true),
+        create_invite,
+    )
+    Register(DELETE, "/api/admin/invites",
+        middleware.NeedsPermission("admin-invites", true),
+        remove_invite,
+    )
+    Register(GET, "/api/admin/approvals",
+        middleware.NeedsPermission("admin-approve", true),
+        list_approvals,
+    )
+    Register(POST, "/api/admin/approvals/:userid",
+        middleware.NeedsPermission("admin-approve", true),
+        approve_user,
+    )
+    Register(DELETE, "/api/admin/approvals/:userid",
+        middleware.NeedsPermission("admin-approve", true),
+        reject_user,
+    )
+    Register(GET, "/api/admin/sanctions",
+        middleware.NeedsPermission("admin-sanction", true),
+        list_sanctions,
+    )
+    Register(GET, "/api/admin/sanctions/:userid",
+        middleware.NeedsPermission("admin-sanction", true),
+        user_sanctions,
+    )
+    Register(POST, "/api/admin/sanctions",
+        middleware.NeedsPermission("admin-sanction", true),
+        add_sanction,
+    )
+    Register(PUT, "/api/admin/sanctions",
+        middleware.NeedsPermission("admin-sanction", true),
+        edit_sanction,
+    )
+    Register(DELETE, "/api/admin/sanctions",
+        middleware.NeedsPermission("admin-sanction", true),
+        lift_sanction,
+    )
     Register(POST, "/api/admin/manual-confirmation/:userid",
         middleware.NeedsPermission("admin-confirm", true),
         manual_confirmation,
     )
+    Register(GET, "/api/admin/games/:gameshort/export",
+        middleware.NeedsPermission("admin-export", true),
+        export_game,
+    )
+    Register(POST, "/api/admin/games/:gameshort/import",
+        middleware.NeedsPermission("admin-import", true),
+        import_game,
+    )
+    Register(GET, "/api/admin/mirrors",
+        middleware.NeedsPermission("admin-mirrors", true),
+        list_mirrors,
+    )
+    Register(POST, "/api/admin/mirrors",
+        middleware.NeedsPermission("admin-mirrors", true),
+        add_mirror,
+    )
+    Register(PUT, "/api/admin/mirrors/:mirrorid",
+        middleware.NeedsPermission("admin-mirrors", true),
+        edit_mirror,
+    )
+    Register(DELETE, "/api/admin/mirrors",
+        middleware.NeedsPermission("admin-mirrors", true),
+        remove_mirror,
+    )
+    Register(POST, "/api/admin/mirrors/:mirrorid/sync",
+        middleware.NeedsPermission("admin-mirrors", true),
+        sync_mirror,
+    )
 }
 
 /*
  Path: /api/admin/impersonate/:userid
  Method: POST
- Description: Log into another persons account from an admin account
+ Description: Log into another persons account from an admin account. The session ends after an hour, or when the admin switches back
  Abilities: admin-impersonate
  */
 func impersonate(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to impersonate users.").Code(1045))
+        return
+    }
     id, err := ctx.GetInt("userid")
     userid := cast.ToUint(id)
     if err != nil {
@@ -51,9 +145,32 @@ func impersonate(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid").Code(2145))
         return
     }
-    middleware.LogoutUser(ctx)
-    middleware.LoginUser(ctx, user)
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+    admin := middleware.CurrentUser(ctx)
+    if user.ID == admin.ID {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid").Code(2145))
+        return
+    }
+    middleware.Audit(ctx, "impersonate", "user", user.ID, nil)
+    middleware.StartImpersonation(ctx, admin, user)
+    if app.Settings.ImpersonationNotice {
+        utils.SendImpersonationNotice(user.Username, user.Email)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
+
+/*
+ Path: /api/admin/impersonate
+ Method: DELETE
+ Description: Ends the impersonation of another user and logs the admin back into their own account
+ */
+func stop_impersonating(ctx *iris.Context) {
+    if middleware.Impersonator(ctx) == nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You are not impersonating anyone").Code(3089))
+        return
+    }
+    middleware.Audit(ctx, "impersonate-stop", "user", middleware.CurrentSession(ctx).UserID, nil)
+    admin := middleware.StopImpersonation(ctx)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": admin.Format(true)})
 }
 
 /*
@@ -87,5 +204,543 @@ func manual_confirmation(ctx *iris.Context) {
     role.AddParam("packs-add", "gameshort", ".*")
     app.Database.Save(role)
     app.Database.Save(user)
+    middleware.Audit(ctx, "user-confirm", "user", user.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/lockouts
+ Method: GET
+ Description: Lists the usernames and IP addresses that are currently locked out because of failed logins
+ Abilities: admin-lockouts
+ */
+func list_lockouts(ctx *iris.Context) {
+    var lockouts []objects.Lockout
+    app.Database.Where("expires_at > ?", time.Now()).Order("expires_at desc").Find(&lockouts)
+    output := make([]map[string]interface{}, len(lockouts))
+    for i,element := range lockouts {
+        output[i] = utils.ToMap(element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/lockouts
+ Method: DELETE
+ Description: Clears a lockout, which also resets the failed login counter. Required fields: lockoutid
+ Abilities: admin-lockouts
+ */
+func clear_lockout(ctx *iris.Context) {
+    lockoutid := cast.ToUint(utils.GetJSON(ctx, "lockoutid"))
+    lockout := &objects.Lockout{}
+    app.Database.Where("id = ?", lockoutid).First(lockout)
+    if lockout.ID != lockoutid || lockoutid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The lockout ID is invalid").Code(2144))
+        return
+    }
+    app.Database.Delete(lockout)
+    middleware.Audit(ctx, "lockout-clear", "lockout", lockout.ID, map[string]interface{}{"kind": lockout.Kind, "subject": lockout.Subject})
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/invites
+ Method: GET
+ Description: Lists the invite codes that can still be used
+ Abilities: admin-invites
+ */
+func list_invites(ctx *iris.Context) {
+    var invites []objects.Invite
+    app.Database.Order("created_at desc").Find(&invites)
+    output := []map[string]interface{}{}
+    for _,element := range invites {
+        if element.IsValid() {
+            output = append(output, utils.ToMap(element))
+        }
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/invites
+ Method: POST
+ Description: Creates a new invite code. Optional fields: max_uses (0 for unlimited), expires (days), note
+ Abilities: admin-invites
+ */
+func create_invite(ctx *iris.Context) {
+    maxUses := cast.ToInt(utils.GetJSON(ctx, "max_uses"))
+    expires := cast.ToInt(utils.GetJSON(ctx, "expires"))
+    note := cast.ToString(utils.GetJSON(ctx, "note"))
+    if maxUses < 0 || expires < 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The usage limit or expiry is invalid.").Code(2134))
+        return
+    }
+    invite := objects.NewInvite(*middleware.CurrentUser(ctx), maxUses)
+    invite.Note = note
+    if expires > 0 {
+        expiry := time.Now().Add(time.Hour * 24 * time.Duration(expires))
+        invite.ExpiresAt = &expiry
+    }
+    app.Database.Save(invite)
+    middleware.Audit(ctx, "invite-add", "invite", invite.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(invite)})
+}
+
+/*
+ Path: /api/admin/invites
+ Method: DELETE
+ Description: Removes an invite code. Required fields: inviteid
+ Abilities: admin-invites
+ */
+func remove_invite(ctx *iris.Context) {
+    inviteid := cast.ToUint(utils.GetJSON(ctx, "inviteid"))
+    invite := &objects.Invite{}
+    app.Database.Where("id = ?", inviteid).First(invite)
+    if invite.ID != inviteid || inviteid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The invite ID is invalid").Code(2146))
+        return
+    }
+    app.Database.Delete(invite)
+    middleware.Audit(ctx, "invite-remove", "invite", invite.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/approvals
+ Method: GET
+ Description: Lists the accounts that are waiting for approval
+ Abilities: admin-approve
+ */
+func list_approvals(ctx *iris.Context) {
+    var users []objects.User
+    app.Database.Where("awaiting_approval = ?", true).Order("created_at asc").Find(&users)
+    output := make([]map[string]interface{}, len(users))
+    for i,element := range users {
+        output[i] = element.Format(true)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/approvals/:userid
+ Method: POST
+ Description: Approves a new account, so the user can log in
+ Abilities: admin-approve
+ */
+func approve_user(ctx *iris.Context) {
+    userid := cast.ToUint(ctx.GetString("userid"))
+    user := &objects.User{}
+    app.Database.Where("id = ?", userid).First(user)
+    if user.ID != userid || !user.AwaitingApproval {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid").Code(2145))
+        return
+    }
+    user.AwaitingApproval = false
+    app.Database.Save(user)
+    middleware.Audit(ctx, "user-approve", "user", user.ID, nil)
+    utils.SendApprovalNotice(user.Username, user.Email)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
+
+/*
+ Path: /api/admin/approvals/:userid
+ Method: DELETE
+ Description: Rejects a new account and deletes it
+ Abilities: admin-approve
+ */
+func reject_user(ctx *iris.Context) {
+    userid := cast.ToUint(ctx.GetString("userid"))
+    user := &objects.User{}
+    app.Database.Where("id = ?", userid).First(user)
+    if user.ID != userid || !user.AwaitingApproval {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid").Code(2145))
+        return
+    }
+    middleware.Audit(ctx, "user-reject", "user", user.ID, map[string]interface{}{"username": user.Username})
+    user.Purge()
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/sanctions
+ Method: GET
+ Description: Lists the users that are currently suspended or banned, together with the sanction
+ Abilities: admin-sanction
+ */
+func list_sanctions(ctx *iris.Context) {
+    var users []objects.User
+    app.Database.Where("banned = ?", true).Or("suspended_until > ?", time.Now()).Order("username asc").Find(&users)
+    output := []map[string]interface{}{}
+    for _,element := range users {
+        sanction := objects.ActiveSanction(element.ID)
+        if sanction == nil {
+            continue
+        }
+        data := element.Format(true)
+        data["sanction"] = utils.ToMap(sanction)
+        output = append(output, data)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/sanctions/:userid
+ Method: GET
+ Description: Lists all sanctions of a user, including the ones that ended
+ Abilities: admin-sanction
+ */
+func user_sanctions(ctx *iris.Context) {
+    userid := cast.ToUint(ctx.GetString("userid"))
+    var sanctions []objects.Sanction
+    app.Database.Where("user_id = ?", userid).Order("created_at desc").Find(&sanctions)
+    output := make([]map[string]interface{}, len(sanctions))
+    for i,element := range sanctions {
+        output[i] = utils.ToMap(element)
+        output[i]["active"] = element.IsActive()
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/sanctions
+ Method: POST
+ Description: Suspends or bans a user and logs them out everywhere. Required fields: userid, kind (suspension or ban), reason. Optional fields: days (for suspensions), hide (hides their mods and ratings)
+ Abilities: admin-sanction
+ */
+func add_sanction(ctx *iris.Context) {
+    userid := cast.ToUint(utils.GetJSON(ctx, "userid"))
+    kind := cast.ToString(utils.GetJSON(ctx, "kind"))
+    reason := cast.ToString(utils.GetJSON(ctx, "reason"))
+    days := cast.ToInt(utils.GetJSON(ctx, "days"))
+    hide := cast.ToBool(utils.GetJSON(ctx, "hide"))
+
+    admin := middleware.CurrentUser(ctx)
+    user := &objects.User{}
+    app.Database.Where("id = ?", userid).First(user)
+    if user.ID != userid || userid == 0 || user.ID == admin.ID {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The userid is invalid").Code(2145))
+        return
+    }
+    if kind != objects.SanctionSuspension && kind != objects.SanctionBan {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The kind of the sanction is invalid.").Code(2148))
+        return
+    }
+    if kind == objects.SanctionSuspension && days <= 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Suspensions need a duration in days.").Code(2148))
+        return
+    }
+    if reason == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Please give a reason.").Code(2148))
+        return
+    }
+
+    // An account has only one sanction at a time
+    if active := objects.ActiveSanction(user.ID); active != nil {
+        now := time.Now()
+        active.LiftedAt = &now
+        active.LiftedByID = admin.ID
+        app.Database.Save(active)
+    }
+    sanction := objects.NewSanction(*user, *admin, kind, reason, hide)
+    user.Sanction(sanction, time.Hour * 24 * time.Duration(days))
+    middleware.Audit(ctx, "user-" + sanction.Kind, "user", user.ID, map[string]interface{}{"sanction": sanction.ID, "reason": reason, "hide": hide})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(sanction)})
+}
+
+/*
+ Path: /api/admin/sanctions
+ Method: PUT
+ Description: Updates the appeal notes of a sanction. Required fields: sanctionid, appeal
+ Abilities: admin-sanction
+ */
+func edit_sanction(ctx *iris.Context) {
+    sanctionid := cast.ToUint(utils.GetJSON(ctx, "sanctionid"))
+    sanction := &objects.Sanction{}
+    app.Database.Where("id = ?", sanctionid).First(sanction)
+    if sanction.ID != sanctionid || sanctionid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The sanction ID is invalid").Code(2147))
+        return
+    }
+    before := utils.ToMap(sanction)
+    sanction.Appeal = cast.ToString(utils.GetJSON(ctx, "appeal"))
+    app.Database.Save(sanction)
+    middleware.Audit(ctx, "sanction-edit", "sanction", sanction.ID, utils.Diff(before, utils.ToMap(sanction)))
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(sanction)})
+}
+
+/*
+ Path: /api/admin/sanctions
+ Method: DELETE
+ Description: Lifts a suspension or ban. Required fields: sanctionid
+ Abilities: admin-sanction
+ */
+func lift_sanction(ctx *iris.Context) {
+    sanctionid := cast.ToUint(utils.GetJSON(ctx, "sanctionid"))
+    sanction := &objects.Sanction{}
+    app.Database.Where("id = ?", sanctionid).First(sanction)
+    if sanction.ID != sanctionid || sanctionid == 0 || !sanction.IsActive() {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The sanction ID is invalid").Code(2147))
+        return
+    }
+    user := &objects.User{}
+    app.Database.Where("id = ?", sanction.UserID).First(user)
+    user.LiftSanction(sanction, *middleware.CurrentUser(ctx))
+    middleware.Audit(ctx, "sanction-lift", "sanction", sanction.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/audit
+ Method: GET
+ Description: Lists the entries of the audit log, newest first. Optional query parameters: actor, action, target_type, target_id, since and until (RFC 3339), page, limit (up to 500)
+ Abilities: admin-audit
+ */
+func list_audit(ctx *iris.Context) {
+    query := app.Database.Order("created_at desc")
+    if actor := cast.ToUint(ctx.URLParam("actor")); actor != 0 {
+        query = query.Where("actor_id = ? OR impersonator_id = ?", actor, actor)
+    }
+    if action := ctx.URLParam("action"); action != "" {
+        query = query.Where("action = ?", action)
+    }
+    if targetType := ctx.URLParam("target_type"); targetType != "" {
+        query = query.Where("target_type = ?", targetType)
+    }
+    if targetID := cast.ToUint(ctx.URLParam("target_id")); targetID != 0 {
+        query = query.Where("target_id = ?", targetID)
+    }
+    if since, err := time.Parse(time.RFC3339, ctx.URLParam("since")); err == nil {
+        query = query.Where("created_at >= ?", since)
+    }
+    if until, err := time.Parse(time.RFC3339, ctx.URLParam("until")); err == nil {
+        query = query.Where("created_at <= ?", until)
+    }
+    limit := cast.ToInt(ctx.URLParam("limit"))
+    if limit <= 0 || limit > 500 {
+        limit = 100
+    }
+    page := cast.ToInt(ctx.URLParam("page"))
+    if page < 1 {
+        page = 1
+    }
+
+    var entries []objects.AuditEntry
+    query.Offset((page - 1) * limit).Limit(limit).Find(&entries)
+    output := make([]map[string]interface{}, len(entries))
+    for i,element := range entries {
+        output[i] = utils.ToMap(element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/games/:gameshort/export
+ Method: GET
+ Description: Downloads the mods of a game, together with their versions and files, as an archive that another instance can import. The number of version files that couldn't be found is returned in the X-Missing-Files header
+ Abilities: admin-export
+ */
+func export_game(ctx *iris.Context) {
+    gameshort := ctx.GetString("gameshort")
+    game := &objects.Game{}
+    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
+    if game.Short != gameshort && game.ID != cast.ToUint(gameshort) {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
+        return
+    }
+    temp, err := ioutil.TempFile("", "spacedock-export-")
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    defer os.Remove(temp.Name())
+    missing, err := objects.ExportGame(game, temp)
+    temp.Close()
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    for _,element := range missing {
+        log.Printf("* Export of %s is missing %s", game.Short, element)
+    }
+    middleware.Audit(ctx, "game-export", "game", game.ID, map[string]interface{}{"missing": len(missing)})
+    ctx.SetHeader("X-Missing-Files", strconv.Itoa(len(missing)))
+    ctx.SetHeader("Content-Type", "application/gzip")
+    ctx.SendFile(temp.Name(), game.Short + "-export.tar.gz")
+}
+
+/*
+ Path: /api/admin/games/:gameshort/import
+ Method: POST
+ Description: Imports an archive created by the export of another instance into a game. The archive is uploaded as "export". Optional form values: dry-run, fallback-user (owns mods whose author doesn't exist here) and create-versions (creates missing game versions). Mods whose name is taken are skipped and reported as conflicts
+ Abilities: admin-import
+ */
+func import_game(ctx *iris.Context) {
+    gameshort := ctx.GetString("gameshort")
+    game := &objects.Game{}
+    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
+    if game.Short != gameshort && game.ID != cast.ToUint(gameshort) {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
+        return
+    }
+    archive, _, err := ctx.FormFile("export")
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Invalid export archive").Code(2153))
+        return
+    }
+    defer archive.Close()
+    options := objects.ImportOptions{
+        DryRun: cast.ToBool(ctx.FormValue("dry-run")),
+        FallbackUser: ctx.FormValue("fallback-user"),
+        CreateVersions: cast.ToBool(ctx.FormValue("create-versions")),
+    }
+    report, err := objects.ImportGame(game, archive, options)
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    if !options.DryRun {
+        middleware.Audit(ctx, "game-import", "game", game.ID, map[string]interface{}{"mods": len(report.Mods), "versions": report.Versions, "conflicts": len(report.Conflicts)})
+        utils.ClearGameCache(game.Short, "")
+        utils.ClearModCache(game.Short, 0)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": report})
+}
+
+/*
+ Path: /api/admin/mirrors
+ Method: GET
+ Description: Lists the games of other instances that are mirrored into this one, with the time and the errors of their last sync
+ Abilities: admin-mirrors
+ */
+func list_mirrors(ctx *iris.Context) {
+    var mirrors []objects.Mirror
+    app.Database.Find(&mirrors)
+    output := make([]map[string]interface{}, len(mirrors))
+    for i,element := range mirrors {
+        output[i] = utils.ToMap(element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/admin/mirrors
+ Method: POST
+ Description: Mirrors a game of another instance into a local game. Its published mods are pulled periodically and belong to the given user. Required fields: origin (the URL of the other backend), remote-game, gameshort, username
+ Abilities: admin-mirrors
+ */
+func add_mirror(ctx *iris.Context) {
+    origin := cast.ToString(utils.GetJSON(ctx, "origin"))
+    remoteGame := cast.ToString(utils.GetJSON(ctx, "remote-game"))
+    gameshort := cast.ToString(utils.GetJSON(ctx, "gameshort"))
+    username := cast.ToString(utils.GetJSON(ctx, "username"))
+    if origin == "" || remoteGame == "" || gameshort == "" || username == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("All fields are required.").Code(2505))
+        return
+    }
+    game := &objects.Game{}
+    app.Database.Where("short = ?", gameshort).First(game)
+    if game.Short != gameshort {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
+        return
+    }
+    user := &objects.User{}
+    app.Database.Where("username = ?", username).First(user)
+    if user.Username != username {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The username is invalid.").Code(2145))
+        return
+    }
+    mirror := objects.NewMirror(origin, remoteGame, *game, *user)
+    existing := &objects.Mirror{}
+    app.Database.Where("origin = ? AND remote_game = ?", mirror.Origin, mirror.RemoteGame).First(existing)
+    if existing.ID != 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The game is already mirrored.").Code(2186))
+        return
+    }
+    if err := mirror.Check(); err != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The origin can't be mirrored: " + err.Error()).Code(2187))
+        return
+    }
+    app.Database.Save(mirror)
+    middleware.Audit(ctx, "mirror-add", "mirror", mirror.ID, map[string]interface{}{"origin": mirror.Origin, "remote_game": mirror.RemoteGame})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(mirror)})
+}
+
+/*
+ Path: /api/admin/mirrors/:mirrorid
+ Method: PUT
+ Description: Edits a mirror, for example to pause it by setting enabled to false. Required fields: data
+ Abilities: admin-mirrors
+ */
+func edit_mirror(ctx *iris.Context) {
+    mirrorid := cast.ToUint(ctx.GetString("mirrorid"))
+    mirror := &objects.Mirror{}
+    app.Database.Where("id = ?", mirrorid).First(mirror)
+    if mirror.ID != mirrorid || mirrorid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The mirror ID is invalid").Code(2188))
+        return
+    }
+    before := utils.ToMap(mirror)
+    code := utils.EditObject(mirror, utils.GetFullJSON(ctx))
+    if code == 3 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The value you submitted is invalid").Code(2180))
+        return
+    } else if code == 2 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You tried to edit a value that doesn't exist.").Code(3090))
+        return
+    } else if code == 1 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You tried to edit a value that is marked as read-only.").Code(3095))
+        return
+    }
+    app.Database.Set("gorm:save_associations", false).Save(mirror)
+    middleware.Audit(ctx, "mirror-edit", "mirror", mirror.ID, utils.Diff(before, utils.ToMap(mirror)))
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(mirror)})
+}
+
+/*
+ Path: /api/admin/mirrors
+ Method: DELETE
+ Description: Stops mirroring a game. The mods that were mirrored stay, and can be edited like local mods from now on. Required fields: mirrorid
+ Abilities: admin-mirrors
+ */
+func remove_mirror(ctx *iris.Context) {
+    mirrorid := cast.ToUint(utils.GetJSON(ctx, "mirrorid"))
+    mirror := &objects.Mirror{}
+    app.Database.Where("id = ?", mirrorid).First(mirror)
+    if mirror.ID != mirrorid || mirrorid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The mirror ID is invalid").Code(2188))
+        return
+    }
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Unscoped().Model(&objects.Mod{}).Where("mirror_id = ?", mirror.ID).UpdateColumn("mirror_id", 0).Error; err != nil {
+            return err
+        }
+        return work.DB.Delete(mirror).Error
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    middleware.Audit(ctx, "mirror-remove", "mirror", mirror.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/admin/mirrors/:mirrorid/sync
+ Method: POST
+ Description: Starts a sync of a mirror right away, instead of waiting for the next periodic sync. The sync runs in the background,
+ its outcome shows up in synced_at and last_error of the mirror once it is done
+ Abilities: admin-mirrors
+ */
+func sync_mirror(ctx *iris.Context) {
+    mirrorid := cast.ToUint(ctx.GetString("mirrorid"))
+    mirror := &objects.Mirror{}
+    app.Database.Where("id = ?", mirrorid).First(mirror)
+    if mirror.ID != mirrorid || mirrorid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The mirror ID is invalid").Code(2188))
+        return
+    }
+    objects.StartMirrorSync(mirror)
+    middleware.Audit(ctx, "mirror-sync", "mirror", mirror.ID, nil)
+    utils.WriteJSON(ctx, iris.StatusAccepted, iris.Map{"error": false, "count": 1, "data": utils.ToMap(mirror)})
 }
\ No newline at end of file
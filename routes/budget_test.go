@@ -0,0 +1,124 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package routes_test
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    _ "github.com/KSP-SpaceDock/SpaceDock-Backend/routes"
+    "gopkg.in/kataras/iris.v6/httptest"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "testing"
+    "time"
+)
+
+/*
+ How many objects of every type the listings return. Their query count must not depend on it
+ */
+const fixtureCount = 10
+
+func TestMain(m *testing.M) {
+    if err := app.Migrate(); err != nil {
+        log.Fatalf("* %s", err)
+    }
+    app.Settings.Debug = true
+    os.Exit(m.Run())
+}
+
+/*
+ Creates a game with versions, mods, lists and featured mods, and returns the game, a mod and a list of it
+ */
+func createFixtures(t *testing.T) (*objects.Game, *objects.Mod, *objects.ModList) {
+    suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+    publisher := objects.NewPublisher("Publisher " + suffix)
+    app.Database.Save(publisher)
+    game := objects.NewGame("Game " + suffix, *publisher, "game-" + suffix)
+    game.Active = true
+    app.Database.Save(game)
+    versions := []*objects.GameVersion{}
+    for i := 0; i < fixtureCount; i++ {
+        version := objects.NewGameVersion("1." + strconv.Itoa(i), *game, false)
+        app.Database.Save(version)
+        versions = append(versions, version)
+    }
+
+    var mod *objects.Mod
+    var list *objects.ModList
+    for i := 0; i < fixtureCount; i++ {
+        name := suffix + strconv.Itoa(i)
+        user := objects.NewUser("user" + name, "user" + name + "@example.com", "password")
+        user.Public = true
+        app.Database.Save(user)
+        mod = objects.NewMod("Mod " + name, *user, *game, "MIT")
+        mod.Published = true
+        app.Database.Save(mod)
+        for _,element := range versions {
+            version := objects.NewModVersion(*mod, element.FriendlyVersion, *element, "/content/" + name + ".zip", false)
+            app.Database.Save(version)
+            mod.DefaultVersionID = version.ID
+        }
+        app.Database.Model(mod).UpdateColumn("default_version_id", mod.DefaultVersionID)
+        app.Database.Save(objects.NewFeatured(*mod))
+        list = objects.NewModList("List " + name, *user, *game)
+        app.Database.Save(list)
+        app.Database.Save(objects.NewModListItem(*mod, *list))
+    }
+    if mod == nil || mod.ID == 0 || list.ID == 0 {
+        t.Fatal("Failed to create the fixtures")
+    }
+    return game, mod, list
+}
+
+/*
+ Requests every listing and checks that it stays within the queries the route declares, plus one for every relation it loads
+ */
+func TestListingQueryBudgets(t *testing.T) {
+    game, mod, list := createFixtures(t)
+    gameshort := game.Short
+    modid := strconv.Itoa(int(mod.ID))
+    listid := strconv.Itoa(int(list.ID))
+    budgets := []struct {
+        path   string
+        budget int
+    }{
+        {"/api/games", 1},
+        {"/api/games/" + gameshort, 1},
+        {"/api/games/" + gameshort + "/versions", 2},
+        {"/api/publishers", 1},
+        {"/api/publishers/" + strconv.Itoa(int(game.PublisherID)), 1},
+        {"/api/mods", 2},
+        {"/api/mods/" + gameshort, 3},
+        {"/api/mods/" + gameshort + "/" + modid, 7},
+        {"/api/mods/" + gameshort + "/" + modid + "/versions", 5},
+        {"/api/lists", 1},
+        {"/api/lists/" + gameshort, 2},
+        {"/api/lists/" + gameshort + "/" + listid, 2},
+        {"/api/featured", 3},
+        {"/api/featured/" + gameshort, 4},
+        {"/api/users", 2},
+        {"/api/users/" + strconv.Itoa(int(mod.UserID)), 2},
+    }
+
+    e := httptest.New(app.App, t)
+    for _,element := range budgets {
+        // The query string keeps the response out of the cache
+        header := e.GET(element.path).WithQuery("budget", element.budget).Expect().Status(http.StatusOK).Header("X-Query-Count").Raw()
+        count, err := strconv.Atoi(header)
+        if err != nil {
+            t.Errorf("%s didn't report its queries: %q", element.path, header)
+            continue
+        }
+        if count > element.budget {
+            t.Errorf("%s ran %d queries for %d objects, its budget is %d", element.path, count, fixtureCount, element.budget)
+        }
+    }
+}
\ No newline at end of file
@@ -21,8 +21,8 @@ import (
  Registers the routes for the featured section
  */
 func FeaturedRegister() {
-    Register(GET, "/api/featured", middleware.Recursion(1), middleware.Cache, list_featured)
-    Register(GET, "/api/featured/:gameshort", middleware.Recursion(1), middleware.Cache, list_featured_game)
+    Register(GET, "/api/featured", middleware.Relations(objects.Featured{}, "mod", "mod.user"), middleware.QueryBudget(1), middleware.Cache, list_featured)
+    Register(GET, "/api/featured/:gameshort", middleware.Relations(objects.Featured{}, "mod", "mod.user"), middleware.QueryBudget(2), middleware.Cache, list_featured_game)
     Register(POST, "/api/featured/:gameshort",
         middleware.NeedsPermission("mods-feature", true, "gameshort"),
         add_featured,
@@ -40,10 +40,12 @@ func FeaturedRegister() {
  */
 func list_featured(ctx *iris.Context) {
     var featured []objects.Featured
-    app.Database.Find(&featured)
-    output := make([]map[string]interface{}, len(featured))
-    for i,element := range featured {
-        output[i] = utils.ToMap(element)
+    middleware.DB(ctx).Find(&featured)
+    output := []map[string]interface{}{}
+    for _,element := range featured {
+        if !element.Mod.IsHidden() {
+            output = append(output, utils.ToMap(element))
+        }
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
 }
@@ -58,17 +60,17 @@ func list_featured_game(ctx *iris.Context) {
 
     // Check if the game exists
     game := &objects.Game{}
-    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
+    middleware.DB(ctx).Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
     if game.Short != gameshort && game.ID != cast.ToUint(gameshort) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
 
     var featured []objects.Featured
-    app.Database.Find(&featured)
+    middleware.DB(ctx).Find(&featured)
     output := []map[string]interface{}{}
     for _,element := range featured {
-        if element.Mod.GameID == game.ID {
+        if element.Mod.GameID == game.ID && !element.Mod.IsHidden() {
             output = append(output, utils.ToMap(element))
         }
     }
@@ -111,6 +113,7 @@ func add_featured(ctx *iris.Context) {
     // Everything is fine, lets feature the mod
     feature = objects.NewFeatured(*mod)
     app.Database.Save(feature)
+    middleware.Audit(ctx, "mod-feature", "mod", mod.ID, nil)
     utils.ClearFeaturedCache(gameshort)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(feature)})
 }
@@ -150,6 +153,7 @@ func remove_featured(ctx *iris.Context) {
 
     // Everything is fine, lets remove the feature
     app.Database.Delete(feature)
+    middleware.Audit(ctx, "mod-unfeature", "mod", mod.ID, nil)
     utils.ClearFeaturedCache(gameshort)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
\ No newline at end of file
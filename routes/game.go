@@ -22,8 +22,8 @@ import (
  Registers the routes for the game management
  */
 func GameRegister() {
-    Register(GET, "/api/games", middleware.Recursion(0), middleware.Cache, list_games)
-    Register(GET, "/api/games/:gameshort", middleware.Cache, show_game)
+    Register(GET, "/api/games", middleware.Relations(objects.Game{}), middleware.QueryBudget(1), middleware.Cache, list_games)
+    Register(GET, "/api/games/:gameshort", middleware.Relations(objects.Game{}), middleware.QueryBudget(1), middleware.Cache, show_game)
     Register(PUT, "/api/games/:gameshort",
         middleware.NeedsPermission("game-edit", true, "gameshort"),
         edit_game,
@@ -36,7 +36,7 @@ func GameRegister() {
         middleware.NeedsPermission("game-remove", true, "pubid"),
         remove_game,
     )
-    Register(GET, "/api/games/:gameshort/versions", middleware.Recursion(0), middleware.Cache, game_versions)
+    Register(GET, "/api/games/:gameshort/versions", middleware.Relations(objects.Game{}, "versions"), middleware.QueryBudget(1), middleware.Cache, game_versions)
     Register(POST, "/api/games/:gameshort/versions",
         middleware.NeedsPermission("game-edit", true, "gameshort"),
         game_version_add,
@@ -63,13 +63,13 @@ func list_games(ctx *iris.Context) {
     includeInactive := ctx.URLParam("includeInactive")
     val, err  := strconv.ParseBool(includeInactive)
     if (err == nil) && val {
-        app.Database.Find(&games)
+        middleware.DB(ctx).Find(&games)
     } else {
-        app.Database.Where("active = ?", true).Find(&games)
+        middleware.DB(ctx).Where("active = ?", true).Find(&games)
     }
     output := make([]map[string]interface{}, len(games))
     for i,element := range games {
-        output[i] = utils.ToMap(element)
+        output[i] = middleware.Expand(ctx, element, utils.ToMap(element))
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(games), "data": output})
 }
@@ -82,12 +82,12 @@ func list_games(ctx *iris.Context) {
 func show_game(ctx *iris.Context) {
     gameshort := ctx.GetString("gameshort")
     game := &objects.Game{}
-    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
+    middleware.DB(ctx).Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
     if game.Short != gameshort && game.ID != cast.ToUint(gameshort) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
         return
     }
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(game)})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": middleware.Expand(ctx, game, utils.ToMap(game))})
 }
 
 /*
@@ -106,6 +106,7 @@ func edit_game(ctx *iris.Context) {
     }
 
     // Edit the game
+    before := utils.ToMap(game)
     code := utils.EditObject(game, utils.GetFullJSON(ctx))
     if code == 3 {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The value you submitted is invalid").Code(2180))
@@ -118,6 +119,7 @@ func edit_game(ctx *iris.Context) {
         return
     }
     app.Database.Save(game)
+    middleware.Audit(ctx, "game-edit", "game", game.ID, utils.Diff(before, utils.ToMap(game)))
     utils.ClearGameCache(gameshort, "")
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(game)})
 }
@@ -174,6 +176,7 @@ func add_game(ctx *iris.Context) {
     // Make a new game
     game = objects.NewGame(name, publisher, short)
     app.Database.Save(game)
+    middleware.Audit(ctx, "game-add", "game", game.ID, nil)
     utils.ClearGameCache("", "")
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(game)})
 }
@@ -182,6 +185,7 @@ func add_game(ctx *iris.Context) {
  Path: /api/games/
  Method: DELETE
  Description: Removes a game from existence. Required fields: short
+              Games that still have mods or lists can't be removed
  Abilities: game-remove
  */
 func remove_game(ctx *iris.Context) {
@@ -194,9 +198,26 @@ func remove_game(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
         return
     }
+    mods, lists := 0, 0
+    app.Database.Model(&objects.Mod{}).Where("game_id = ?", game.ID).Count(&mods)
+    app.Database.Model(&objects.ModList{}).Where("game_id = ?", game.ID).Count(&lists)
+    if mods > 0 || lists > 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The game still has mods or lists. Remove them first.").Code(2189))
+        return
+    }
 
-    // Remove it
-    app.Database.Delete(game)
+    // Remove it together with its versions
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Where("game_id = ?", game.ID).Delete(objects.GameVersion{}).Error; err != nil {
+            return err
+        }
+        return work.DB.Delete(game).Error
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    middleware.Audit(ctx, "game-remove", "game", game.ID, nil)
     utils.ClearGameCache("", "")
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -209,7 +230,7 @@ func remove_game(ctx *iris.Context) {
 func game_versions(ctx *iris.Context) {
     gameshort := ctx.GetString("gameshort")
     game := &objects.Game{}
-    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
+    middleware.DB(ctx).Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
     if game.Short != gameshort && game.ID != cast.ToUint(gameshort) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The game does not exist.").Code(2125))
         return
@@ -245,6 +266,7 @@ func game_version_add(ctx *iris.Context) {
     // Create a new version
     version := objects.NewGameVersion(friendly_version, *game, is_beta)
     app.Database.Save(version)
+    middleware.Audit(ctx, "game-version-add", "game-version", version.ID, nil)
 
     // Format the output
     utils.ClearGameCache(gameshort, "")
@@ -277,6 +299,7 @@ func game_version_remove(ctx *iris.Context) {
 
     // Delete it
     app.Database.Delete(version)
+    middleware.Audit(ctx, "game-version-remove", "game-version", version.ID, nil)
 
     // Format the output
     utils.ClearGameCache(gameshort, "")
@@ -335,6 +358,7 @@ func game_version_edit(ctx *iris.Context) {
     }
 
     // Edit the game version
+    before := utils.ToMap(version)
     code := utils.EditObject(version, utils.GetFullJSON(ctx))
     if code == 3 {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The value you submitted is invalid").Code(2180))
@@ -347,6 +371,7 @@ func game_version_edit(ctx *iris.Context) {
         return
     }
     app.Database.Save(version)
+    middleware.Audit(ctx, "game-version-edit", "game-version", version.ID, utils.Diff(before, utils.ToMap(version)))
     utils.ClearGameCache(gameshort, friendly_version)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(version)})
 }
\ No newline at end of file
@@ -35,8 +35,11 @@ func init() {
     GeneralRegister()
     ModlistsRegister()
     ModsRegister()
+    OAuthRegister()
     PublisherRegister()
+    SessionsRegister()
     TokensRegister()
+    TwoFactorRegister()
     UserRegister()
 }
 
@@ -77,6 +80,11 @@ func MiddlewareRegister() {
     store := limiter.NewMemoryStore()
     limiterInstance := limiter.NewLimiter(store, rate)
     app.App.Use(middleware.NewAccessLimiter(limiterInstance))
+    middleware.CreateLoginGuard()
+    middleware.CreateDownloadCounter()
+
+    // Mark requests of admins that are logged in as someone else
+    app.App.Use(iris.HandlerFunc(middleware.ImpersonationHeader))
 
     // Cross-Origin Requests
     if app.Settings.DisableSameOrigin {
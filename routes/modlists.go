@@ -21,9 +21,13 @@ import (
  Registers the routes for the modlist section
  */
 func ModlistsRegister() {
-    Register(GET, "/api/lists", middleware.Recursion(0), middleware.Cache, list_modlists)
-    Register(GET, "/api/lists/:gameshort", middleware.Recursion(0), middleware.Cache, list_modlists_game)
-    Register(GET, "/api/lists/:gameshort/:listid", middleware.Cache, list_info)
+    Register(GET, "/api/lists", middleware.Relations(objects.ModList{}), middleware.QueryBudget(1), middleware.Cache, list_modlists)
+    Register(GET, "/api/lists/:gameshort", middleware.Relations(objects.ModList{}),
+        middleware.QueryBudget(2),
+        middleware.Cache,
+        list_modlists_game,
+    )
+    Register(GET, "/api/lists/:gameshort/:listid", middleware.Relations(objects.ModList{}, "game"), middleware.QueryBudget(1), middleware.Cache, list_info)
     Register(POST, "/api/lists",
         middleware.NeedsPermission("lists-add", true, "gameshort"),
         lists_add,
@@ -45,10 +49,10 @@ func ModlistsRegister() {
  */
 func list_modlists(ctx *iris.Context) {
     var modlists []objects.ModList
-    app.Database.Find(&modlists)
+    middleware.DB(ctx).Find(&modlists)
     output := make([]map[string]interface{}, len(modlists))
     for i,element := range modlists {
-        output[i] = utils.ToMap(element)
+        output[i] = middleware.Expand(ctx, element, utils.ToMap(element))
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
 }
@@ -60,13 +64,13 @@ func list_modlists(ctx *iris.Context) {
  */
 func list_modlists_game(ctx *iris.Context) {
     gameshort := ctx.GetString("gameshort")
+    game := &objects.Game{}
+    middleware.DB(ctx).Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
     var modlists []objects.ModList
-    app.Database.Find(&modlists)
-    output := []map[string]interface{}{}
-    for _,element := range modlists {
-        if element.Game.Short == gameshort || element.GameID == cast.ToUint(gameshort) {
-            output = append(output, utils.ToMap(element))
-        }
+    middleware.DB(ctx).Where("game_id = ?", game.ID).Find(&modlists)
+    output := make([]map[string]interface{}, len(modlists))
+    for i,element := range modlists {
+        output[i] = middleware.Expand(ctx, element, utils.ToMap(element))
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
 }
@@ -83,7 +87,7 @@ func list_info(ctx *iris.Context) {
 
     // Get the modlist
     modlist := &objects.ModList{}
-    app.Database.Where("id = ?", listid).First(modlist)
+    middleware.DB(ctx).Where("id = ?", listid).First(modlist)
     if modlist.ID != listid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The pack ID is invalid").Code(2135))
         return
@@ -92,7 +96,7 @@ func list_info(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(modlist)})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": middleware.Expand(ctx, modlist, utils.ToMap(modlist))})
 }
 
 /*
@@ -132,13 +136,16 @@ func lists_add(ctx *iris.Context) {
     // Make a new list
     user := middleware.CurrentUser(ctx)
     modlist = objects.NewModList(name, *user, *game)
-    app.Database.Save(modlist)
-    role := user.AddRole(name)
-    role.AddAbility("lists-edit")
-    role.AddAbility("lists-remove")
-    role.AddParam("lists-edit", "listsid", cast.ToString(modlist.ID))
-    role.AddParam("lists-remove", "name", name)
-    app.Database.Save(user).Save(role)
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Save(modlist).Error; err != nil {
+            return err
+        }
+        return modlist.AddOwnerRole(work.DB)
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
     utils.ClearModListCache(gameshort, 0)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(modlist)})
 }
@@ -204,8 +211,20 @@ func list_remove(ctx *iris.Context) {
         return
     }
 
-    // Remove the modlist
-    app.Database.Delete(modlist)
+    // Remove the modlist, its entries and the role of its owner
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Where("mod_list_id = ?", modlist.ID).Delete(objects.ModListItem{}).Error; err != nil {
+            return err
+        }
+        if err := work.DB.Delete(modlist).Error; err != nil {
+            return err
+        }
+        return modlist.RemoveOwnerRole(work.DB)
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
     utils.ClearModListCache(gameshort, 0)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -244,7 +263,7 @@ func list_add_mod(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -298,7 +317,7 @@ func list_remove_mod(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
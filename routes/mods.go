@@ -14,14 +14,14 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "archive/zip"
+    "crypto/sha256"
+    "encoding/hex"
     "github.com/kennygrant/sanitize"
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
     "io"
     "os"
     "path/filepath"
-    "strconv"
-    "strings"
     "time"
 )
 
@@ -29,9 +29,14 @@ import (
  Registers the routes for the mod section
  */
 func ModsRegister() {
-    Register(GET, "/api/mods", middleware.Recursion(0), middleware.Cache, mod_list)
-    Register(GET, "/api/mods/:gameshort", middleware.Recursion(0), middleware.Cache, mod_game_list)
-    Register(GET, "/api/mods/:gameshort/:modid", middleware.Cache, mod_info)
+    Register(GET, "/api/mods", middleware.Relations(objects.Mod{}, "user"), middleware.QueryBudget(1), middleware.Cache, mod_list)
+    Register(GET, "/api/mods/:gameshort", middleware.Relations(objects.Mod{}, "user"), middleware.QueryBudget(2), middleware.Cache, mod_game_list)
+    Register(GET, "/api/mods/:gameshort/:modid",
+        middleware.Relations(objects.Mod{}, "user", "game", "default_version", "default_version.gameversion", "versions", "versions.gameversion"),
+        middleware.QueryBudget(1),
+        middleware.Cache,
+        mod_info,
+    )
     Register(GET, "/api/mods/:gameshort/:modid/download/:versionname", mod_download)
     Register(PUT, "/api/mods/:gameshort/:modid",
         middleware.NeedsPermission("mods-edit", true, "gameshort", "modid"),
@@ -49,7 +54,16 @@ func ModsRegister() {
         middleware.NeedsPermission("mods-edit", true, "gameshort", "modid"),
         mod_publish,
     )
-    Register(GET, "/api/mods/:gameshort/:modid/versions", middleware.Recursion(0), middleware.Cache, mod_versions)
+    Register(GET, "/api/mods/:gameshort/:modid/versions",
+        middleware.Relations(objects.Mod{}, "user", "game", "versions", "versions.gameversion"),
+        middleware.QueryBudget(1),
+        middleware.Cache,
+        mod_versions,
+    )
+    Register(POST, "/api/mods/:gameshort/:modid/releases",
+        middleware.NeedsPermission("mods-edit", true, "gameshort", "modid"),
+        mod_release,
+    )
     Register(POST, "/api/mods/:gameshort/:modid/versions",
         middleware.NeedsPermission("mod-edit", true, "gameshort", "modid"),
         mod_update,
@@ -99,10 +113,12 @@ func ModsRegister() {
  */
 func mod_list(ctx *iris.Context) {
     var mods []objects.Mod
-    app.Database.Find(&mods)
-    output := make([]map[string]interface{}, len(mods))
-    for i,element := range mods {
-        output[i] = utils.ToMap(element)
+    middleware.DB(ctx).Find(&mods)
+    output := []map[string]interface{}{}
+    for _,element := range mods {
+        if !element.IsHidden() {
+            output = append(output, middleware.Expand(ctx, element, utils.ToMap(element)))
+        }
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
 }
@@ -115,13 +131,13 @@ func mod_list(ctx *iris.Context) {
 func mod_game_list(ctx *iris.Context) {
     gameshort := ctx.GetString("gameshort")
     game := &objects.Game{}
-    app.Database.Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).Find(game)
+    middleware.DB(ctx).Where("short = ?", gameshort).Or("id = ?", cast.ToUint(gameshort)).First(game)
     var mods []objects.Mod
-    app.Database.Find(&mods)
+    middleware.DB(ctx).Where("game_id = ?", game.ID).Find(&mods)
     output := []map[string]interface{}{}
     for _,element := range mods {
-        if element.GameID == game.ID {
-            output = append(output, utils.ToMap(element))
+        if !element.IsHidden() {
+            output = append(output, middleware.Expand(ctx, element, utils.ToMap(element)))
         }
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
@@ -139,7 +155,7 @@ func mod_info(ctx *iris.Context) {
 
     // Get the mod
     mod := &objects.Mod{}
-    app.Database.Where("id = ?", modid).First(mod)
+    middleware.DB(ctx).Where("id = ?", modid).First(mod)
     if mod.ID != modid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The modid is invalid").Code(2130))
         return
@@ -148,12 +164,12 @@ func mod_info(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
     // Display info
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(mod)})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": middleware.Expand(ctx, mod, utils.ToMap(mod))})
 }
 
 /*
@@ -178,7 +194,7 @@ func mod_download(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -197,31 +213,16 @@ func mod_download(ctx *iris.Context) {
         return
     }
 
-    // Grab events
-    download := &objects.DownloadEvent{}
-    app.Database.
-        Where("mod_id = ?", mod.ID).
-        Where("version_id = ?", version.ID).
-        Order("download_event.created_at desc").
-        First(download)
-
     // Check whether the path exists
     if _, err := os.Stat(filepath.Join(app.Settings.Storage, version.DownloadPath)); os.IsNotExist(err) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The file you tried to access doesn't exist.").Code(2120))
         return
     }
 
-    if ctx.Header().Get("Range") == "" {
-        if download.ID == 0 || (time.Now().Sub(download.CreatedAt).Seconds() / 60 / 60) >= 1 {
-            download = objects.NewDownloadEvent(*mod, *version)
-            download.Downloads += 1
-            app.Database.Save(download)
-        } else {
-            download.Downloads += 1
-        }
-        mod.DownloadCount += 1
+    // Requests for a part of the file continue a download that was counted already
+    if ctx.Header().Get("Range") == "" && middleware.CountsDownload(ctx, version) {
+        objects.CountDownload(mod, version)
     }
-    app.Database.Save(mod)
 
     // Download
     ctx.Redirect("/content/" + version.DownloadPath, iris.StatusTemporaryRedirect)
@@ -249,6 +250,10 @@ func mod_edit(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
+    if mod.IsMirrored() {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is mirrored from " + mod.Origin + " and can only be changed there").Code(3088))
+        return
+    }
 
     // Edit the mod
     code := utils.EditObject(mod, utils.GetFullJSON(ctx))
@@ -262,7 +267,7 @@ func mod_edit(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You tried to edit a value that is marked as read-only.").Code(3095))
         return
     }
-    app.Database.Save(mod)
+    app.Database.Omit(objects.ModCounters...).Save(mod)
     utils.ClearModCache(gameshort, modid)
 
     // Display info
@@ -311,13 +316,16 @@ func mod_add(ctx *iris.Context) {
 
     // Add new mod
     mod = objects.NewMod(name, *middleware.CurrentUser(ctx), *game, license)
-    app.Database.Save(mod)
-    role := mod.User.AddRole(name)
-    role.AddAbility("mods-edit")
-    role.AddAbility("mods-remove")
-    role.AddParam("mods-edit", "modid", cast.ToString(mod.ID))
-    role.AddParam("mods-remove", "name", name)
-    app.Database.Save(role)
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Save(mod).Error; err != nil {
+            return err
+        }
+        return mod.AddOwnerRole(work.DB)
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
     utils.ClearModCache(gameshort, 0)
 
     // Display info
@@ -348,13 +356,18 @@ func mod_remove(ctx *iris.Context) {
     }
 
     // Delete the mod
-    role := &objects.Role{}
-    app.Database.Where("name = ?", mod.Name).First(role)
-    role.RemoveAbility("mods-edit")
-    role.RemoveAbility("mods-remove")
-    mod.User.RemoveRole(mod.Name)
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := work.DB.Delete(mod).Error; err != nil {
+            return err
+        }
+        return mod.RemoveOwnerRole(work.DB)
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
     utils.ClearModCache(mod.Game.Short, 0)
-    app.Database.Delete(mod).Delete(role)
+    middleware.Audit(ctx, "mod-remove", "mod", mod.ID, map[string]interface{}{"name": mod.Name, "owner": mod.UserID})
 
     // Display info
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
@@ -385,7 +398,7 @@ func mod_publish(ctx *iris.Context) {
 
     // Publish
     mod.Published = true
-    app.Database.Save(mod)
+    app.Database.Model(mod).UpdateColumns(map[string]interface{}{"published": true, "updated_at": time.Now()})
     utils.ClearModCache(gameshort, modid)
 
     // Display info
@@ -404,7 +417,7 @@ func mod_versions(ctx *iris.Context) {
 
     // Get the mod
     mod := &objects.Mod{}
-    app.Database.Where("id = ?", modid).First(mod)
+    middleware.DB(ctx).Where("id = ?", modid).First(mod)
     if mod.ID != modid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The modid is invalid").Code(2130))
         return
@@ -413,7 +426,7 @@ func mod_versions(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -456,7 +469,7 @@ func mod_update(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -466,23 +479,17 @@ func mod_update(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("All fields are required.").Code(2505))
         return
     }
+    defer zipball.Close()
     if friendly_version == "default" || friendly_version == "latest" {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You cannot use a reserved friendly_version").Code(2503))
+        return
     }
     game_version := &objects.GameVersion{}
-    app.Database.Where("friendly_version = ?", friendly_version).First(game_version)
+    app.Database.Where("friendly_version = ?", friendly_version).Where("game_id = ?", mod.GameID).First(game_version)
     if game_version.FriendlyVersion != friendly_version {
         utils.WriteJSON(ctx, iris.StatusNotFound,  utils.Error("Game version does not exist").Code(2105))
         return
     }
-
-    // Save the file
-    user := middleware.CurrentUser(ctx)
-    filename := sanitize.BaseName(mod.Name) + "-" + sanitize.BaseName(version) + ".zip"
-    base_path := filepath.Join(sanitize.BaseName(user.Username) + "_" + strconv.Itoa(int(user.ID)), sanitize.BaseName(mod.Name))
-    full_path := filepath.Join(app.Settings.Storage, base_path)
-    os.MkdirAll(full_path, os.ModePerm)
-    path := filepath.Join(full_path, filename)
     for _,v := range mod.Versions {
         if v.FriendlyVersion == sanitize.BaseName(version) {
             utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("We already have this version. Did you mistype the version number?").Code(3040))
@@ -490,28 +497,134 @@ func mod_update(ctx *iris.Context) {
         }
     }
 
-    // Remove the old file. If it fails, dont care
-    _ = os.Remove(filepath.Join(app.Settings.Storage, path))
-    out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
-    if err != nil {
-        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+    // Save the file
+    modversion, status, e := storeModVersion(mod, middleware.CurrentUser(ctx), version, game_version, changelog, beta, notify, zipball)
+    if modversion == nil {
+        utils.WriteJSON(ctx, status, e)
+        return
+    }
+    utils.ClearModCache(gameshort, modid)
+
+    // Display info
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(modversion)})
+}
+
+/*
+ Path: /api/mods/:gameshort/:modid/releases
+ Method: POST
+ Description: Releases a new version of a mod from a build pipeline. Expects a multipart form with the fields zipball and manifest.
+              The manifest is a JSON object with the fields version, game_version, changelog, beta and notify.
+              Releasing a version that already exists with the same file returns the existing version instead of failing.
+ Abilities: mods-edit
+ */
+func mod_release(ctx *iris.Context) {
+    // Get params
+    gameshort := ctx.GetString("gameshort")
+    modid := cast.ToUint(ctx.GetString("modid"))
+
+    // Get the mod
+    mod := &objects.Mod{}
+    app.Database.Where("id = ?", modid).First(mod)
+    if mod.ID != modid {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The modid is invalid").Code(2130))
+        return
+    }
+    if mod.Game.Short != gameshort && mod.GameID != cast.ToUint(gameshort) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
+        return
+    }
+
+    // Read the manifest
+    manifest := utils.LoadJSON(ctx.FormValue("manifest"))
+    if manifest == nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The manifest is missing or not valid JSON.").Code(2506))
         return
     }
+    version := cast.ToString(manifest["version"])
+    friendly_version := cast.ToString(manifest["game_version"])
+    changelog := cast.ToString(manifest["changelog"])
+    beta := cast.ToBool(manifest["beta"])
+    notify := cast.ToBool(manifest["notify"])
+    zipball, _, err := ctx.FormFile("zipball")
+    if version == "" || friendly_version == "" || err != nil {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The fields version, game_version and zipball are required.").Code(2505))
+        return
+    }
+    defer zipball.Close()
+    if version == "default" || version == "latest" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You cannot use a reserved version name").Code(2503))
+        return
+    }
+    game_version := &objects.GameVersion{}
+    app.Database.Where("friendly_version = ?", friendly_version).Where("game_id = ?", mod.GameID).First(game_version)
+    if game_version.FriendlyVersion != friendly_version {
+        utils.WriteJSON(ctx, iris.StatusNotFound,  utils.Error("Game version does not exist").Code(2105))
+        return
+    }
+
+    // Releasing the same version twice is fine, as long as the file didn't change
+    for _,v := range mod.Versions {
+        if v.FriendlyVersion != sanitize.BaseName(version) {
+            continue
+        }
+        existing, err := fileChecksum(filepath.Join(app.Settings.Storage, v.DownloadPath))
+        uploaded := sha256.New()
+        io.Copy(uploaded, zipball)
+        if err != nil || existing != hex.EncodeToString(uploaded.Sum(nil)) {
+            utils.WriteJSON(ctx, iris.StatusConflict, utils.Error("This version was already released with a different file.").Code(3041))
+            return
+        }
+        utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(v)})
+        return
+    }
+
+    // Save the file
+    modversion, status, e := storeModVersion(mod, middleware.CurrentUser(ctx), version, game_version, changelog, beta, notify, zipball)
+    if modversion == nil {
+        utils.WriteJSON(ctx, status, e)
+        return
+    }
+    utils.ClearModCache(gameshort, modid)
+
+    // Display info
+    utils.WriteJSON(ctx, iris.StatusCreated, iris.Map{"error": false, "count": 1, "data": utils.ToMap(modversion)})
+}
+
+/*
+ Stores an uploaded zipball as a new version of the mod and notifies the followers.
+ Returns the new version, or the status code and error that should be sent to the client
+ */
+func storeModVersion(mod *objects.Mod, user *objects.User, version string, game_version *objects.GameVersion, changelog string, beta bool, notify bool, zipball io.Reader) (*objects.ModVersion, int, iris.Map) {
+    if mod.IsMirrored() {
+        return nil, iris.StatusForbidden, utils.Error("The mod is mirrored from " + mod.Origin + " and can only be changed there").Code(3088)
+    }
+    download_path := objects.ModVersionPath(*user, *mod, version)
+    path := filepath.Join(app.Settings.Storage, filepath.FromSlash(download_path))
+    os.MkdirAll(filepath.Dir(path), os.ModePerm)
+
+    // Write the upload next to its final location, it replaces the old file once the version is stored
+    upload := path + ".upload"
+    previous := path + ".old"
+    out, err := os.OpenFile(upload, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+    if err != nil {
+        return nil, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153)
+    }
     io.Copy(out, zipball)
     out.Close()
-    zipball.Close()
 
     // Check if the file is a zipfile
-    temp,err := zip.OpenReader(path)
+    temp,err := zip.OpenReader(upload)
     if err != nil {
-        _ = os.Remove(filepath.Join(app.Settings.Storage, path))
-        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("This is not a valid zip file.").Code(2160))
-        return
+        _ = os.Remove(upload)
+        return nil, iris.StatusBadRequest, utils.Error("This is not a valid zip file.").Code(2160)
     } else {
         temp.Close()
     }
-    modversion := objects.NewModVersion(*mod, sanitize.BaseName(version), *game_version, strings.Replace(filepath.Join(base_path, filename), "\\", "/", -1), beta)
+    modversion := objects.NewModVersion(*mod, sanitize.BaseName(version), *game_version, download_path, beta)
     modversion.Changelog = changelog
+    if info, err := os.Stat(upload); err == nil {
+        modversion.FileSize = info.Size()
+    }
 
     // sort index
     if len(mod.Versions) == 0 {
@@ -524,27 +637,82 @@ func mod_update(ctx *iris.Context) {
         }
         modversion.SortIndex += 1
     }
+    err = app.Transaction(func(work *app.UnitOfWork) error {
+        work.OnRollback(func() {
+            _ = os.Remove(upload)
+        })
+        if err := work.DB.Save(modversion).Error; err != nil {
+            return err
+        }
+        if !beta {
+            mod.DefaultVersionID = modversion.ID
+            mod.DefaultVersion = *modversion
+        }
+        if err := work.DB.Model(mod).UpdateColumns(map[string]interface{}{"default_version_id": mod.DefaultVersionID, "updated_at": time.Now()}).Error; err != nil {
+            return err
+        }
+        if notify && !beta {
+            for _,e := range mod.Followers {
+                if e.WantsDigest() {
+                    if err := work.DB.Save(objects.NewDigestEntry(e, *mod, *modversion)).Error; err != nil {
+                        return err
+                    }
+                }
+            }
+        }
+
+        // Move the file last, so a failed write never replaces the old one. The old file is kept aside until the version is stored
+        if _, err := os.Stat(path); err == nil {
+            if err := os.Rename(path, previous); err != nil {
+                return err
+            }
+            work.OnRollback(func() {
+                _ = os.Rename(previous, path)
+            })
+        }
+        if err := os.Rename(upload, path); err != nil {
+            return err
+        }
+        work.OnRollback(func() {
+            _ = os.Remove(path)
+        })
+        return nil
+    })
+    if err != nil {
+        return nil, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153)
+    }
+    _ = os.Remove(previous)
     if notify && !beta {
+        // Followers who want a digest got the update queued, everyone else gets an email right away
         followers := []string{}
         for _,e := range mod.Followers {
-            followers = append(followers, e.Email)
+            if !e.WantsDigest() {
+                followers = append(followers, e.Email)
+            }
         }
         err, modURL := mod.Game.GetValue("modURL")
         if err != nil {
             modURL = ""
         }
-        utils.SendUpdateNotification(followers, changelog, user.Username, friendly_version, mod.Name, mod.ID, cast.ToString(modURL), mod.Game.Name, game_version.FriendlyVersion)
-    }
-    app.Database.Save(modversion)
-    if !beta {
-        mod.DefaultVersionID = modversion.ID
-        mod.DefaultVersion = *modversion
+        utils.SendUpdateNotification(followers, changelog, user.Username, modversion.FriendlyVersion, mod.Name, mod.ID, cast.ToString(modURL), mod.Game.Name, game_version.FriendlyVersion)
     }
-    app.Database.Save(mod)
-    utils.ClearModCache(gameshort, modid)
+    return modversion, iris.StatusOK, nil
+}
 
-    // Display info
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(modversion)})
+/*
+ Returns the hex encoded SHA256 checksum of a file
+ */
+func fileChecksum(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    hash := sha256.New()
+    if _, err := io.Copy(hash, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 /*
@@ -569,7 +737,7 @@ func mod_version_delete(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -582,7 +750,7 @@ func mod_version_delete(ctx *iris.Context) {
         return
     }
 
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The mod is not published.").Code(3020))
         return
     }
@@ -597,6 +765,8 @@ func mod_version_delete(ctx *iris.Context) {
         return
     }
     app.Database.Delete(version)
+    app.Database.Where("version_id = ?", version.ID).Delete(objects.DigestEntry{})
+    middleware.Audit(ctx, "mod-version-remove", "mod-version", version.ID, map[string]interface{}{"mod": mod.ID, "version": version.FriendlyVersion})
     utils.ClearModCache(gameshort, modid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -623,7 +793,7 @@ func mod_follow(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -650,7 +820,8 @@ func mod_follow(ctx *iris.Context) {
     }
     mod.Followers = append(mod.Followers, *user)
     user.Following = append(user.Following, *mod)
-    app.Database.Save(mod).Save(user)
+    app.Database.Omit(objects.ModCounters...).Save(mod)
+    app.Database.Save(user)
     utils.ClearModCache(gameshort, modid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -677,7 +848,7 @@ func mod_unfollow(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -706,7 +877,9 @@ func mod_unfollow(ctx *iris.Context) {
     _,j := utils.ArrayContains(mod, user.Following)
     mod.Followers = append(mod.Followers[:i], mod.Followers[i+1:]...)
     user.Following = append(user.Following[:j], user.Following[j+1:]...)
-    app.Database.Save(mod).Save(user)
+    app.Database.Omit(objects.ModCounters...).Save(mod)
+    app.Database.Save(user)
+    app.Database.Where("mod_id = ?", mod.ID).Where("user_id = ?", user.ID).Delete(objects.DigestEntry{})
     utils.ClearModCache(gameshort, modid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -733,7 +906,7 @@ func mod_rate(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -752,7 +925,7 @@ func mod_rate(ctx *iris.Context) {
     // Add rating to user and mod
     mod.Ratings = append(mod.Ratings, *rating)
     mod.CalculateScore()
-    app.Database.Save(mod)
+    app.Database.Model(mod).UpdateColumns(map[string]interface{}{"total_score": mod.TotalScore, "updated_at": time.Now()})
     utils.ClearModCache(gameshort, modid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -778,7 +951,7 @@ func mod_unrate(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -794,7 +967,7 @@ func mod_unrate(ctx *iris.Context) {
     _,i := utils.ArrayContains(*rating, mod.Ratings)
     mod.Ratings = append(mod.Ratings[:i], mod.Ratings[i+1:]...)
     mod.CalculateScore()
-    app.Database.Save(mod)
+    app.Database.Model(mod).UpdateColumns(map[string]interface{}{"total_score": mod.TotalScore, "updated_at": time.Now()})
     utils.ClearModCache(gameshort, modid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
@@ -882,7 +1055,7 @@ func mod_accept_grant(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -890,8 +1063,16 @@ func mod_accept_grant(ctx *iris.Context) {
     for _,element := range mod.SharedAuthors {
         if middleware.IsCurrentUser(ctx, &element.User) && !element.Accepted {
             element.Accepted = true
-            element.User.AddRole(mod.Name)
-            app.Database.Save(&(element.User)).Save(&element)
+            err := app.Transaction(func(work *app.UnitOfWork) error {
+                if _,err := element.User.AddRoleTx(work.DB, mod.Name); err != nil {
+                    return err
+                }
+                return work.DB.Save(&element).Error
+            })
+            if err != nil {
+                utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+                return
+            }
             utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(mod)})
             return
         }
@@ -920,7 +1101,7 @@ func mod_reject_grant(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The gameshort is invalid.").Code(2125))
         return
     }
-    if !mod.Published && !middleware.IsCurrentUser(ctx, &mod.User) {
+    if (!mod.Published || mod.IsHidden()) && !middleware.IsCurrentUser(ctx, &mod.User) {
         utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("The mod is not published").Code(3020))
         return
     }
@@ -981,11 +1162,16 @@ func mod_revoke_grant(ctx *iris.Context) {
     }
 
     // Remove SharedAuthor
-    shared.User.RemoveRole(mod.Name)
-    app.Database.Save(&(shared.User))
-    _, i := utils.ArrayContains(shared, mod.SharedAuthors)
-    mod.SharedAuthors = append(mod.SharedAuthors[:i], mod.SharedAuthors[i+1:]...)
-    app.Database.Delete(shared)
+    err := app.Transaction(func(work *app.UnitOfWork) error {
+        if err := user.RemoveRoleTx(work.DB, mod.Name); err != nil {
+            return err
+        }
+        return work.DB.Delete(shared).Error
+    })
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
     utils.ClearModCache(gameshort, modid)
 
     // Display info
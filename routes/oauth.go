@@ -0,0 +1,429 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package routes
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/middleware"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "github.com/spf13/cast"
+    "gopkg.in/kataras/iris.v6"
+    "net/url"
+    "strings"
+)
+
+/*
+ Registers the routes for the OAuth section
+ */
+func OAuthRegister() {
+    Register(GET, "/api/oauth/clients",
+        middleware.NeedsPermission("logged-in", false),
+        list_oauth_clients,
+    )
+    Register(POST, "/api/oauth/clients",
+        middleware.NeedsPermission("logged-in", false),
+        register_oauth_client,
+    )
+    Register(DELETE, "/api/oauth/clients",
+        middleware.NeedsPermission("logged-in", false),
+        remove_oauth_client,
+    )
+    Register(GET, "/api/oauth/authorize",
+        middleware.NeedsPermission("logged-in", false),
+        oauth_authorize_info,
+    )
+    Register(POST, "/api/oauth/authorize",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        oauth_authorize,
+    )
+    Register(POST, "/api/oauth/token", oauth_token)
+    Register(GET, "/api/oauth/grants",
+        middleware.NeedsPermission("logged-in", false),
+        list_oauth_grants,
+    )
+    Register(DELETE, "/api/oauth/grants",
+        middleware.NeedsPermission("logged-in", false),
+        revoke_oauth_grant,
+    )
+}
+
+/*
+ Path: /api/oauth/clients
+ Method: GET
+ Description: Lists the OAuth applications registered by the current user
+ */
+func list_oauth_clients(ctx *iris.Context) {
+    user := middleware.CurrentUser(ctx)
+    var clients []objects.OAuthClient
+    app.Database.Where("owner_id = ?", user.ID).Find(&clients)
+    output := make([]map[string]interface{}, len(clients))
+    for i,element := range clients {
+        output[i] = oauthClientMap(element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/oauth/clients
+ Method: POST
+ Description: Registers a new OAuth application. Required fields: name, redirect_uris. Optional fields: homepage, confidential
+ Confidential clients get a client_secret, which is only shown this one time. Public clients have to use PKCE.
+ */
+func register_oauth_client(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage OAuth applications.").Code(1045))
+        return
+    }
+    name := cast.ToString(utils.GetJSON(ctx, "name"))
+    homepage := cast.ToString(utils.GetJSON(ctx, "homepage"))
+    redirects := cast.ToStringSlice(utils.GetJSON(ctx, "redirect_uris"))
+    confidential := cast.ToBool(utils.GetJSON(ctx, "confidential"))
+
+    // Check the values
+    if name == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The application name is invalid.").Code(2142))
+        return
+    }
+    if len(redirects) == 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("At least one redirect URI is required.").Code(2138))
+        return
+    }
+    for _,element := range redirects {
+        u, err := url.Parse(element)
+        if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(element, " ") {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The redirect URI " + element + " is invalid.").Code(2138))
+            return
+        }
+    }
+
+    // Create the client
+    client, secret := objects.NewOAuthClient(*middleware.CurrentUser(ctx), name, redirects, confidential)
+    client.Homepage = homepage
+    app.Database.Save(client)
+
+    // The secret is only shown this one time
+    output := oauthClientMap(*client)
+    if confidential {
+        output["client_secret"] = secret
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": output})
+}
+
+/*
+ Path: /api/oauth/clients
+ Method: DELETE
+ Description: Removes an OAuth application and revokes every token that was issued to it. Required fields: clientid
+ Abilities: oauth-client-delete (for applications of other users)
+ */
+func remove_oauth_client(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage OAuth applications.").Code(1045))
+        return
+    }
+    clientid := cast.ToUint(utils.GetJSON(ctx, "clientid"))
+
+    // Get the client
+    client := &objects.OAuthClient{}
+    app.Database.Where("id = ?", clientid).First(client)
+    if client.ID != clientid {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The client ID is invalid").Code(2136))
+        return
+    }
+    if client.OwnerID != middleware.CurrentUser(ctx).ID && middleware.UserHasPermission(ctx, "oauth-client-delete", true, []string{"clientid"}) != 0 {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have access to this application.").Code(1020))
+        return
+    }
+
+    // Delete the client
+    client.Revoke()
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/oauth/authorize
+ Method: GET
+ Description: Validates an authorization request and returns the information the consent screen needs.
+              URL parameters: client_id, redirect_uri, response_type, scope, code_challenge, code_challenge_method
+ */
+func oauth_authorize_info(ctx *iris.Context) {
+    params := map[string]interface{}{}
+    for key, value := range ctx.URLParams() {
+        params[key] = value
+    }
+    client, scopes, ok := checkAuthorizeRequest(ctx, params)
+    if !ok {
+        return
+    }
+
+    // Tell the frontend whether the user already agreed to this
+    user := middleware.CurrentUser(ctx)
+    consent := &objects.OAuthConsent{}
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", client.ID).First(consent)
+    output := iris.Map{
+        "client": oauthClientMap(*client),
+        "scopes": scopes,
+        "consented": consent.UserID == user.ID && consent.Covers(scopes),
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": output})
+}
+
+/*
+ Path: /api/oauth/authorize
+ Method: POST
+ Description: Grants or denies an authorization request. Returns the URL the user should be redirected to.
+              Required fields: client_id, redirect_uri, response_type, scope, code_challenge, approve. Optional fields: code_challenge_method, state
+ */
+func oauth_authorize(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to authorize OAuth applications.").Code(1045))
+        return
+    }
+    params := utils.GetFullJSON(ctx)
+    client, scopes, ok := checkAuthorizeRequest(ctx, params)
+    if !ok {
+        return
+    }
+    redirect, _ := url.Parse(cast.ToString(params["redirect_uri"]))
+    query := redirect.Query()
+    if state := cast.ToString(params["state"]); state != "" {
+        query.Set("state", state)
+    }
+
+    if !cast.ToBool(params["approve"]) {
+        query.Set("error", "access_denied")
+    } else {
+        // Remember the consent
+        user := middleware.CurrentUser(ctx)
+        consent := &objects.OAuthConsent{}
+        app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", client.ID).First(consent)
+        if consent.UserID != user.ID {
+            consent = objects.NewOAuthConsent(*user, *client, scopes)
+        } else if !consent.Covers(scopes) {
+            consent.Scopes = strings.Join(append(strings.Fields(consent.Scopes), scopes...), " ")
+        }
+        app.Database.Save(consent)
+
+        // Create the code
+        code, plain := objects.NewOAuthCode(*user, *client, redirect.String(), scopes, cast.ToString(params["code_challenge"]))
+        app.Database.Save(code)
+        query.Set("code", plain)
+    }
+    redirect.RawQuery = query.Encode()
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": iris.Map{"redirect": redirect.String()}})
+}
+
+/*
+ Path: /api/oauth/token
+ Method: POST
+ Description: The OAuth token endpoint. Supports the grant types authorization_code (with PKCE) and refresh_token.
+              Accepts form encoded or JSON bodies. Client credentials can be sent as fields or with HTTP Basic authentication.
+              Errors follow RFC 6749 instead of the usual error format, so existing OAuth libraries can understand them.
+ */
+func oauth_token(ctx *iris.Context) {
+    params := map[string]string{}
+    for _,key := range []string{"grant_type", "code", "redirect_uri", "code_verifier", "refresh_token", "scope", "client_id", "client_secret"} {
+        params[key] = ctx.FormValue(key)
+    }
+    if body := utils.GetFullJSON(ctx); body != nil {
+        for key := range params {
+            if params[key] == "" {
+                params[key] = cast.ToString(body[key])
+            }
+        }
+    }
+    if id, secret, ok := ctx.Request.BasicAuth(); ok {
+        params["client_id"] = id
+        params["client_secret"] = secret
+    }
+
+    // Authenticate the client
+    client := objects.FindOAuthClient(params["client_id"])
+    if client == nil || !client.CheckSecret(params["client_secret"]) {
+        oauthError(ctx, iris.StatusUnauthorized, "invalid_client", "The client authentication failed.")
+        return
+    }
+
+    var user objects.User
+    var scopes []string
+    if params["grant_type"] == "authorization_code" {
+        code := objects.RedeemOAuthCode(params["code"], *client)
+        if code == nil || code.RedirectURI != params["redirect_uri"] {
+            oauthError(ctx, iris.StatusBadRequest, "invalid_grant", "The authorization code is invalid or expired.")
+            return
+        }
+        if !checkCodeVerifier(code.Challenge, params["code_verifier"]) {
+            oauthError(ctx, iris.StatusBadRequest, "invalid_grant", "The code verifier doesn't match the code challenge.")
+            return
+        }
+        if user.GetById(code.UserID) != nil {
+            oauthError(ctx, iris.StatusBadRequest, "invalid_grant", "The user doesn't exist anymore.")
+            return
+        }
+        scopes = strings.Fields(code.Scopes)
+    } else if params["grant_type"] == "refresh_token" {
+        refresh := objects.RedeemOAuthRefreshToken(params["refresh_token"], *client)
+        if refresh == nil {
+            oauthError(ctx, iris.StatusBadRequest, "invalid_grant", "The refresh token is invalid or expired.")
+            return
+        }
+        if user.GetById(refresh.UserID) != nil {
+            oauthError(ctx, iris.StatusBadRequest, "invalid_grant", "The user doesn't exist anymore.")
+            return
+        }
+        scopes = strings.Fields(refresh.Scopes)
+
+        // The client can ask for less than it had before, but not for more
+        if requested := strings.Fields(params["scope"]); len(requested) > 0 {
+            for _,scope := range requested {
+                if e,_ := utils.ArrayContains(scope, scopes); !e {
+                    oauthError(ctx, iris.StatusBadRequest, "invalid_scope", "The scope " + scope + " wasn't granted.")
+                    return
+                }
+            }
+            scopes = requested
+        }
+    } else {
+        oauthError(ctx, iris.StatusBadRequest, "unsupported_grant_type", "Only authorization_code and refresh_token are supported.")
+        return
+    }
+
+    // Only grant what the user can still do
+    granted := []string{}
+    abilities := user.GetAbilities()
+    for _,scope := range scopes {
+        if e,_ := utils.ArrayContains(scope, abilities); e {
+            granted = append(granted, scope)
+        }
+    }
+    _, access, refresh := objects.IssueOAuthTokens(user, *client, granted)
+    ctx.SetHeader("Cache-Control", "no-store")
+    ctx.SetHeader("Pragma", "no-cache")
+    ctx.JSON(iris.StatusOK, iris.Map{
+        "access_token": access,
+        "token_type": "Bearer",
+        "expires_in": int(objects.OAuthAccessLifetime.Seconds()),
+        "refresh_token": refresh,
+        "scope": strings.Join(granted, " "),
+    })
+}
+
+/*
+ Path: /api/oauth/grants
+ Method: GET
+ Description: Lists the OAuth applications the current user has granted access to
+ */
+func list_oauth_grants(ctx *iris.Context) {
+    user := middleware.CurrentUser(ctx)
+    var consents []objects.OAuthConsent
+    app.Database.Where("user_id = ?", user.ID).Find(&consents)
+    output := make([]map[string]interface{}, len(consents))
+    for i,element := range consents {
+        output[i] = utils.ToMap(element)
+        output[i]["scopes"] = strings.Fields(element.Scopes)
+        output[i]["client"] = oauthClientMap(element.Client)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/oauth/grants
+ Method: DELETE
+ Description: Revokes the access of an OAuth application to the account of the current user. Required fields: clientid
+ */
+func revoke_oauth_grant(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage OAuth applications.").Code(1045))
+        return
+    }
+    clientid := cast.ToUint(utils.GetJSON(ctx, "clientid"))
+    user := middleware.CurrentUser(ctx)
+
+    // Get the consent
+    consent := &objects.OAuthConsent{}
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", clientid).First(consent)
+    if consent.UserID != user.ID || consent.ClientID != clientid {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The client ID is invalid").Code(2136))
+        return
+    }
+
+    // Remove everything the application got
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", clientid).Delete(objects.OAuthCode{})
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", clientid).Delete(objects.OAuthRefreshToken{})
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", clientid).Delete(objects.Token{})
+    app.Database.Delete(consent)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Validates the parameters of an authorization request. Writes the error response itself if they are invalid
+ */
+func checkAuthorizeRequest(ctx *iris.Context, params map[string]interface{}) (*objects.OAuthClient, []string, bool) {
+    client := objects.FindOAuthClient(cast.ToString(params["client_id"]))
+    if client == nil {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The client ID is invalid").Code(2136))
+        return nil, nil, false
+    }
+    if !client.HasRedirectURI(cast.ToString(params["redirect_uri"])) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The redirect URI isn't registered for this application.").Code(2138))
+        return nil, nil, false
+    }
+    if cast.ToString(params["response_type"]) != "code" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Only the response type code is supported.").Code(2141))
+        return nil, nil, false
+    }
+    method := cast.ToString(params["code_challenge_method"])
+    if cast.ToString(params["code_challenge"]) == "" || (method != "" && method != "S256") {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A code_challenge using the S256 method is required.").Code(2140))
+        return nil, nil, false
+    }
+
+    // Scopes are abilities, and users can only grant what they can do themselves
+    scopes := strings.Fields(cast.ToString(params["scope"]))
+    abilities := middleware.CurrentUser(ctx).GetAbilities()
+    if len(scopes) == 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("At least one scope is required.").Code(2139))
+        return nil, nil, false
+    }
+    for _,scope := range scopes {
+        if e,_ := utils.ArrayContains(scope, abilities); !e {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The scope " + scope + " is invalid.").Code(2139))
+            return nil, nil, false
+        }
+    }
+    return client, scopes, true
+}
+
+/*
+ Checks a PKCE code verifier against the stored S256 challenge
+ */
+func checkCodeVerifier(challenge string, verifier string) bool {
+    if len(verifier) < 43 || len(verifier) > 128 {
+        return false
+    }
+    sum := sha256.Sum256([]byte(verifier))
+    expected := base64.RawURLEncoding.EncodeToString(sum[:])
+    return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func oauthClientMap(client objects.OAuthClient) map[string]interface{} {
+    output := utils.ToMap(client)
+    output["redirect_uris"] = client.GetRedirectURIs()
+    output["confidential"] = client.IsConfidential()
+    return output
+}
+
+func oauthError(ctx *iris.Context, status int, code string, description string) {
+    ctx.SetHeader("Cache-Control", "no-store")
+    ctx.JSON(status, iris.Map{"error": code, "error_description": description})
+}
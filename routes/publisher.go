@@ -21,8 +21,8 @@ import (
  Registers the routes for the publisher section
  */
 func PublisherRegister() {
-    Register(GET, "/api/publishers", middleware.Recursion(0), middleware.Cache, publishers_list)
-    Register(GET, "/api/publishers/:pubid", middleware.Cache, publishers_info)
+    Register(GET, "/api/publishers", middleware.Relations(objects.Publisher{}), middleware.QueryBudget(1), middleware.Cache, publishers_list)
+    Register(GET, "/api/publishers/:pubid", middleware.Relations(objects.Publisher{}), middleware.QueryBudget(1), middleware.Cache, publishers_info)
     Register(PUT, "/api/publishers/:pubid",
         middleware.NeedsPermission("publisher-edit", true, "pubid"),
         edit_publisher,
@@ -44,10 +44,10 @@ func PublisherRegister() {
  */
 func publishers_list(ctx *iris.Context) {
     var publishers []objects.Publisher
-    app.Database.Find(&publishers)
+    middleware.DB(ctx).Find(&publishers)
     output := make([]map[string]interface{}, len(publishers))
     for i,element := range publishers {
-        output[i] = utils.ToMap(element)
+        output[i] = middleware.Expand(ctx, element, utils.ToMap(element))
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(publishers), "data": output})
 }
@@ -62,14 +62,14 @@ func publishers_info(ctx *iris.Context) {
 
     // Get the publisher
     pub := &objects.Publisher{}
-    app.Database.Where("id = ?", pubid).First(pub)
+    middleware.DB(ctx).Where("id = ?", pubid).First(pub)
     if pub.ID != pubid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The publisher ID is invalid").Code(2110))
         return
     }
 
     // Return the info
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(pub)})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": middleware.Expand(ctx, pub, utils.ToMap(pub))})
 }
 
 /*
@@ -90,6 +90,7 @@ func edit_publisher(ctx *iris.Context) {
     }
 
     // Edit the publisher
+    before := utils.ToMap(pub)
     code := utils.EditObject(pub, utils.GetFullJSON(ctx))
     if code == 3 {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The value you submitted is invalid").Code(2180))
@@ -102,6 +103,7 @@ func edit_publisher(ctx *iris.Context) {
         return
     }
     app.Database.Save(pub)
+    middleware.Audit(ctx, "publisher-edit", "publisher", pub.ID, utils.Diff(before, utils.ToMap(pub)))
     utils.ClearPublisherCache(pubid)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(pub)})
 }
@@ -126,6 +128,7 @@ func add_publisher(ctx *iris.Context) {
     // Add the publisher
     pub = objects.NewPublisher(name)
     app.Database.Save(pub)
+    middleware.Audit(ctx, "publisher-add", "publisher", pub.ID, nil)
     utils.ClearPublisherCache(0)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(pub)})
 }
@@ -149,6 +152,7 @@ func remove_publisher(ctx *iris.Context) {
 
     // Delete the publisher
     app.Database.Delete(pub)
+    middleware.Audit(ctx, "publisher-remove", "publisher", pub.ID, nil)
     utils.ClearPublisherCache(0)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
 }
\ No newline at end of file
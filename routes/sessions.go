@@ -0,0 +1,93 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package routes
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/middleware"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/spf13/cast"
+    "gopkg.in/kataras/iris.v6"
+    "time"
+)
+
+/*
+ Registers the routes for the session management
+ */
+func SessionsRegister() {
+    Register(GET, "/api/sessions",
+        middleware.NeedsPermission("logged-in", false),
+        list_sessions,
+    )
+    Register(DELETE, "/api/sessions",
+        middleware.NeedsPermission("logged-in", false),
+        revoke_session,
+    )
+}
+
+/*
+ Path: /api/sessions
+ Method: GET
+ Description: Lists the active login sessions of the current user
+ */
+func list_sessions(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage sessions.").Code(1045))
+        return
+    }
+    user := middleware.CurrentUser(ctx)
+    current := middleware.CurrentSession(ctx)
+    var sessions []objects.Session
+    app.Database.Where("user_id = ?", user.ID).Where("pending = ?", false).Where("expires_at > ?", time.Now()).Order("last_seen_at desc").Find(&sessions)
+    output := make([]map[string]interface{}, len(sessions))
+    for i,element := range sessions {
+        output[i] = utils.ToMap(element)
+        output[i]["current"] = current != nil && current.ID == element.ID
+        output[i]["impersonated"] = element.ImpersonatorID != 0
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
+/*
+ Path: /api/sessions
+ Method: DELETE
+ Description: Logs out a session of the current user. Required fields: sessionid, or all to log out every other session
+ */
+func revoke_session(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage sessions.").Code(1045))
+        return
+    }
+    sessionid := cast.ToUint(utils.GetJSON(ctx, "sessionid"))
+    all := cast.ToBool(utils.GetJSON(ctx, "all"))
+    user := middleware.CurrentUser(ctx)
+    current := middleware.CurrentSession(ctx)
+
+    // Everything but this one
+    if all {
+        objects.RevokeSessions(user.ID, current.ID)
+        utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+        return
+    }
+
+    // Get the session
+    session := &objects.Session{}
+    app.Database.Where("id = ?", sessionid).Where("user_id = ?", user.ID).First(session)
+    if session.ID != sessionid || sessionid == 0 {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The session ID is invalid").Code(2143))
+        return
+    }
+    if session.ID == current.ID {
+        middleware.LogoutUser(ctx)
+    } else {
+        app.Database.Delete(session)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
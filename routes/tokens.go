@@ -15,63 +15,154 @@ import (
     "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
+    "time"
 )
 
 /*
  Registers the routes for the token section
  */
 func TokensRegister() {
+    Register(GET, "/api/tokens",
+        middleware.NeedsPermission("logged-in", false),
+        list_tokens,
+    )
     Register(POST, "/api/tokens",
-        middleware.NeedsPermission("token-generate", true),
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
         generate_token,
     )
     Register(PUT, "/api/tokens",
-        middleware.NeedsPermission("token-edit", true, "tokenid"),
+        middleware.NeedsPermission("logged-in", false),
         edit_token,
     )
     Register(DELETE, "/api/tokens",
-        middleware.NeedsPermission("token-revoke", true, "tokenid"),
+        middleware.NeedsPermission("logged-in", false),
         revoke_token,
     )
 }
 
+/*
+ Path: /api/tokens
+ Method: GET
+ Description: Lists the API tokens of the current user. Tokens of OAuth applications are managed through /api/oauth/grants
+ */
+func list_tokens(ctx *iris.Context) {
+    user := middleware.CurrentUser(ctx)
+    var tokens []objects.Token
+    app.Database.Where("user_id = ?", user.ID).Where("client_id = ?", 0).Find(&tokens)
+    output := make([]map[string]interface{}, len(tokens))
+    for i,element := range tokens {
+        output[i] = utils.ToMap(element)
+    }
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(output), "data": output})
+}
+
 /*
  Path: /api/tokens
  Method: POST
- Description: Generates a new API token
- Abilities: token-generate
+ Description: Generates a new API token for the current user. Required fields: name, scopes. Optional fields: expires (days), ips
+ The scopes map abilities of the user to allowed parameters, e.g. {"mods-edit": {"modid": ["^12$"]}}
+ Setting ips (which bypass the request limit) requires the token-generate ability
  */
 func generate_token(ctx *iris.Context) {
-    token := objects.NewToken()
-    token.SetValue("ips", []string{})
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage API tokens.").Code(1045))
+        return
+    }
+    name := cast.ToString(utils.GetJSON(ctx, "name"))
+    expires := cast.ToInt(utils.GetJSON(ctx, "expires"))
+    ips := cast.ToStringSlice(utils.GetJSON(ctx, "ips"))
+    user := middleware.CurrentUser(ctx)
+
+    // Check the values
+    if name == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The token name is invalid.").Code(2117))
+        return
+    }
+    scopes, ok := parseScopes(utils.GetJSON(ctx, "scopes"), user)
+    if !ok {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The scopes are invalid. You can only grant abilities you have yourself.").Code(2133))
+        return
+    }
+    if expires < 0 {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The expiry is invalid.").Code(2134))
+        return
+    }
+    if len(ips) > 0 && middleware.UserHasPermission(ctx, "token-generate", true, []string{}) != 0 {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have the permission to bypass the request limit.").Code(1020))
+        return
+    }
+
+    // Create the token
+    token, plain := objects.NewToken(*user, name)
+    token.SetScopes(scopes)
+    token.SetValue("ips", ips)
+    if expires > 0 {
+        expiry := time.Now().Add(time.Hour * 24 * time.Duration(expires))
+        token.ExpiresAt = &expiry
+    }
     app.Database.Save(token)
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(token)})
+
+    // The plaintext is only shown this one time
+    output := utils.ToMap(token)
+    output["token"] = plain
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": output})
 }
 
 /*
  Path: /api/tokens
  Method: PUT
- Description: Edits the IP-Adresses of a token
- Abilities: token-edit
+ Description: Edits the name, scopes or IP-Adresses of a token. Required fields: tokenid. Optional fields: name, scopes, ips
+ Abilities: token-edit (for tokens of other users)
  */
 func edit_token(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage API tokens.").Code(1045))
+        return
+    }
     tokenid := cast.ToUint(utils.GetJSON(ctx, "tokenid"))
-    ips := cast.ToStringSlice(utils.GetJSON(ctx, "ips"))
+    data := utils.GetFullJSON(ctx)
 
     // Get the token
     token := &objects.Token{}
-    app.Database.Where("id = ?", tokenid).First(token)
+    app.Database.Where("id = ?", tokenid).Where("client_id = ?", 0).First(token)
     if token.ID != tokenid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The token ID is invalid").Code(2131))
         return
     }
-    if ips == nil {
-        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The list of IP Addresses is invalid.").Code(2132))
+    if token.UserID != middleware.CurrentUser(ctx).ID && middleware.UserHasPermission(ctx, "token-edit", true, []string{"tokenid"}) != 0 {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have access to this token.").Code(1020))
         return
     }
 
     // Edit the token
-    token.SetValue("ips", ips)
+    if name, ok := data["name"]; ok {
+        if cast.ToString(name) == "" {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The token name is invalid.").Code(2117))
+            return
+        }
+        token.Name = cast.ToString(name)
+    }
+    if value, ok := data["scopes"]; ok {
+        scopes, ok := parseScopes(value, &token.User)
+        if !ok {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The scopes are invalid. You can only grant abilities you have yourself.").Code(2133))
+            return
+        }
+        token.SetScopes(scopes)
+    }
+    if value, ok := data["ips"]; ok {
+        ips := cast.ToStringSlice(value)
+        if ips == nil {
+            utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The list of IP Addresses is invalid.").Code(2132))
+            return
+        }
+        if middleware.UserHasPermission(ctx, "token-generate", true, []string{}) != 0 {
+            utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have the permission to bypass the request limit.").Code(1020))
+            return
+        }
+        token.SetValue("ips", ips)
+    }
     app.Database.Save(token)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": utils.ToMap(token)})
 }
@@ -79,21 +170,55 @@ func edit_token(ctx *iris.Context) {
 /*
  Path: /api/tokens
  Method: DELETE
- Description: Removes a token completely
- Abilities: token-revoke
+ Description: Removes a token completely. Required fields: tokenid
+ Abilities: token-revoke (for tokens of other users)
  */
 func revoke_token(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage API tokens.").Code(1045))
+        return
+    }
     tokenid := cast.ToUint(utils.GetJSON(ctx, "tokenid"))
 
     // Get the token
     token := &objects.Token{}
-    app.Database.Where("id = ?", tokenid).First(token)
+    app.Database.Where("id = ?", tokenid).Where("client_id = ?", 0).First(token)
     if token.ID != tokenid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The token ID is invalid").Code(2131))
         return
     }
+    if token.UserID != middleware.CurrentUser(ctx).ID && middleware.UserHasPermission(ctx, "token-revoke", true, []string{"tokenid"}) != 0 {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("You don't have access to this token.").Code(1020))
+        return
+    }
 
     // Delete the token
     app.Database.Delete(token)
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
-}
\ No newline at end of file
+}
+
+/*
+ Converts the submitted scopes into the parameter format and checks that the owner has every ability
+ */
+func parseScopes(value interface{}, user *objects.User) (map[string]map[string][]string, bool) {
+    scopes := map[string]map[string][]string{}
+    abilities := user.GetAbilities()
+    for ability, params := range cast.ToStringMap(value) {
+        if e,_ := utils.ArrayContains(ability, abilities); !e {
+            return nil, false
+        }
+        scopes[ability] = map[string][]string{}
+        for param, values := range cast.ToStringMap(params) {
+            scopes[ability][param] = cast.ToStringSlice(values)
+            for _,element := range scopes[ability][param] {
+                if objects.ValidateRoleParam(param, element, objects.GuessMatch(element)) != nil {
+                    return nil, false
+                }
+            }
+        }
+    }
+    if len(scopes) == 0 {
+        return nil, false
+    }
+    return scopes, true
+}
@@ -0,0 +1,182 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package routes
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/middleware"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/utils"
+    "github.com/jameskeane/bcrypt"
+    "github.com/spf13/cast"
+    "gopkg.in/kataras/iris.v6"
+)
+
+/*
+ Registers the routes for two-factor authentication
+ */
+func TwoFactorRegister() {
+    Register(POST, "/api/2fa/setup",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        two_factor_setup,
+    )
+    Register(POST, "/api/2fa/enable",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        two_factor_enable,
+    )
+    Register(POST, "/api/2fa/disable",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        two_factor_disable,
+    )
+    Register(POST, "/api/2fa/recovery",
+        middleware.NoImpersonation,
+        middleware.NeedsPermission("logged-in", false),
+        two_factor_recovery,
+    )
+    Register(POST, "/api/users/:userid/2fa/reset",
+        middleware.NeedsPermission("user-2fa-reset", true, "userid"),
+        two_factor_reset,
+    )
+}
+
+/*
+ Path: /api/2fa/setup
+ Method: POST
+ Description: Generates a new TOTP secret for the current user. Returns the secret and the otpauth:// URI for the QR code.
+              Two-factor authentication isn't active until the first code was verified using /api/2fa/enable
+ */
+func two_factor_setup(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage two-factor authentication.").Code(1045))
+        return
+    }
+    user := middleware.CurrentUser(ctx)
+    if user.TotpEnabled {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Two-factor authentication is already enabled.").Code(3078))
+        return
+    }
+    secret, err := user.NewTotpSecret()
+    if err != nil {
+        utils.WriteJSON(ctx, iris.StatusInternalServerError, utils.Error(err.Error()).Code(2153))
+        return
+    }
+    app.Database.Save(user)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": iris.Map{"secret": secret, "uri": user.TotpURI()}})
+}
+
+/*
+ Path: /api/2fa/enable
+ Method: POST
+ Description: Enables two-factor authentication after verifying a code from the authenticator app. Required fields: code
+              Returns the recovery codes, which are only shown this one time
+ */
+func two_factor_enable(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage two-factor authentication.").Code(1045))
+        return
+    }
+    code := cast.ToString(utils.GetJSON(ctx, "code"))
+    user := middleware.CurrentUser(ctx)
+    if user.TotpEnabled {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Two-factor authentication is already enabled.").Code(3078))
+        return
+    }
+    if user.TotpSecret == "" {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Please request a secret using /api/2fa/setup first.").Code(3079))
+        return
+    }
+    if !user.CheckTotp(code) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+        return
+    }
+    user.TotpEnabled = true
+    codes := user.NewRecoveryCodes()
+    app.Database.Save(user)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(codes), "data": codes})
+}
+
+/*
+ Path: /api/2fa/disable
+ Method: POST
+ Description: Disables two-factor authentication for the current user. Required fields: password, code
+ */
+func two_factor_disable(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage two-factor authentication.").Code(1045))
+        return
+    }
+    password := cast.ToString(utils.GetJSON(ctx, "password"))
+    code := cast.ToString(utils.GetJSON(ctx, "code"))
+    user := middleware.CurrentUser(ctx)
+    if !user.TotpEnabled {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Two-factor authentication is not enabled.").Code(3079))
+        return
+    }
+    if s,_ := bcrypt.Hash(password, user.Password); password == "" || s != user.Password {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The password is incorrect").Code(2175))
+        return
+    }
+    if !user.CheckTwoFactor(code) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+        return
+    }
+    user.DisableTwoFactor()
+    app.Database.Save(user)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
+}
+
+/*
+ Path: /api/2fa/recovery
+ Method: POST
+ Description: Replaces the recovery codes of the current user. Required fields: code
+ */
+func two_factor_recovery(ctx *iris.Context) {
+    if middleware.CurrentToken(ctx) != nil {
+        utils.WriteJSON(ctx, iris.StatusForbidden, utils.Error("API tokens can't be used to manage two-factor authentication.").Code(1045))
+        return
+    }
+    code := cast.ToString(utils.GetJSON(ctx, "code"))
+    user := middleware.CurrentUser(ctx)
+    if !user.TotpEnabled {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Two-factor authentication is not enabled.").Code(3079))
+        return
+    }
+    if !user.CheckTotp(code) {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The two-factor authentication code is incorrect").Code(3076))
+        return
+    }
+    codes := user.NewRecoveryCodes()
+    app.Database.Save(user)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(codes), "data": codes})
+}
+
+/*
+ Path: /api/users/:userid/2fa/reset
+ Method: POST
+ Description: Disables two-factor authentication for a user who lost access to their authenticator and recovery codes
+ Abilities: user-2fa-reset
+ */
+func two_factor_reset(ctx *iris.Context) {
+    userid := cast.ToUint(ctx.GetString("userid"))
+    user := &objects.User{}
+    if user.GetById(userid) != nil {
+        utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The userid is invalid.").Code(2145))
+        return
+    }
+    user.DisableTwoFactor()
+    app.Database.Save(user)
+    middleware.Audit(ctx, "user-2fa-reset", "user", user.ID, nil)
+    utils.ClearUserCache(user.ID)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
+}
@@ -16,15 +16,16 @@ import (
     "github.com/spf13/cast"
     "gopkg.in/kataras/iris.v6"
     "regexp"
+    "time"
 )
 
 /*
  Registers the routes for the user management
  */
 func UserRegister() {
-    Register(GET, "/api/users", middleware.Recursion(0), middleware.Cache, list_users)
+    Register(GET, "/api/users", middleware.Relations(objects.User{}, "roles"), middleware.QueryBudget(1), middleware.Cache, list_users)
     Register(POST, "/api/users", register)
-    Register(GET, "/api/users/:userid", middleware.Cache, show_user)
+    Register(GET, "/api/users/:userid", middleware.Relations(objects.User{}, "roles"), middleware.QueryBudget(1), middleware.Cache, show_user)
     Register(PUT, "/api/users/:userid",
         middleware.NeedsPermission("user-edit", false, "userid"),
         edit_user,
@@ -42,17 +43,18 @@ func UserRegister() {
  */
 func list_users(ctx *iris.Context) {
     var users []objects.User
-    app.Database.Find(&users)
+    middleware.DB(ctx).Find(&users)
+    userid := uint(1)
+    if middleware.CurrentUser(ctx) != nil {
+        userid = middleware.CurrentUser(ctx).ID
+    }
+    full := middleware.UserHasPermission(ctx, "view-users-full", false, []string{}) == 0
     output := make([]map[string]interface{}, len(users))
     for i,element := range users {
-        userid := uint(1)
-        if middleware.CurrentUser(ctx) != nil {
-            userid = middleware.CurrentUser(ctx).ID
-        }
-        if element.ID == userid || middleware.UserHasPermission(ctx, "view-users-full", false, []string{}) == 0 {
-            output[i] = element.Format(true)
+        if element.ID == userid || full {
+            output[i] = middleware.Expand(ctx, element, element.Format(true))
         } else if element.Public {
-            output[i] = element.Format(false)
+            output[i] = middleware.Expand(ctx, element, element.Format(false))
         }
     }
     utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": len(users), "data": output})
@@ -61,7 +63,7 @@ func list_users(ctx *iris.Context) {
 /*
  Path: /api/users/
  Method: POST
- Description: Creates a new useraccount
+ Description: Creates a new useraccount. Requires the field invite if registration is invite-only
  */
 func register(ctx *iris.Context) {
     // Check if registration is allowed
@@ -78,9 +80,22 @@ func register(ctx *iris.Context) {
     confirmPassword := cast.ToString(utils.GetJSON(ctx,"repeatPassword"))
     data := cast.ToStringMap(utils.GetJSON(ctx,"userdata"))
     check := cast.ToString(utils.GetJSON(ctx,"check"))
+    inviteCode := cast.ToString(utils.GetJSON(ctx,"invite"))
 
     var errors []string
     var codes []int
+    if app.Settings.RegistrationMode == "invite" {
+        invite := &objects.Invite{}
+        app.Database.Where("code = ?", inviteCode).First(invite)
+        if inviteCode == "" || invite.Code != inviteCode || !invite.IsValid() {
+            errors = append(errors, "A valid invite code is required")
+            codes = append(codes, 3087)
+            if check == "invite" {
+                utils.WriteJSON(ctx, iris.StatusOK, utils.Error("A valid invite code is required").Code(3087))
+                return
+            }
+        }
+    }
     emailError := checkEmailForRegistration(email)
     if emailError != "" {
         errors = append(errors, emailError)
@@ -135,7 +150,7 @@ func register(ctx *iris.Context) {
         }
     }
 
-    if check == "email" || check == "password" || check == "username" {
+    if check == "email" || check == "password" || check == "username" || check == "invite" {
         utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false})
         return
     }
@@ -144,9 +159,23 @@ func register(ctx *iris.Context) {
         return
     }
 
+    // The invite is only used up once everything else is valid
+    var invite *objects.Invite
+    if app.Settings.RegistrationMode == "invite" {
+        invite = objects.RedeemInvite(inviteCode)
+        if invite == nil {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("A valid invite code is required").Code(3087))
+            return
+        }
+    }
+
     // Everything is valid, make them an account
     user := objects.NewUser(username, email, password)
     user.Confirmation,_ = utils.RandomHex(20)
+    user.AwaitingApproval = app.Settings.RegistrationApproval
+    if invite != nil {
+        user.InviteID = invite.ID
+    }
 
     // Edit user
     if data != nil {
@@ -200,6 +229,16 @@ func checkEmailForRegistration(email string) string {
     } else if app.Database.Where("email = ?", email).First(&user); user.Username != "" {
         return "A user with this email already exists."
     }
+    domain := utils.EmailDomain(email)
+    if len(app.Settings.EmailAllowlist) > 0 && !utils.DomainMatches(domain, app.Settings.EmailAllowlist) {
+        return "Email addresses from this domain can't be used here."
+    }
+    if utils.DomainMatches(domain, app.Settings.EmailDenylist) {
+        return "Email addresses from this domain can't be used here."
+    }
+    if app.Settings.BlockDisposableEmails && (utils.DomainMatches(domain, utils.DisposableDomains) || utils.DomainMatches(domain, app.Settings.DisposableDomains)) {
+        return "Please use a permanent email address."
+    }
     return ""
 }
 
@@ -221,7 +260,7 @@ func show_user(ctx *iris.Context) {
         userid = user.ID
     } else {
         userid = cast.ToUint(userid_)
-        app.Database.Where("id = ?", userid).First(user)
+        middleware.DB(ctx).Where("id = ?", userid).First(user)
     }
     if user.ID != userid {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The userid is invalid.").Code(2145))
@@ -236,13 +275,14 @@ func show_user(ctx *iris.Context) {
         utils.WriteJSON(ctx, iris.StatusNotFound, utils.Error("The userid is invalid.").Code(2145))
         return
     }
-    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": output})
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": middleware.Expand(ctx, user, output)})
 }
 
 /*
  Path: /api/users/:userid
  Method: PUT
  Description: Edits a user, based on the request parameters. Required fields: data
+              Changing the email address sends a confirmation link to the new address, the change happens after it was clicked
  Abilities: user-edit
  */
 func edit_user(ctx *iris.Context) {
@@ -254,8 +294,14 @@ func edit_user(ctx *iris.Context) {
         return
     }
 
+    // Email changes have to be confirmed, so they don't go through EditObject
+    data := utils.GetFullJSON(ctx)
+    email, changeEmail := data["email"]
+    delete(data, "email")
+
     // Everything is ok, edit the user
-    code := utils.EditObject(user, utils.GetFullJSON(ctx))
+    before := user.Format(true)
+    code := utils.EditObject(user, data)
     if code == 3 {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("The value you submitted is invalid").Code(2180))
         return
@@ -265,11 +311,37 @@ func edit_user(ctx *iris.Context) {
     } else if code == 1 {
         utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("You tried to edit a value that is marked as read-only.").Code(3095))
         return
-    } else {
-        utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
-        utils.ClearUserCache(userid)
+    }
+    if user.UpdateNotifications == "" {
+        user.UpdateNotifications = objects.NotifyImmediate
+    }
+    if e,_ := utils.ArrayContains(user.UpdateNotifications, objects.NotifyModes); !e {
+        utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error("Update notifications must be one of immediate, daily or weekly.").Code(2181))
         return
     }
+    if changeEmail && cast.ToString(email) != user.Email {
+        if middleware.RejectImpersonation(ctx) {
+            return
+        }
+        if emailError := checkEmailForRegistration(cast.ToString(email)); emailError != "" {
+            utils.WriteJSON(ctx, iris.StatusBadRequest, utils.Error(emailError).Code(4000))
+            return
+        }
+        user.PendingEmail = cast.ToString(email)
+        user.EmailConfirmation,_ = utils.RandomHex(20)
+        user.EmailCancel,_ = utils.RandomHex(20)
+        user.EmailChangeExpiry = time.Now().Add(time.Hour * 24)
+        user.EmailCancelExpiry = time.Now().Add(time.Hour * 24 * 7)
+        user.PreviousEmail = ""
+        utils.SendEmailChange(user.Username, user.PendingEmail, user.EmailConfirmation)
+        utils.SendEmailChangeNotice(user.Username, user.Email, user.PendingEmail, user.EmailCancel)
+    }
+    app.Database.Save(user)
+    if !middleware.IsCurrentUser(ctx, user) {
+        middleware.Audit(ctx, "user-edit", "user", user.ID, utils.Diff(before, user.Format(true)))
+    }
+    utils.ClearUserCache(userid)
+    utils.WriteJSON(ctx, iris.StatusOK, iris.Map{"error": false, "count": 1, "data": user.Format(true)})
 }
 
 /*
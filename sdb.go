@@ -13,8 +13,10 @@ import (
     "flag"
     "fmt"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
     _ "github.com/KSP-SpaceDock/SpaceDock-Backend/routes"
     "github.com/KSP-SpaceDock/SpaceDock-Backend/tools"
+    "time"
 )
 
 /*
@@ -27,16 +29,59 @@ func main() {
     helpCommand := flag.NewFlagSet("help", flag.ExitOnError)
     setupCommand := flag.NewFlagSet("setup", flag.ExitOnError)
     migrateCommand := flag.NewFlagSet("migrate", flag.ExitOnError)
+    dbCommand := flag.NewFlagSet("db", flag.ExitOnError)
+    backupCommand := flag.NewFlagSet("backup", flag.ExitOnError)
+    restoreCommand := flag.NewFlagSet("restore", flag.ExitOnError)
+    exportCommand := flag.NewFlagSet("export", flag.ExitOnError)
+    importCommand := flag.NewFlagSet("import", flag.ExitOnError)
+    mirrorCommand := flag.NewFlagSet("mirror", flag.ExitOnError)
 
     // Setup subcommand flags
     dummyData := setupCommand.Bool("dummy", true, "Populates the database with dummy data")
 
+    // Migrate subcommand flags
+    migrateOptions := tools.MigrateOptions{}
+    migrateConfig := migrateCommand.String("config", "", "A file in config/ that contains the settings of the import")
+    migrateCommand.StringVar(&migrateOptions.OldDriver, "old-driver", "", "The dialect of the old database (postgres or mysql)")
+    migrateCommand.StringVar(&migrateOptions.OldConnection, "old-connection", "", "The connection string of the old database")
+    migrateCommand.StringVar(&migrateOptions.NewDriver, "new-driver", "", "The dialect of the new database, defaults to the one from config.yml")
+    migrateCommand.StringVar(&migrateOptions.NewConnection, "new-connection", "", "The connection string of the new database, defaults to the one from config.yml")
+    migrateCommand.StringVar(&migrateOptions.OldStorage, "old-storage", "", "The storage directory of the old instance, its mod files are copied into the new one")
+    migrateCommand.StringVar(&migrateOptions.AdminRole, "admin-role", "", "The role that admins of the old database get (default admin)")
+    migrateCommand.IntVar(&migrateOptions.BatchSize, "batch-size", 0, "How many rows are copied at once (default 500)")
+    migrateCommand.BoolVar(&migrateOptions.DryRun, "dry-run", false, "Reports what would be imported without writing anything")
+
+    // Db subcommand flags
+    rollbackSteps := dbCommand.Int("steps", 1, "How many migrations are rolled back")
+    dbAction := ""
+
+    // Backup and restore subcommand flags
+    backupBase := backupCommand.String("incremental", "", "An earlier backup, files that didn't change since then are not added again")
+    restoreVerify := restoreCommand.Bool("verify", false, "Only checks the backup, without restoring it")
+
+    // Export and import subcommand flags
+    exportGame := exportCommand.String("game", "", "The short name of the game whose mods are exported")
+    importGame := importCommand.String("game", "", "The short name of the game the mods are imported into")
+    importOptions := objects.ImportOptions{}
+    importCommand.BoolVar(&importOptions.DryRun, "dry-run", false, "Reports what would be imported without writing anything")
+    importCommand.StringVar(&importOptions.FallbackUser, "fallback-user", "", "The user that owns mods whose author doesn't exist on this instance")
+    importCommand.BoolVar(&importOptions.CreateVersions, "create-versions", false, "Creates game versions that don't exist on this instance")
+
+    // Mirror subcommand flags
+    mirrorID := mirrorCommand.Uint("id", 0, "The mirror that is synced, all enabled ones if it is missing")
+
     flag.Usage = func() {
         fmt.Printf("usage: sdb [command] [options]\n\n")
         fmt.Printf("SpaceDock backend application for handling database operations and http routes.\n\n")
         fmt.Printf("Use \"sdb help <command>\" for more information about a command.\n\n")
         fmt.Printf("    Commands:\n\n")
+        fmt.Printf("        backup      writes the database and the mod files into a single archive\n")
+        fmt.Printf("        db          applies, rolls back or lists the schema migrations of the database\n")
+        fmt.Printf("        export      writes the mods of a game into an archive that another instance can import\n")
+        fmt.Printf("        import      imports the mods of a game from an exported archive\n")
         fmt.Printf("        migrate     converts a pre-split SpaceDock database to the new backend database format\n")
+        fmt.Printf("        mirror      pulls new mods and versions from the instances this one mirrors\n")
+        fmt.Printf("        restore     restores a backup into an empty database\n")
         fmt.Printf("        setup       populates the database with dummy data and an administrator account\n\n")
         fmt.Printf("If no subcommand is specified, the backend application will run.\n")
     }
@@ -47,6 +92,23 @@ func main() {
             setupCommand.Parse(args[1:])
         case "migrate":
             migrateCommand.Parse(args[1:])
+        case "db":
+            if len(args) < 2 {
+                fmt.Printf("usage: sdb db migrate|rollback|status\n")
+                os.Exit(1)
+            }
+            dbAction = args[1]
+            dbCommand.Parse(args[2:])
+        case "backup":
+            backupCommand.Parse(args[1:])
+        case "restore":
+            restoreCommand.Parse(args[1:])
+        case "export":
+            exportCommand.Parse(args[1:])
+        case "import":
+            importCommand.Parse(args[1:])
+        case "mirror":
+            mirrorCommand.Parse(args[1:])
         case "help":
             helpCommand.Parse(args[1:])
         default:
@@ -64,7 +126,13 @@ func main() {
             defaultUsage := func() {
                 fmt.Printf("usage: sdb help <command>\n\n")
                 fmt.Printf("    Commands:\n\n")
+                fmt.Printf("        backup      writes the database and the mod files into a single archive\n")
+                fmt.Printf("        db          applies, rolls back or lists the schema migrations of the database\n")
+                fmt.Printf("        export      writes the mods of a game into an archive that another instance can import\n")
+                fmt.Printf("        import      imports the mods of a game from an exported archive\n")
                 fmt.Printf("        migrate     converts a pre-split SpaceDock database to the new backend database format\n")
+                fmt.Printf("        mirror      pulls new mods and versions from the instances this one mirrors\n")
+                fmt.Printf("        restore     restores a backup into an empty database\n")
                 fmt.Printf("        setup       populates the database with dummy data and an administrator account\n\n")
             }
 
@@ -72,9 +140,43 @@ func main() {
             // If we didn't, print the default help text.
             if len(helpArgs)  == 1 {
                 switch helpArgs[0] {
+                case "backup":
+                    fmt.Printf("usage: sdb backup [-incremental=<earlier backup>] [<file>]\n\n")
+                    fmt.Printf("The backup subcommand writes all objects of the database and the files of the mod versions\n")
+                    fmt.Printf("into a single archive. The database is always dumped completely. With the incremental flag,\n")
+                    fmt.Printf("files that didn't change since the earlier backup are only listed, so restoring needs\n")
+                    fmt.Printf("the earlier backup in the same directory.\n")
+                case "restore":
+                    fmt.Printf("usage: sdb restore [-verify] <file>\n\n")
+                    fmt.Printf("The restore subcommand checks a backup against its checksums and restores it into an\n")
+                    fmt.Printf("empty database. With the verify flag, the backup is only checked.\n")
+                case "export":
+                    fmt.Printf("usage: sdb export -game=<short> [<file>]\n\n")
+                    fmt.Printf("The export subcommand writes the mods of a game, with their versions, authors and files,\n")
+                    fmt.Printf("into an archive that the import subcommand of another instance can read.\n")
+                case "import":
+                    fmt.Printf("usage: sdb import -game=<short> [-dry-run] [-fallback-user=<name>] [-create-versions] <file>\n\n")
+                    fmt.Printf("The import subcommand adds the mods of an exported archive to a game. Authors are matched\n")
+                    fmt.Printf("by their username, mods of unknown authors belong to the fallback user. Mods whose name\n")
+                    fmt.Printf("is already taken are skipped, and so are versions for missing game versions, unless\n")
+                    fmt.Printf("create-versions is set. With -dry-run, the import only reports what it would do.\n")
+                case "mirror":
+                    fmt.Printf("usage: sdb mirror [-id=<mirror>]\n\n")
+                    fmt.Printf("The mirror subcommand syncs the mirrors right away, instead of waiting for the next\n")
+                    fmt.Printf("periodic sync. Mirrors are added by admins through /api/admin/mirrors.\n")
+                case "db":
+                    fmt.Printf("usage: sdb db migrate|rollback|status [-steps=1]\n\n")
+                    fmt.Printf("The db subcommand manages the versioned schema migrations of the database.\n\n")
+                    fmt.Printf("    migrate     applies all pending migrations\n")
+                    fmt.Printf("    rollback    rolls back the newest migration, or as many as the steps flag says\n")
+                    fmt.Printf("    status      lists all migrations and when they were applied\n")
                 case "migrate":
-                    fmt.Printf("usage: sdb migrate\n\n")
+                    fmt.Printf("usage: sdb migrate [-config=migrate.yml] [-old-connection=...] [-old-storage=...] [-dry-run]\n\n")
                     fmt.Printf("The migrate subcommand will convert an old database to the new backend format.\n")
+                    fmt.Printf("The settings can be stored in a file in config/ (see config/migrate.example.yml), flags override them.\n\n")
+                    fmt.Printf("Rows are copied in batches and the progress is stored in the new database, so an interrupted\n")
+                    fmt.Printf("import continues where it stopped. Rows that point to missing rows are skipped and reported.\n")
+                    fmt.Printf("With -dry-run, the import only reports what it would do.\n")
                 case "setup":
                     fmt.Printf("usage: sdb setup [-dummy=true|false]\n\n")
                     fmt.Printf("The setup subcommand will add an administrator account, a normal user,\n")
@@ -97,7 +199,57 @@ func main() {
     }
 
     if migrateCommand.Parsed() {
-        tools.MigrateDB()
+        tools.MigrateDB(migrateOptions, *migrateConfig)
+    }
+
+    if backupCommand.Parsed() {
+        output := "spacedock-" + time.Now().Format("20060102-150405") + ".tar.gz"
+        if backupCommand.NArg() > 0 {
+            output = backupCommand.Arg(0)
+        }
+        tools.Backup(output, *backupBase)
+    }
+
+    if restoreCommand.Parsed() {
+        if restoreCommand.NArg() != 1 {
+            fmt.Printf("usage: sdb restore [-verify] <file>\n")
+            os.Exit(1)
+        }
+        tools.Restore(restoreCommand.Arg(0), *restoreVerify)
+    }
+
+    if exportCommand.Parsed() {
+        output := *exportGame + "-export.tar.gz"
+        if exportCommand.NArg() > 0 {
+            output = exportCommand.Arg(0)
+        }
+        tools.ExportGame(*exportGame, output)
+    }
+
+    if importCommand.Parsed() {
+        if importCommand.NArg() != 1 {
+            fmt.Printf("usage: sdb import -game=<short> [-dry-run] [-fallback-user=<name>] [-create-versions] <file>\n")
+            os.Exit(1)
+        }
+        tools.ImportGame(*importGame, importCommand.Arg(0), importOptions)
+    }
+
+    if mirrorCommand.Parsed() {
+        tools.SyncMirrors(*mirrorID)
+    }
+
+    if dbCommand.Parsed() {
+        switch dbAction {
+        case "migrate":
+            tools.DatabaseMigrate()
+        case "rollback":
+            tools.DatabaseRollback(*rollbackSteps)
+        case "status":
+            tools.DatabaseStatus()
+        default:
+            fmt.Printf("usage: sdb db migrate|rollback|status\n")
+            os.Exit(1)
+        }
     }
 }
 
@@ -0,0 +1,654 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package tools
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "archive/tar"
+    "bufio"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/jinzhu/gorm"
+    "github.com/spf13/cast"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+)
+
+/*
+ The version of the archive format. Restore refuses archives with a newer one
+ */
+const backupFormat = 1
+
+/*
+ Describes the contents of a backup archive. It is the last entry of the archive, so it can contain the checksums of all others
+ */
+type BackupManifest struct {
+    Format     int `json:"format"`
+    Created    time.Time `json:"created"`
+    Dialect    string `json:"dialect"`
+    Migrations []int `json:"migrations"`
+    Base       string `json:"base,omitempty"`
+    Tables     []BackupTable `json:"tables"`
+    Files      []BackupFile `json:"files"`
+}
+
+/*
+ A dumped table. Every line of its entry is one row as a JSON object, with the column names as keys
+ */
+type BackupTable struct {
+    Name     string `json:"name"`
+    Rows     int `json:"rows"`
+    Checksum string `json:"checksum"`
+}
+
+/*
+ A file from the storage. Archive is the name of the backup that contains it, if it was unchanged since an earlier one
+ */
+type BackupFile struct {
+    Path     string `json:"path"`
+    Size     int64 `json:"size"`
+    ModTime  time.Time `json:"modtime"`
+    Checksum string `json:"checksum"`
+    Archive  string `json:"archive,omitempty"`
+}
+
+/*
+ Writes all objects and the files they reference into a single archive. With a base archive, only files that changed since then are added
+ */
+func Backup(output string, base string) {
+    log.SetOutput(os.Stdout)
+    if err := writeBackup(output, base); err != nil {
+        os.Remove(output)
+        log.Fatalf("* Backup failed: %s", err)
+    }
+    log.Printf("* Wrote the backup to %s", output)
+}
+
+func writeBackup(output string, base string) error {
+    manifest := &BackupManifest{Format: backupFormat, Created: time.Now(), Dialect: app.Database.Dialect().GetName()}
+    applied, err := app.MigrationStatus()
+    if err != nil {
+        return err
+    }
+    for _,element := range applied {
+        if element.Applied {
+            manifest.Migrations = append(manifest.Migrations, element.Version)
+        }
+    }
+
+    // Files that are part of the base backup
+    previous := map[string]BackupFile{}
+    if base != "" {
+        baseManifest, err := readManifest(base)
+        if err != nil {
+            return err
+        }
+        manifest.Base = filepath.Base(base)
+        for _,element := range baseManifest.Files {
+            if element.Archive == "" {
+                element.Archive = filepath.Base(base)
+            }
+            previous[element.Path] = element
+        }
+    }
+
+    // The archive contains password hashes and tokens, so only the owner may read it
+    file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    if err := file.Chmod(0600); err != nil {
+        return err
+    }
+    compressed := gzip.NewWriter(file)
+    archive := tar.NewWriter(compressed)
+
+    // The database, a table at a time, but all from the same snapshot
+    tx, err := beginSnapshot()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    db := tx.Unscoped()
+    for _,table := range backupTables(db) {
+        log.Printf("* Dumping %s", table.name)
+        entry, err := dumpTable(db, table, archive)
+        if err != nil {
+            return fmt.Errorf("%s: %s", table.name, err)
+        }
+        manifest.Tables = append(manifest.Tables, entry)
+    }
+
+    // The files of the mod versions
+    paths := []string{}
+    if err := db.Model(&objects.ModVersion{}).Where("download_path <> ''").Pluck("DISTINCT download_path", &paths).Error; err != nil {
+        return err
+    }
+    sort.Strings(paths)
+    added := 0
+    for _,element := range paths {
+        clean, ok := storagePath(element)
+        if !ok {
+            log.Printf("* Skipped the file %s, it is outside of the storage", element)
+            continue
+        }
+        info, err := os.Stat(filepath.Join(app.Settings.Storage, filepath.FromSlash(clean)))
+        if err != nil {
+            log.Printf("* Skipped the missing file %s", clean)
+            continue
+        }
+        if old, ok := previous[clean]; ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+            manifest.Files = append(manifest.Files, old)
+            continue
+        }
+        entry, err := addFile(archive, clean, info)
+        if err != nil {
+            return err
+        }
+        manifest.Files = append(manifest.Files, entry)
+        added += 1
+    }
+    log.Printf("* Added %d of %d files", added, len(manifest.Files))
+
+    // The manifest comes last
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := archive.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}); err != nil {
+        return err
+    }
+    if _, err := archive.Write(data); err != nil {
+        return err
+    }
+    if err := archive.Close(); err != nil {
+        return err
+    }
+    return compressed.Close()
+}
+
+/*
+ Starts a read transaction that sees the database as it was when it started, so rows that are written
+ while the backup runs can't reference rows of tables that were already dumped.
+ Sqlite transactions are serializable and InnoDB uses repeatable read by default. Snapshots on mssql need ALLOW_SNAPSHOT_ISOLATION
+ */
+func beginSnapshot() (*gorm.DB, error) {
+    tx := app.Database.Begin()
+    if tx.Error != nil {
+        return nil, tx.Error
+    }
+    statement := ""
+    switch app.Database.Dialect().GetName() {
+    case "postgres":
+        statement = "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"
+    case "mssql":
+        statement = "SET TRANSACTION ISOLATION LEVEL SNAPSHOT"
+    }
+    if statement != "" {
+        if err := tx.Exec(statement).Error; err != nil {
+            tx.Rollback()
+            return nil, err
+        }
+    }
+    return tx, nil
+}
+
+/*
+ A table that is part of a backup. Tables of datatypes are read into their struct, so every value keeps its type between dialects.
+ Join tables only contain ids
+ */
+type backupTable struct {
+    name  string
+    model interface{}
+}
+
+func backupTables(db *gorm.DB) []backupTable {
+    tables := []backupTable{}
+    joins := map[string]bool{}
+    for _,model := range objects.Models() {
+        scope := db.NewScope(model)
+        tables = append(tables, backupTable{name: scope.TableName(), model: model})
+        for _,field := range scope.GetModelStruct().StructFields {
+            relation := field.Relationship
+            if relation != nil && relation.Kind == "many_to_many" && relation.JoinTableHandler != nil {
+                joins[relation.JoinTableHandler.Table(db)] = true
+            }
+        }
+    }
+    names := []string{}
+    for name := range joins {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _,name := range names {
+        tables = append(tables, backupTable{name: name})
+    }
+    return tables
+}
+
+/*
+ Writes the rows of a table into the archive. The tar header needs the size first, so they go through a temporary file
+ */
+func dumpTable(db *gorm.DB, table backupTable, archive *tar.Writer) (BackupTable, error) {
+    entry := BackupTable{Name: table.name}
+    temp, err := ioutil.TempFile("", "sdb-backup")
+    if err != nil {
+        return entry, err
+    }
+    defer os.Remove(temp.Name())
+    defer temp.Close()
+    hash := sha256.New()
+    buffered := bufio.NewWriter(io.MultiWriter(temp, hash))
+    encoder := json.NewEncoder(buffered)
+
+    if table.model != nil {
+        rows, err := db.Model(table.model).Rows()
+        if err != nil {
+            return entry, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            value := reflect.New(reflect.TypeOf(table.model).Elem()).Interface()
+            if err := db.ScanRows(rows, value); err != nil {
+                return entry, err
+            }
+            row := map[string]interface{}{}
+            for _,field := range db.NewScope(value).Fields() {
+                if field.IsNormal && !field.IsIgnored {
+                    row[field.DBName] = field.Field.Interface()
+                }
+            }
+            if err := encoder.Encode(row); err != nil {
+                return entry, err
+            }
+            entry.Rows += 1
+        }
+    } else {
+        rows, err := db.Table(table.name).Rows()
+        if err != nil {
+            return entry, err
+        }
+        data, err := SQLToMap(rows)
+        rows.Close()
+        if err != nil {
+            return entry, err
+        }
+        for _,element := range data {
+            row := map[string]int64{}
+            for column, value := range element {
+                row[column] = cast.ToInt64(value)
+            }
+            if err := encoder.Encode(row); err != nil {
+                return entry, err
+            }
+            entry.Rows += 1
+        }
+    }
+    if err := buffered.Flush(); err != nil {
+        return entry, err
+    }
+    entry.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+    // Copy it into the archive
+    info, err := temp.Stat()
+    if err != nil {
+        return entry, err
+    }
+    if _, err := temp.Seek(0, 0); err != nil {
+        return entry, err
+    }
+    if err := archive.WriteHeader(&tar.Header{Name: "tables/" + table.name + ".json", Mode: 0644, Size: info.Size(), ModTime: time.Now()}); err != nil {
+        return entry, err
+    }
+    _, err = io.Copy(archive, temp)
+    return entry, err
+}
+
+func addFile(archive *tar.Writer, name string, info os.FileInfo) (BackupFile, error) {
+    entry := BackupFile{Path: name, Size: info.Size(), ModTime: info.ModTime()}
+    file, err := os.Open(filepath.Join(app.Settings.Storage, filepath.FromSlash(name)))
+    if err != nil {
+        return entry, err
+    }
+    defer file.Close()
+    if err := archive.WriteHeader(&tar.Header{Name: "files/" + name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+        return entry, err
+    }
+    hash := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(archive, hash), file); err != nil {
+        return entry, err
+    }
+    entry.Checksum = hex.EncodeToString(hash.Sum(nil))
+    return entry, nil
+}
+
+/*
+ Cleans a path from the database. Paths that would leave the storage directory are rejected
+ */
+func storagePath(name string) (string, bool) {
+    clean := path.Clean("/" + strings.Replace(name, "\\", "/", -1))[1:]
+    return clean, clean != "" && !strings.HasPrefix(clean, "../")
+}
+
+/*
+ Calls the callback for every entry of an archive
+ */
+func readArchive(name string, callback func(header *tar.Header, content io.Reader) error) error {
+    file, err := os.Open(name)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    compressed, err := gzip.NewReader(file)
+    if err != nil {
+        return err
+    }
+    defer compressed.Close()
+    archive := tar.NewReader(compressed)
+    for {
+        header, err := archive.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err := callback(header, archive); err != nil {
+            return err
+        }
+    }
+}
+
+func readManifest(name string) (*BackupManifest, error) {
+    var manifest *BackupManifest
+    err := readArchive(name, func(header *tar.Header, content io.Reader) error {
+        if header.Name != "manifest.json" {
+            return nil
+        }
+        manifest = &BackupManifest{}
+        return json.NewDecoder(content).Decode(manifest)
+    })
+    if err == nil && manifest == nil {
+        err = errors.New(name + " contains no manifest")
+    }
+    return manifest, err
+}
+
+/*
+ Checks the archive against its manifest, and the files it takes from earlier archives against theirs.
+ Earlier archives have to be in the same directory
+ */
+func verifyBackup(name string) (*BackupManifest, error) {
+    checksums := map[string]string{}
+    err := readArchive(name, func(header *tar.Header, content io.Reader) error {
+        hash := sha256.New()
+        if _, err := io.Copy(hash, content); err != nil {
+            return err
+        }
+        checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    manifest, err := readManifest(name)
+    if err != nil {
+        return nil, err
+    }
+    if manifest.Format > backupFormat {
+        return nil, fmt.Errorf("The backup uses format %d, this version only supports %d", manifest.Format, backupFormat)
+    }
+    for _,element := range manifest.Tables {
+        if checksums["tables/" + element.Name + ".json"] != element.Checksum {
+            return nil, errors.New("The table " + element.Name + " is damaged or missing")
+        }
+    }
+
+    // Files from earlier archives are checked against those
+    others := map[string][]BackupFile{}
+    for _,element := range manifest.Files {
+        if element.Archive != "" {
+            others[element.Archive] = append(others[element.Archive], element)
+            continue
+        }
+        if checksums["files/" + element.Path] != element.Checksum {
+            return nil, errors.New("The file " + element.Path + " is damaged or missing")
+        }
+    }
+    for archive, files := range others {
+        found := map[string]string{}
+        err := readArchive(filepath.Join(filepath.Dir(name), archive), func(header *tar.Header, content io.Reader) error {
+            if !strings.HasPrefix(header.Name, "files/") {
+                return nil
+            }
+            hash := sha256.New()
+            if _, err := io.Copy(hash, content); err != nil {
+                return err
+            }
+            found[strings.TrimPrefix(header.Name, "files/")] = hex.EncodeToString(hash.Sum(nil))
+            return nil
+        })
+        if err != nil {
+            return nil, fmt.Errorf("The earlier backup %s can't be read: %s", archive, err)
+        }
+        for _,element := range files {
+            if found[element.Path] != element.Checksum {
+                return nil, errors.New("The file " + element.Path + " is damaged or missing in " + archive)
+            }
+        }
+    }
+    return manifest, nil
+}
+
+/*
+ Restores a backup into an empty database. The archive is verified before anything is written, and nothing is kept if restoring fails
+ */
+func Restore(name string, verifyOnly bool) {
+    log.SetOutput(os.Stdout)
+    log.Printf("* Verifying %s", name)
+    manifest, err := verifyBackup(name)
+    if err != nil {
+        log.Fatalf("* The backup is invalid: %s", err)
+    }
+    log.Printf("* The backup from %s is valid", manifest.Created.Format("2006-01-02 15:04:05"))
+    if verifyOnly {
+        return
+    }
+    if err := restoreBackup(name, manifest); err != nil {
+        log.Fatalf("* Restore failed: %s", err)
+    }
+    log.Print("* Restore completed")
+}
+
+func restoreBackup(name string, manifest *BackupManifest) error {
+    // The schema has to be at least as new as the one of the backup
+    states, err := app.MigrationStatus()
+    if err != nil {
+        return err
+    }
+    known := map[int]bool{}
+    for _,element := range states {
+        known[element.Version] = element.Known
+    }
+    for _,version := range manifest.Migrations {
+        if !known[version] {
+            return fmt.Errorf("The backup was made with migration %d, which this version doesn't have", version)
+        }
+    }
+    if err := app.Migrate(); err != nil {
+        return err
+    }
+    count := 0
+    app.Database.Model(&objects.User{}).Unscoped().Count(&count)
+    if count > 0 {
+        return errors.New("The database already contains users, backups can only be restored into an empty one")
+    }
+
+    tables := map[string]backupTable{}
+    for _,element := range backupTables(app.Database) {
+        tables[element.name] = element
+    }
+    files := map[string]map[string]bool{}
+    for _,element := range manifest.Files {
+        archive := element.Archive
+        if archive == "" {
+            archive = filepath.Base(name)
+        }
+        if files[archive] == nil {
+            files[archive] = map[string]bool{}
+        }
+        files[archive][element.Path] = true
+    }
+
+    err = app.Transaction(func(work *app.UnitOfWork) error {
+        err := readArchive(name, func(header *tar.Header, content io.Reader) error {
+            if strings.HasPrefix(header.Name, "tables/") {
+                table, ok := tables[strings.TrimSuffix(strings.TrimPrefix(header.Name, "tables/"), ".json")]
+                if !ok {
+                    log.Printf("* Skipped %s, the table doesn't exist anymore", header.Name)
+                    return nil
+                }
+                log.Printf("* Restoring %s", table.name)
+                return restoreTable(work.DB, table, content)
+            }
+            return restoreFile(work, files[filepath.Base(name)], header, content)
+        })
+        if err != nil {
+            return err
+        }
+        for archive, wanted := range files {
+            if archive == filepath.Base(name) {
+                continue
+            }
+            log.Printf("* Restoring files from %s", archive)
+            err := readArchive(filepath.Join(filepath.Dir(name), archive), func(header *tar.Header, content io.Reader) error {
+                return restoreFile(work, wanted, header, content)
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // Postgres doesn't move the sequence of a table when rows are inserted with their id
+    if app.Database.Dialect().GetName() == "postgres" {
+        for _,element := range tables {
+            if element.model == nil {
+                continue
+            }
+            if err := app.Database.Exec("SELECT setval(pg_get_serial_sequence('" + element.name + "', 'id'), (SELECT MAX(id) FROM " + element.name + "))").Error; err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func restoreTable(db *gorm.DB, table backupTable, content io.Reader) error {
+    identity := table.model != nil && db.Dialect().GetName() == "mssql"
+    if identity {
+        if err := db.Exec("SET IDENTITY_INSERT " + table.name + " ON").Error; err != nil {
+            return err
+        }
+    }
+    decoder := json.NewDecoder(content)
+    for decoder.More() {
+        row := map[string]json.RawMessage{}
+        if err := decoder.Decode(&row); err != nil {
+            return err
+        }
+        if table.model == nil {
+            columns := []string{}
+            for column := range row {
+                columns = append(columns, column)
+            }
+            sort.Strings(columns)
+            values := make([]interface{}, len(columns))
+            for i, column := range columns {
+                var value int64
+                if err := json.Unmarshal(row[column], &value); err != nil {
+                    return err
+                }
+                values[i] = value
+            }
+            statement := "INSERT INTO " + table.name + " (" + strings.Join(columns, ", ") + ") VALUES (?" + strings.Repeat(",?", len(columns) - 1) + ")"
+            if err := db.Exec(statement, values...).Error; err != nil {
+                return err
+            }
+            continue
+        }
+        value := reflect.New(reflect.TypeOf(table.model).Elem()).Interface()
+        for _,field := range db.NewScope(value).Fields() {
+            if raw, ok := row[field.DBName]; ok && field.IsNormal && !field.IsIgnored {
+                if err := json.Unmarshal(raw, field.Field.Addr().Interface()); err != nil {
+                    return fmt.Errorf("%s.%s: %s", table.name, field.DBName, err)
+                }
+            }
+        }
+        if err := db.Set("gorm:save_associations", false).Create(value).Error; err != nil {
+            return err
+        }
+    }
+    if identity {
+        return db.Exec("SET IDENTITY_INSERT " + table.name + " OFF").Error
+    }
+    return nil
+}
+
+/*
+ Writes a file of the archive into the storage, if it is one of the wanted ones. Files that didn't exist before are removed on rollback
+ */
+func restoreFile(work *app.UnitOfWork, wanted map[string]bool, header *tar.Header, content io.Reader) error {
+    if !strings.HasPrefix(header.Name, "files/") {
+        return nil
+    }
+    name, ok := storagePath(strings.TrimPrefix(header.Name, "files/"))
+    if !ok || !wanted[name] {
+        return nil
+    }
+    target := filepath.Join(app.Settings.Storage, filepath.FromSlash(name))
+    if _, err := os.Stat(target); err == nil {
+        log.Printf("* Kept the existing file %s", name)
+        return nil
+    }
+    os.MkdirAll(filepath.Dir(target), os.ModePerm)
+    out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+    if err != nil {
+        return err
+    }
+    work.OnRollback(func() {
+        _ = os.Remove(target)
+    })
+    if _, err := io.Copy(out, content); err != nil {
+        out.Close()
+        return err
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+    return os.Chtimes(target, header.ModTime, header.ModTime)
+}
\ No newline at end of file
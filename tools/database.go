@@ -0,0 +1,57 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package tools
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "fmt"
+    "log"
+    "os"
+)
+
+/*
+ Applies all pending schema migrations
+ */
+func DatabaseMigrate() {
+    log.SetOutput(os.Stdout)
+    if err := app.Migrate(); err != nil {
+        log.Fatalf("* %s", err)
+    }
+    log.Print("* The database schema is up to date")
+}
+
+/*
+ Rolls back the newest schema migrations
+ */
+func DatabaseRollback(steps int) {
+    log.SetOutput(os.Stdout)
+    if err := app.Rollback(steps); err != nil {
+        log.Fatalf("* %s", err)
+    }
+}
+
+/*
+ Prints which schema migrations were applied
+ */
+func DatabaseStatus() {
+    states, err := app.MigrationStatus()
+    if err != nil {
+        log.Fatalf("* Failed to read the schema migrations: %s", err)
+    }
+    for _,element := range states {
+        status := "pending"
+        if element.Applied {
+            status = "applied " + element.AppliedAt.Format("2006-01-02 15:04:05")
+        }
+        if !element.Known {
+            status += ", unknown to this version"
+        }
+        fmt.Printf("%6d  %-50s %s\n", element.Version, element.Name, status)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,77 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package tools
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+)
+
+func findGame(short string) *objects.Game {
+    game := &objects.Game{}
+    app.Database.Where("short = ?", short).First(game)
+    if game.Short != short || short == "" {
+        log.Fatalf("* The game %s does not exist", short)
+    }
+    return game
+}
+
+/*
+ Writes the mods of a game into an archive that another instance can import
+ */
+func ExportGame(short string, output string) {
+    log.SetOutput(os.Stdout)
+    game := findGame(short)
+    file, err := os.Create(output)
+    if err != nil {
+        log.Fatalf("* Export failed: %s", err)
+    }
+    missing, err := objects.ExportGame(game, file)
+    file.Close()
+    if err != nil {
+        os.Remove(output)
+        log.Fatalf("* Export failed: %s", err)
+    }
+    for _,element := range missing {
+        log.Printf("* Missing file: %s", element)
+    }
+    log.Printf("* Wrote the mods of %s to %s", game.Name, output)
+}
+
+/*
+ Imports an archive created by ExportGame into a game and prints what was imported
+ */
+func ImportGame(short string, input string, options objects.ImportOptions) {
+    log.SetOutput(os.Stdout)
+    game := findGame(short)
+    file, err := os.Open(input)
+    if err != nil {
+        log.Fatalf("* Import failed: %s", err)
+    }
+    defer file.Close()
+    report, err := objects.ImportGame(game, file, options)
+    if err != nil {
+        log.Fatalf("* Import failed: %s", err)
+    }
+    if options.DryRun {
+        fmt.Printf("Dry run, nothing was written.\n")
+    }
+    fmt.Printf("Mods:          %d\n", len(report.Mods))
+    fmt.Printf("Versions:      %d\n", report.Versions)
+    if len(report.GameVersions) > 0 {
+        fmt.Printf("Game versions: %s\n", strings.Join(report.GameVersions, ", "))
+    }
+    for _,element := range report.Conflicts {
+        fmt.Printf("Skipped:       %s\n", element)
+    }
+}
\ No newline at end of file
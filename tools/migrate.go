@@ -9,24 +9,239 @@
 package tools
 
 import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
     "database/sql"
     "encoding/json"
+    "errors"
     "fmt"
+    "github.com/jinzhu/gorm"
     _ "github.com/jinzhu/gorm/dialects/mssql"
     _ "github.com/jinzhu/gorm/dialects/mysql"
     _ "github.com/jinzhu/gorm/dialects/postgres"
+    "github.com/spf13/cast"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
     "time"
 )
 
-/* Insert appropriate values here */
-const driver_old_SD = "postgres"
-const connection_old_SD = ""
-const driver_new_SD = "postgres"
-const connection_new_SD = ""
-const admin_role_id = 1
+/*
+ The settings of the importer for databases of the old SpaceDock. They can be loaded from a file in config/ and are overridden by flags.
+ The old database has to be postgres or mysql, the new one defaults to the database from config.yml
+ */
+type MigrateOptions struct {
+    OldDriver     string `yaml:"old-driver"`
+    OldConnection string `yaml:"old-connection"`
+    NewDriver     string `yaml:"new-driver"`
+    NewConnection string `yaml:"new-connection"`
+    OldStorage    string `yaml:"old-storage"`
+    AdminRole     string `yaml:"admin-role"`
+    BatchSize     int `yaml:"batch-size"`
+    DryRun        bool `yaml:"dry-run"`
+}
+
+/*
+ How far the import of a table got, so an interrupted import continues where it stopped
+ */
+type LegacyImport struct {
+    Name     string `gorm:"primary_key;size:64"`
+    LastKey  int64
+    Imported int
+    Skipped  int
+}
+
+func (LegacyImport) TableName() string {
+    return "legacy_imports"
+}
+
+/*
+ A table of the old database. Rows are read in batches ordered by Key, or by Order and their offset if the table has no key.
+ References lists the columns that point to rows of other tables in the new database, rows where they don't are skipped
+ */
+type legacyTable struct {
+    Name       string
+    Target     string
+    Key        string
+    Order      string
+    KeepIDs    bool
+    References map[string]string
+    Insert     func(im *importer, tx *gorm.DB, row map[string]interface{}) error
+}
+
+type legacyMod struct {
+    Name   string
+    UserID int64
+}
+
+type importer struct {
+    options   MigrateOptions
+    progress  map[string]*LegacyImport
+    oldDB     *gorm.DB
+    newDB     *gorm.DB
+    adminRole int64
+    known     map[string]map[int64]bool
+    mods      map[int64]legacyMod
+    usernames map[int64]string
+    report    []string
+    copied    int
+    present   int
+    missing   []string
+}
 
-func SQLToMap(rows *sql.Rows) []map[string]interface{} {
-    cols,_ := rows.Columns()
+var legacyTables = []legacyTable{
+    {
+        Name: "publisher", Target: "publishers", Key: "id", KeepIDs: true,
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO publishers (id, created_at, updated_at, name, description, short_description, meta) VALUES (?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["updated"], element["name"], element["description"],
+                element["short_description"], DumpJSON(map[string]interface{} {
+                    "link": element["link"],
+                    "background": element["background"],
+                })).Error
+        },
+    },
+    {
+        Name: "game", Target: "games", Key: "id", KeepIDs: true,
+        References: map[string]string{"publisher_id": "publishers"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO games (id, created_at, updated_at, name, active, altname, rating, releasedate, short, publisher_id, description, short_description, meta) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["updated"], element["name"], element["active"], element["altname"],
+                element["rating"], element["releasedate"], element["short"], element["publisher_id"], element["description"],
+                element["short_description"], DumpJSON(map[string]interface{} {
+                    "link": element["link"],
+                    "background": element["background"],
+                })).Error
+        },
+    },
+    {
+        Name: "gameversion", Target: "game_versions", Key: "id", KeepIDs: true,
+        References: map[string]string{"game_id": "games"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO game_versions (id, created_at, updated_at, game_id, friendly_version, beta, meta) VALUES (?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["created"], element["game_id"], element["friendly_version"], false, "{}").Error
+        },
+    },
+    {
+        Name: "user", Target: "users", Key: "id", KeepIDs: true,
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            err := tx.Exec("INSERT INTO users (id, created_at, updated_at, username, email, show_email, public, password, description, confirmation, password_reset, password_reset_expiry, meta) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["created"], element["username"], element["email"], false,
+                element["public"], element["password"], element["description"], element["confirmation"],
+                element["passwordReset"], element["passwordResetExpiry"], DumpJSON(map[string]interface{} {
+                    "forumUsername": element["forumUsername"],
+                    "ircNick": element["ircNick"],
+                    "twitterUsername": element["twitterUsername"],
+                    "redditUsername": element["redditUsername"],
+                    "background": element["backgroundMedia"],
+                })).Error
+            if err != nil || !cast.ToBool(element["admin"]) {
+                return err
+            }
+            return tx.Exec("INSERT INTO role_users (role_id, user_id) VALUES (?,?)", im.adminRole, element["id"]).Error
+        },
+    },
+    {
+        Name: "mod", Target: "mods", Key: "id", KeepIDs: true,
+        References: map[string]string{"user_id": "users", "game_id": "games"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO mods (id, created_at, updated_at, user_id, game_id, name, description, short_description, approved, published, license, default_version_id, total_score, download_count, meta) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["updated"], element["user_id"], element["game_id"], element["name"],
+                element["description"], element["short_description"], true, element["published"], element["license"],
+                element["default_version_id"], 0, element["download_count"], DumpJSON(map[string]interface{} {
+                    "ckan": element["ckan"],
+                    "source_link": element["source_link"],
+                    "background": element["background"],
+                })).Error
+        },
+    },
+    {
+        Name: "modversion", Target: "mod_versions", Key: "id", KeepIDs: true,
+        References: map[string]string{"mod_id": "mods", "gameversion_id": "game_versions"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            path, size := im.importFile(element)
+            return tx.Exec("INSERT INTO mod_versions (id, created_at, updated_at, mod_id, friendly_version, beta, game_version_id, download_path, changelog, sort_index, file_size, meta) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["created"], element["mod_id"], element["friendly_version"], false, element["gameversion_id"], path, element["changelog"], element["sort_index"], size, "{}").Error
+        },
+    },
+    {
+        Name: "featured", Target: "featureds", Key: "id",
+        References: map[string]string{"mod_id": "mods"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO featureds (created_at, updated_at, mod_id, meta) VALUES (?,?,?,?)",
+                element["created"], element["created"], element["mod_id"], "{}").Error
+        },
+    },
+    {
+        Name: "mod_followers", Target: "mod_followers", Order: "mod_id, user_id",
+        References: map[string]string{"mod_id": "mods", "user_id": "users"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO mod_followers (user_id, mod_id) VALUES (?,?)", element["user_id"], element["mod_id"]).Error
+        },
+    },
+    {
+        Name: "modlist", Target: "mod_lists", Key: "id", KeepIDs: true,
+        References: map[string]string{"user_id": "users", "game_id": "games"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO mod_lists (id, created_at, updated_at, user_id, game_id, name, description, short_description, meta) VALUES (?,?,?,?,?,?,?,?,?)",
+                element["id"], element["created"], element["created"], element["user_id"], element["game_id"], element["name"],
+                element["description"], element["short_description"], DumpJSON(map[string]interface{} {
+                    "background": element["background"],
+                })).Error
+        },
+    },
+    {
+        Name: "modlistitem", Target: "mod_list_items", Key: "id",
+        References: map[string]string{"mod_id": "mods", "mod_list_id": "mod_lists"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO mod_list_items (created_at, updated_at, mod_id, mod_list_id, sort_index, meta) VALUES (?,?,?,?,?,?)",
+                time.Now(), time.Now(), element["mod_id"], element["mod_list_id"], element["sort_index"], "{}").Error
+        },
+    },
+    {
+        Name: "sharedauthor", Target: "shared_authors", Key: "id",
+        References: map[string]string{"mod_id": "mods", "user_id": "users"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO shared_authors (created_at, updated_at, mod_id, user_id, accepted, meta) VALUES (?,?,?,?,?,?)",
+                time.Now(), time.Now(), element["mod_id"], element["user_id"], element["accepted"], "{}").Error
+        },
+    },
+    {
+        Name: "downloadevent", Target: "download_events", Key: "id",
+        References: map[string]string{"mod_id": "mods", "version_id": "mod_versions"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return objects.AddDownloads(tx, cast.ToUint(element["mod_id"]), cast.ToUint(element["version_id"]), cast.ToTime(element["created"]), cast.ToInt(element["downloads"]))
+        },
+    },
+    {
+        Name: "followevent", Target: "follow_events", Key: "id",
+        References: map[string]string{"mod_id": "mods"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO follow_events (created_at, updated_at, mod_id, events, delta, meta) VALUES (?,?,?,?,?,?)",
+                element["created"], element["created"], element["mod_id"], element["events"], element["delta"], "{}").Error
+        },
+    },
+    {
+        Name: "referralevent", Target: "referral_events", Key: "id",
+        References: map[string]string{"mod_id": "mods"},
+        Insert: func(im *importer, tx *gorm.DB, element map[string]interface{}) error {
+            return tx.Exec("INSERT INTO referral_events (created_at, updated_at, mod_id, events, host, meta) VALUES (?,?,?,?,?,?)",
+                element["created"], element["created"], element["mod_id"], element["events"], element["host"], "{}").Error
+        },
+    },
+}
+
+/*
+ Reads all rows into maps from column names to values. Byte slices are turned into strings, since some drivers return text that way
+ */
+func SQLToMap(rows *sql.Rows) ([]map[string]interface{}, error) {
+    cols, err := rows.Columns()
+    if err != nil {
+        return nil, err
+    }
     result := []map[string]interface{}{}
     for rows.Next() {
         // Create a slice of interface{}'s to represent each column,
@@ -39,21 +254,24 @@ func SQLToMap(rows *sql.Rows) []map[string]interface{} {
 
         // Scan the result into the column pointers...
         if err := rows.Scan(columnPointers...); err != nil {
-            panic(err)
+            return nil, err
         }
 
         // Create our map, and retrieve the value for each column from the pointers slice,
         // storing it in the map with the name of the column as the key.
         m := make(map[string]interface{})
         for i, colName := range cols {
-            val := columnPointers[i].(*interface{})
-            m[colName] = *val
+            val := *(columnPointers[i].(*interface{}))
+            if b, ok := val.([]byte); ok {
+                val = string(b)
+            }
+            m[colName] = val
         }
 
         // Outputs: map[columnName:value columnName2:value2 columnName3:value3 ...]
         result = append(result, m)
     }
-    return result
+    return result, rows.Err()
 }
 
 func DumpJSON(data interface{}) string {
@@ -64,333 +282,417 @@ func DumpJSON(data interface{}) string {
     return string(buff)
 }
 
-func MigrateDB() {
-    oldDB, err := sql.Open(driver_old_SD, connection_old_SD)
-    if err != nil {
-        panic(err)
+/*
+ Imports a database of the old SpaceDock into the new format. The options from the config file are used unless a flag sets them
+ */
+func MigrateDB(flags MigrateOptions, configFile string) {
+    log.SetOutput(os.Stdout)
+    options := MigrateOptions{}
+    if configFile != "" {
+        app.LoadFromConfigFile(&options, configFile)
     }
-    newDB, err := sql.Open(driver_new_SD, connection_new_SD)
-    if err != nil {
-        panic(err)
+    if flags.OldDriver != "" {
+        options.OldDriver = flags.OldDriver
+    }
+    if flags.OldConnection != "" {
+        options.OldConnection = flags.OldConnection
+    }
+    if flags.NewDriver != "" {
+        options.NewDriver = flags.NewDriver
+    }
+    if flags.NewConnection != "" {
+        options.NewConnection = flags.NewConnection
     }
+    if flags.OldStorage != "" {
+        options.OldStorage = flags.OldStorage
+    }
+    if flags.AdminRole != "" {
+        options.AdminRole = flags.AdminRole
+    }
+    if flags.BatchSize > 0 {
+        options.BatchSize = flags.BatchSize
+    }
+    options.DryRun = options.DryRun || flags.DryRun
+    if err := runImport(options); err != nil {
+        log.Fatalf("* Import failed: %s", err)
+    }
+}
 
-    // Clear database
-    newDB.Exec("DELETE * FROM users")
-    newDB.Exec("DELETE * FROM role_users")
+func runImport(options MigrateOptions) error {
+    if options.OldDriver == "" {
+        options.OldDriver = "postgres"
+    }
+    if options.OldConnection == "" {
+        return errors.New("The connection to the old database is missing")
+    }
+    if options.AdminRole == "" {
+        options.AdminRole = "admin"
+    }
+    if options.BatchSize <= 0 {
+        options.BatchSize = 500
+    }
 
-    // Featured
-    fmt.Print("Migrating featured mods\n")
-    rows, err := oldDB.Query("SELECT * FROM featured")
+    // Connect to both databases
+    im := &importer{options: options, progress: map[string]*LegacyImport{}, known: map[string]map[int64]bool{}}
+    oldDB, err := gorm.Open(options.OldDriver, options.OldConnection)
     if err != nil {
-        panic(err)
-    }
-    data := SQLToMap(rows)
-    tx, _ := newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO featureds (created_at, updated_at, mod_id, meta) VALUES ($1, $2, $3, $4)",
-            element["created"], element["created"], element["mod_id"], "{}")
+        return err
+    }
+    defer oldDB.Close()
+    im.oldDB = oldDB
+    if options.NewDriver == "" && options.NewConnection == "" {
+        im.newDB = app.Database
+    } else {
+        newDB, err := gorm.Open(options.NewDriver, options.NewConnection)
         if err != nil {
-            panic(err)
+            return err
         }
+        defer newDB.Close()
+        im.newDB = newDB
+    }
+    if !im.newDB.HasTable("users") {
+        return errors.New("The new database has no tables yet, run \"sdb db migrate\" on it first")
+    }
+    if err := im.prepare(); err != nil {
+        return err
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
 
-    // Users
-    fmt.Print("Migrating users\n")
-    rows, err = oldDB.Query("SELECT * FROM \"user\"")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["username"])
-        _, err := tx.Exec("INSERT INTO users (id, created_at, updated_at, username, email, show_email, public, password, description, confirmation, password_reset, password_reset_expiry, meta) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)",
-            element["id"], element["created"], element["created"], element["username"], element["email"], false,
-            element["public"], element["password"], element["description"], element["confirmation"],
-            element["passwordReset"], element["passwordResetExpiry"], DumpJSON(map[string]interface{} {
-                "forumUsername": element["forumUsername"],
-                "ircNick": element["ircNick"],
-                "twitterUsername": element["twitterUsername"],
-                "redditUsername": element["redditUsername"],
-                "background": element["backgroundMedia"],
-            }))
-        if err != nil {
-            panic(err)
-        }
-        if element["admin"].(bool) {
-            _, err := tx.Exec("INSERT INTO role_users (role_id, user_id) VALUES ($1,$2)", admin_role_id, element["id"])
-            if err != nil {
-                panic(err)
-            }
+    if options.DryRun {
+        log.Print("* Dry run, nothing will be written")
+    }
+    for _,table := range legacyTables {
+        if err := im.importTable(table); err != nil {
+            return fmt.Errorf("%s: %s", table.Name, err)
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    im.checkDefaultVersions()
+    im.printReport()
+    return nil
+}
 
-    // Publisher
-    fmt.Print("Migrating publishers\n")
-    rows, err = oldDB.Query("SELECT * FROM publisher")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["name"])
-        _, err := tx.Exec("INSERT INTO publishers (id, created_at, updated_at, name, description, short_description, meta) VALUES ($1,$2,$3,$4,$5,$6,$7)",
-            element["id"], element["created"], element["updated"], element["name"], element["description"],
-            element["short_description"], DumpJSON(map[string]interface{} {
-                "link": element["link"],
-                "background": element["background"],
-            }))
-        if err != nil {
-            panic(err)
+/*
+ Loads what the import needs from both databases before it starts
+ */
+func (im *importer) prepare() error {
+    resuming := false
+    if im.newDB.HasTable(&LegacyImport{}) {
+        count := 0
+        im.newDB.Model(&LegacyImport{}).Count(&count)
+        resuming = count > 0
+    } else if !im.options.DryRun {
+        if err := im.newDB.CreateTable(&LegacyImport{}).Error; err != nil {
+            return err
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
-
-    // Game
-    fmt.Print("Migrating games\n")
-    rows, err = oldDB.Query("SELECT * FROM game")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["short"])
-        _, err := tx.Exec("INSERT INTO games (id, created_at, updated_at, name, active, altname, rating, releasedate, short, publisher_id, description, short_description, meta) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)",
-            element["id"], element["created"], element["updated"], element["name"], element["active"], element["altname"],
-            element["rating"], element["releasedate"], element["short"], element["publisher_id"], element["description"],
-            element["short_description"], DumpJSON(map[string]interface{} {
-                "link": element["link"],
-                "background": element["background"],
-            }))
-        if err != nil {
-            panic(err)
+    if !resuming {
+        count := 0
+        im.newDB.Table("users").Count(&count)
+        if count > 0 {
+            return errors.New("The new database already contains users. The ids of the old database are kept, so it has to be empty")
         }
+    } else {
+        log.Print("* Continuing the previous import")
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
 
-    // Mod
-    fmt.Print("Migrating mods\n")
-    rows, err = oldDB.Query("SELECT * FROM mod")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["name"])
-        _, err := tx.Exec("INSERT INTO mods (id, created_at, updated_at, user_id, game_id, name, description, short_description, approved, published, license, default_version_id, total_score, download_count, meta) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)",
-            element["id"], element["created"], element["updated"], element["user_id"], element["game_id"], element["name"],
-            element["description"], element["short_description"], true, element["published"], element["license"],
-            element["default_version_id"], 0, element["download_count"], DumpJSON(map[string]interface{} {
-                "ckan": element["ckan"],
-                "source_link": element["source_link"],
-                "background": element["background"],
-            }))
+    // The ids that already exist in the new database
+    for _,table := range legacyTables {
+        if !table.KeepIDs {
+            continue
+        }
+        im.known[table.Target] = map[int64]bool{}
+        rows, err := im.newDB.Table(table.Target).Select("id").Rows()
         if err != nil {
-            panic(err)
+            return err
         }
+        for rows.Next() {
+            var id int64
+            if rows.Scan(&id) == nil {
+                im.known[table.Target][id] = true
+            }
+        }
+        rows.Close()
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
 
-    // Mod Followers
-    fmt.Print("Migrating followers\n")
-    rows, err = oldDB.Query("SELECT * FROM mod_followers")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    newDB.Exec("CREATE TABLE mod_followers (mod_id integer, user_id integer);")
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d - %d\n", element["user_id"], element["mod_id"])
-        _, err := tx.Exec("INSERT INTO mod_followers (user_id, mod_id) VALUES ($1,$2)", element["user_id"], element["mod_id"])
-        if err != nil {
-            panic(err)
+    // Admins of the old database get the admin role
+    role := &objects.Role{}
+    im.newDB.Where("name = ?", im.options.AdminRole).First(role)
+    if role.ID == 0 {
+        im.note("The role " + im.options.AdminRole + " doesn't exist and is created for the admins. Its abilities have to be granted through the access API")
+        if !im.options.DryRun {
+            role = objects.NewRole(im.options.AdminRole, "Administrators imported from the old database")
+            if err := im.newDB.Save(role).Error; err != nil {
+                return err
+            }
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    im.adminRole = int64(role.ID)
 
-    // Modlist
-    fmt.Print("Migrating mod lists\n")
-    rows, err = oldDB.Query("SELECT * FROM modlist")
+    // Names for the paths of the mod files
+    if im.options.OldStorage == "" {
+        im.note("No old storage directory was given, the mod files are not imported and their paths are kept")
+        return nil
+    }
+    im.mods = map[int64]legacyMod{}
+    im.usernames = map[int64]string{}
+    rows, err := im.oldDB.Raw("SELECT id, name, user_id FROM " + im.oldDB.Dialect().Quote("mod")).Rows()
     if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["name"])
-        _, err := tx.Exec("INSERT INTO mod_lists (id, created_at, updated_at, user_id, game_id, name, description, short_description, meta) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)",
-            element["id"], element["created"], element["created"], element["user_id"], element["game_id"], element["name"],
-            element["description"], element["short_description"], DumpJSON(map[string]interface{} {
-                "background": element["background"],
-            }))
-        if err != nil {
-            panic(err)
+        return err
+    }
+    for rows.Next() {
+        var id, user int64
+        var name string
+        if rows.Scan(&id, &name, &user) == nil {
+            im.mods[id] = legacyMod{Name: name, UserID: user}
         }
     }
-    tx.Commit()
     rows.Close()
-    fmt.Print("\n")
-
-    // Modlist Item
-    fmt.Print("Migrating modlist items\n")
-    rows, err = oldDB.Query("SELECT * FROM modlistitem")
+    rows, err = im.oldDB.Raw("SELECT id, username FROM " + im.oldDB.Dialect().Quote("user")).Rows()
     if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO mod_list_items (created_at, updated_at, mod_id, mod_list_id, sort_index, meta) VALUES ($1,$2,$3,$4,$5,$6)",
-            time.Now(), time.Now(), element["mod_id"], element["mod_list_id"], element["sort_index"], "{}")
-        if err != nil {
-            panic(err)
+        return err
+    }
+    for rows.Next() {
+        var id int64
+        var name string
+        if rows.Scan(&id, &name) == nil {
+            im.usernames[id] = name
         }
     }
-    tx.Commit()
     rows.Close()
-    fmt.Print("\n")
+    return nil
+}
 
-    // Shared Authors
-    fmt.Print("Migrating shared authors\n")
-    rows, err = oldDB.Query("SELECT * FROM sharedauthor")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO shared_authors (created_at, updated_at, mod_id, user_id, accepted, meta) VALUES ($1,$2,$3,$4,$5,$6)",
-            time.Now(), time.Now(), element["mod_id"], element["user_id"], element["accepted"], "{}")
+/*
+ Copies the rows of a table in batches. Every batch is written together with the progress of the table, so an interrupted import can continue
+ */
+func (im *importer) importTable(table legacyTable) error {
+    progress := &LegacyImport{Name: table.Name}
+    if im.newDB.HasTable(&LegacyImport{}) {
+        im.newDB.Where("name = ?", table.Name).First(progress)
+        progress.Name = table.Name
+    }
+    im.progress[table.Name] = progress
+    quoted := im.oldDB.Dialect().Quote(table.Name)
+    total := 0
+    if err := im.oldDB.Raw("SELECT COUNT(*) FROM " + quoted).Row().Scan(&total); err != nil {
+        return err
+    }
+    log.Printf("* Importing %s (%d rows)", table.Name, total)
+
+    for {
+        var rows *sql.Rows
+        var err error
+        if table.Key != "" {
+            rows, err = im.oldDB.Raw("SELECT * FROM " + quoted + " WHERE " + table.Key + " > ? ORDER BY " + table.Key + " LIMIT ?", progress.LastKey, im.options.BatchSize).Rows()
+        } else {
+            rows, err = im.oldDB.Raw("SELECT * FROM " + quoted + " ORDER BY " + table.Order + " LIMIT ? OFFSET ?", im.options.BatchSize, progress.LastKey).Rows()
+        }
+        if err != nil {
+            return err
+        }
+        data, err := SQLToMap(rows)
+        rows.Close()
         if err != nil {
-            panic(err)
+            return err
+        }
+        if len(data) == 0 {
+            break
         }
+        if err := im.importBatch(table, data, progress); err != nil {
+            return err
+        }
+        log.Printf("   %s: %d/%d", table.Name, progress.Imported + progress.Skipped, total)
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
 
-    // Download events
-    fmt.Print("Migrating download events\n")
-    rows, err = oldDB.Query("SELECT * FROM downloadevent")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO download_events (created_at, updated_at, mod_id, version_id, downloads, meta) VALUES ($1,$2,$3,$4,$5,$6)",
-            element["created"], element["created"], element["mod_id"], element["version_id"], element["downloads"], "{}")
-        if err != nil {
-            panic(err)
+    // Postgres doesn't move the sequence of a table when rows are inserted with their id
+    if table.KeepIDs && !im.options.DryRun && im.newDB.Dialect().GetName() == "postgres" {
+        return im.newDB.Exec("SELECT setval(pg_get_serial_sequence('" + table.Target + "', 'id'), (SELECT MAX(id) FROM " + table.Target + "))").Error
+    }
+    return nil
+}
+
+func (im *importer) importBatch(table legacyTable, data []map[string]interface{}, progress *LegacyImport) error {
+    var tx *gorm.DB
+    if !im.options.DryRun {
+        tx = im.newDB.Begin()
+        if tx.Error != nil {
+            return tx.Error
+        }
+        if table.KeepIDs && im.newDB.Dialect().GetName() == "mssql" {
+            if err := tx.Exec("SET IDENTITY_INSERT " + table.Target + " ON").Error; err != nil {
+                tx.Rollback()
+                return err
+            }
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    added := []int64{}
+    for _,row := range data {
+        if missing := im.missingReference(table, row); missing != "" {
+            im.skip(table, row, missing)
+            progress.Skipped += 1
+            continue
+        }
+        if !im.options.DryRun {
+            if err := table.Insert(im, tx, row); err != nil {
+                tx.Rollback()
+                return err
+            }
+        } else if table.Name == "modversion" {
+            im.importFile(row)
+        }
+        if table.KeepIDs {
+            added = append(added, cast.ToInt64(row["id"]))
+        }
+        progress.Imported += 1
+    }
+    if table.Key != "" {
+        progress.LastKey = cast.ToInt64(data[len(data) - 1][table.Key])
+    } else {
+        progress.LastKey += int64(len(data))
+    }
+    if !im.options.DryRun {
+        if table.KeepIDs && im.newDB.Dialect().GetName() == "mssql" {
+            if err := tx.Exec("SET IDENTITY_INSERT " + table.Target + " OFF").Error; err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+        if err := tx.Save(progress).Error; err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit().Error; err != nil {
+            return err
+        }
+    }
+    for _,id := range added {
+        im.known[table.Target][id] = true
+    }
+    return nil
+}
 
-    // Follow events
-    fmt.Print("Migrating follow events\n")
-    rows, err = oldDB.Query("SELECT * FROM followevent")
-    if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO follow_events (created_at, updated_at, mod_id, events, delta, meta) VALUES ($1,$2,$3,$4,$5,$6)",
-            element["created"], element["created"], element["mod_id"], element["events"], element["delta"], "{}")
-        if err != nil {
-            panic(err)
+/*
+ Returns the first column of the row that points to a row the new database doesn't have
+ */
+func (im *importer) missingReference(table legacyTable, row map[string]interface{}) string {
+    for column, target := range table.References {
+        if row[column] == nil {
+            continue
+        }
+        if !im.known[target][cast.ToInt64(row[column])] {
+            return column
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    return ""
+}
+
+func (im *importer) skip(table legacyTable, row map[string]interface{}, column string) {
+    key := "offset"
+    if table.Key != "" {
+        key = table.Key + " " + cast.ToString(row[table.Key])
+    }
+    im.note("Skipped " + table.Name + " " + key + ": " + column + " " + cast.ToString(row[column]) + " doesn't exist")
+}
+
+func (im *importer) note(message string) {
+    im.report = append(im.report, message)
+}
+
+/*
+ Copies the file of a mod version into the storage, using the same layout as new uploads. Returns the new path and the size of the file
+ */
+func (im *importer) importFile(row map[string]interface{}) (string, int64) {
+    old := cast.ToString(row["download_path"])
+    if im.options.OldStorage == "" {
+        return old, 0
+    }
+    mod := im.mods[cast.ToInt64(row["mod_id"])]
+    user := objects.User{Username: im.usernames[mod.UserID]}
+    user.ID = uint(mod.UserID)
+    path := objects.ModVersionPath(user, objects.Mod{Name: mod.Name}, cast.ToString(row["friendly_version"]))
 
-    // Referral events
-    fmt.Print("Migrating referral events\n")
-    rows, err = oldDB.Query("SELECT * FROM referralevent")
+    source := filepath.Join(im.options.OldStorage, filepath.FromSlash(strings.TrimPrefix(old, "/")))
+    info, err := os.Stat(source)
     if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d\n", element["id"])
-        _, err := tx.Exec("INSERT INTO referral_events (created_at, updated_at, mod_id, events, host, meta) VALUES ($1,$2,$3,$4,$5,$6)",
-            element["created"], element["created"], element["mod_id"], element["events"], element["host"], "{}")
-        if err != nil {
-            panic(err)
-        }
+        im.missing = append(im.missing, old)
+        return path, 0
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    target := filepath.Join(app.Settings.Storage, filepath.FromSlash(path))
+    if existing, err := os.Stat(target); err == nil && existing.Size() == info.Size() {
+        im.present += 1
+        return path, info.Size()
+    }
+    if im.options.DryRun {
+        im.copied += 1
+        return path, info.Size()
+    }
+    if err := copyFile(source, target); err != nil {
+        im.note("Failed to copy " + old + ": " + err.Error())
+        return path, 0
+    }
+    im.copied += 1
+    return path, info.Size()
+}
 
-    // Mod versions
-    fmt.Print("Migrating mod versions\n")
-    rows, err = oldDB.Query("SELECT * FROM modversion")
+func copyFile(source string, target string) error {
+    in, err := os.Open(source)
     if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["friendly_version"])
-        _, err := tx.Exec("INSERT INTO mod_versions (id, created_at, updated_at, mod_id, friendly_version, beta, game_version_id, download_path, changelog, sort_index, file_size, meta) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)",
-            element["id"], element["created"], element["created"], element["mod_id"], element["friendly_version"], false, element["gameversion_id"], element["download_path"], element["changelog"], element["sort_index"], 0, "{}")
-        if err != nil {
-            panic(err)
-        }
+        return err
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+    defer in.Close()
+    os.MkdirAll(filepath.Dir(target), os.ModePerm)
+    out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
 
-    // Game versions
-    fmt.Print("Migrating game versions\n")
-    rows, err = oldDB.Query("SELECT * FROM gameversion")
+/*
+ The default versions of mods are imported before the versions, so they can only be checked at the end
+ */
+func (im *importer) checkDefaultVersions() {
+    rows, err := im.oldDB.Raw("SELECT id, default_version_id FROM " + im.oldDB.Dialect().Quote("mod")).Rows()
     if err != nil {
-        panic(err)
-    }
-    data = SQLToMap(rows)
-    tx, _ = newDB.Begin()
-    for _,element := range data {
-        fmt.Printf("   Migrating Entry %d (%s)\n", element["id"], element["friendly_version"])
-        _, err := tx.Exec("INSERT INTO game_versions (id, created_at, updated_at, game_id, friendly_version, beta, meta) VALUES ($1,$2,$3,$4,$5,$6,$7)",
-            element["id"], element["created"], element["created"], element["game_id"], element["friendly_version"], false, "{}")
-        if err != nil {
-            panic(err)
+        im.note("Failed to check the default versions: " + err.Error())
+        return
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id int64
+        var version *int64
+        if rows.Scan(&id, &version) != nil || version == nil || !im.known["mods"][id] {
+            continue
+        }
+        if !im.known["mod_versions"][*version] {
+            im.note("Mod " + strconv.FormatInt(id, 10) + " has the default version " + strconv.FormatInt(*version, 10) + ", which doesn't exist")
         }
     }
-    tx.Commit()
-    rows.Close()
-    fmt.Print("\n")
+}
 
-    fmt.Print("Migration completed. You might have to fix the auto_increments of the tables. Sorry.\n")
-    newDB.Close()
-    oldDB.Close()
+func (im *importer) printReport() {
+    if im.options.DryRun {
+        fmt.Print("\nDry run report, nothing was written\n")
+    } else {
+        fmt.Print("\nImport report\n")
+    }
+    for _,table := range legacyTables {
+        progress := im.progress[table.Name]
+        fmt.Printf("    %-16s %d imported, %d skipped\n", table.Name, progress.Imported, progress.Skipped)
+    }
+    if im.options.OldStorage != "" {
+        fmt.Printf("    %-16s %d copied, %d already present, %d missing\n", "files", im.copied, im.present, len(im.missing))
+        for _,element := range im.missing {
+            fmt.Printf("        missing: %s\n", element)
+        }
+    }
+    if len(im.report) > 0 {
+        fmt.Print("\n")
+        for _,element := range im.report {
+            fmt.Printf("    %s\n", element)
+        }
+    }
 }
\ No newline at end of file
@@ -0,0 +1,51 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+*/
+
+package tools
+
+import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/objects"
+    "fmt"
+    "log"
+    "os"
+)
+
+/*
+ Syncs one mirror, or all enabled ones if id is 0, and prints what was pulled
+ */
+func SyncMirrors(id uint) {
+    log.SetOutput(os.Stdout)
+    mirrors := []objects.Mirror{}
+    if id != 0 {
+        app.Database.Where("id = ?", id).Find(&mirrors)
+    } else {
+        app.Database.Where("enabled = ?", true).Find(&mirrors)
+    }
+    if len(mirrors) == 0 {
+        log.Fatal("* There are no mirrors to sync")
+    }
+    failed := false
+    for i := range mirrors {
+        mirror := &mirrors[i]
+        fmt.Printf("%s/%s -> %s\n", mirror.Origin, mirror.RemoteGame, mirror.Game.Short)
+        report, err := objects.SyncMirror(mirror)
+        if err != nil {
+            fmt.Printf("    failed: %s\n", err)
+            failed = true
+            continue
+        }
+        fmt.Printf("    new mods: %d, updated mods: %d, new versions: %d\n", len(report.Mods), report.Updated, report.Versions)
+        for _,element := range report.Conflicts {
+            fmt.Printf("    skipped: %s\n", element)
+        }
+    }
+    if failed {
+        os.Exit(1)
+    }
+}
\ No newline at end of file
@@ -27,6 +27,9 @@ func Setup(dummy bool) {
 
     log.SetOutput(os.Stdout)
     log.Print("Setting up database...")
+    if err := app.Migrate(); err != nil {
+        log.Fatalf("* %s", err)
+    }
 
     // Setup an Administrator
     NewDummyUser("Administrator", "admin", "admin@example.com", true)
@@ -117,6 +120,7 @@ func NewDummyUser(name string, password string, email string, admin bool) *objec
         admin_role.AddParam("token-edit", "tokenid", ".*")
         admin_role.AddParam("token-remove", "tokenid", ".*")
         admin_role.AddParam("user-edit", "userid", ".*")
+        admin_role.AddParam("user-2fa-reset", "userid", ".*")
         app.Database.Save(admin_role)
     }
     return user
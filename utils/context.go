@@ -9,8 +9,10 @@
 package utils
 
 import (
+    "github.com/KSP-SpaceDock/SpaceDock-Backend/app"
     "gopkg.in/kataras/iris.v6"
     "log"
+    "strconv"
 )
 
 func GetFullJSON(ctx *iris.Context) map[string]interface{} {
@@ -32,6 +34,14 @@ func GetJSON(ctx *iris.Context, key string) interface{} {
 }
 
 func WriteJSON(ctx *iris.Context, status int, v interface {}) error {
+    if stats, ok := ctx.Get("sdb-queries").(*app.QueryStats); ok && app.Settings.Debug {
+        count, duration := stats.Totals()
+        ctx.SetHeader("X-Query-Count", strconv.Itoa(count))
+        ctx.SetHeader("X-Query-Time", strconv.FormatFloat(duration.Seconds() * 1000, 'f', 2, 64))
+        if charged := stats.Charged(); stats.Budget > 0 && charged > stats.Budget {
+            log.Printf("* %s ran %d queries, its budget is %d", ctx.Path(), charged, stats.Budget)
+        }
+    }
     if _,ok := ctx.URLParams()["callback"]; ok {
         return ctx.JSONP(status, ctx.URLParam("callback"), v)
     }
@@ -0,0 +1,63 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package utils
+
+import (
+    "strings"
+)
+
+/*
+ Well known providers of throwaway email addresses. More can be added with the disposable-domains setting
+ */
+var DisposableDomains = []string{
+    "10minutemail.com",
+    "discard.email",
+    "dispostable.com",
+    "emailondeck.com",
+    "fakeinbox.com",
+    "getnada.com",
+    "guerrillamail.com",
+    "mailinator.com",
+    "maildrop.cc",
+    "mintemail.com",
+    "mohmal.com",
+    "sharklasers.com",
+    "temp-mail.org",
+    "tempmail.net",
+    "throwawaymail.com",
+    "trashmail.com",
+    "yopmail.com",
+}
+
+/*
+ Returns the lowercase domain part of an email address
+ */
+func EmailDomain(email string) string {
+    i := strings.LastIndex(email, "@")
+    if i == -1 {
+        return ""
+    }
+    return strings.ToLower(strings.TrimSpace(email[i + 1:]))
+}
+
+/*
+ Checks whether a domain is one of the listed domains, or a subdomain of one
+ */
+func DomainMatches(domain string, list []string) bool {
+    for _,element := range list {
+        element = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(element), "@"))
+        if element == "" {
+            continue
+        }
+        if domain == element || strings.HasSuffix(domain, "." + element) {
+            return true
+        }
+    }
+    return false
+}
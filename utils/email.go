@@ -16,6 +16,7 @@ import (
     "log"
     "strconv"
     "strings"
+    "time"
 )
 
 func SendMail(sender string, recipients []string, subject string, message string, important bool) {
@@ -85,6 +86,74 @@ func SendReset(userUsername string, userPasswordReset string, userEmail string)
     go SendMail(app.Settings.SupportMail, []string{userEmail}, "Reset your password on " + app.Settings.SiteName, s, true)
 }
 
+func SendEmailChange(userUsername string, newEmail string, confirmation string) {
+    buffer,err := ioutil.ReadFile("emails/email-change")
+    if err != nil {
+        log.Printf("Error while reading Email Template email-change: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "domain": app.Settings.Domain,
+        "confirmation": confirmation,
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{newEmail}, "Confirm your new email address on " + app.Settings.SiteName, s, true)
+}
+
+func SendEmailChangeNotice(userUsername string, oldEmail string, newEmail string, cancel string) {
+    buffer,err := ioutil.ReadFile("emails/email-change-notice")
+    if err != nil {
+        log.Printf("Error while reading Email Template email-change-notice: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "domain": app.Settings.Domain,
+        "new_email": newEmail,
+        "cancel": cancel,
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{oldEmail}, "The email address of your account on " + app.Settings.SiteName + " is changing", s, true)
+}
+
+func SendDeletionNotice(userUsername string, userEmail string, date time.Time) {
+    buffer,err := ioutil.ReadFile("emails/account-deletion")
+    if err != nil {
+        log.Printf("Error while reading Email Template account-deletion: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "domain": app.Settings.Domain,
+        "date": date.Format("2006-01-02 15:04 MST"),
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{userEmail}, "Your account on " + app.Settings.SiteName + " will be deleted", s, true)
+}
+
+func SendApprovalNotice(userUsername string, userEmail string) {
+    buffer,err := ioutil.ReadFile("emails/account-approved")
+    if err != nil {
+        log.Printf("Error while reading Email Template account-approved: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "domain": app.Settings.Domain,
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{userEmail}, "Your account on " + app.Settings.SiteName + " was approved", s, true)
+}
+
 func SendGrantNotice(userUsername string, modUsername string, modName string, modID uint, userEmail string, modURL string) {
     buffer,err := ioutil.ReadFile("emails/grant-notice")
     if err != nil {
@@ -154,6 +223,91 @@ func SendAutoUpdateNotification(followers []string, changelog string, username s
     go SendMail(app.Settings.SupportMail, followers, modname + " is compatible with " + gamename + " " + gameversion + "!", s, true)
 }
 
+/*
+ One mod update that is listed in a digest email
+ */
+type DigestItem struct {
+    ModID           uint
+    ModName         string
+    ModURL          string
+    FriendlyVersion string
+    GameName        string
+    GameVersion     string
+    Changelog       string
+}
+
+func SendDigest(username string, email string, interval string, items []DigestItem) {
+    buffer,err := ioutil.ReadFile("emails/mod-digest")
+    if err != nil {
+        log.Printf("Error while reading Email Template mod-digest: %s", err)
+        return
+    }
+    if len(items) == 0 {
+        return
+    }
+    updates := ""
+    for _,item := range items {
+        changelog := Truncate(item.Changelog, 500)
+        if changelog != item.Changelog {
+            changelog += "..."
+        }
+        changelog = strings.Replace(changelog, "\n", "\n    ", -1)
+        updates += Format("{mod_name} {friendly_version} (compatible with {game_name} {gameversion})\nhttp://{domain}{url}\n\n    {changelog}\n\n", map[string]interface{}{
+            "mod_name": item.ModName,
+            "friendly_version": item.FriendlyVersion,
+            "game_name": item.GameName,
+            "gameversion": item.GameVersion,
+            "domain": app.Settings.Domain,
+            "url": create_mod_url(item.ModID, sanitize.BaseName(item.ModName), item.ModURL),
+            "changelog": changelog,
+        })
+    }
+    data := map[string]interface{}{
+        "username": username,
+        "site_name": app.Settings.SiteName,
+        "interval": interval,
+        "updates": updates,
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{email}, "Your " + interval + " mod updates from " + app.Settings.SiteName, s, false)
+}
+
+func SendLockoutNotice(userUsername string, userEmail string, ip string, until time.Time) {
+    buffer,err := ioutil.ReadFile("emails/account-locked")
+    if err != nil {
+        log.Printf("Error while reading Email Template account-locked: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "domain": app.Settings.Domain,
+        "ip": ip,
+        "until": until.Format("2006-01-02 15:04 MST"),
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{userEmail}, "Your account on " + app.Settings.SiteName + " was locked", s, true)
+}
+
+func SendImpersonationNotice(userUsername string, userEmail string) {
+    buffer,err := ioutil.ReadFile("emails/impersonation-notice")
+    if err != nil {
+        log.Printf("Error while reading Email Template impersonation-notice: %s", err)
+        return
+    }
+    data := map[string]interface{}{
+        "site_name": app.Settings.SiteName,
+        "username": userUsername,
+        "support_mail": app.Settings.SupportMail,
+        "time": time.Now().Format("2006-01-02 15:04 MST"),
+    }
+    text := string(buffer)
+    s := Format(text, data)
+    go SendMail(app.Settings.SupportMail, []string{userEmail}, "An administrator accessed your account on " + app.Settings.SiteName, s, true)
+}
+
 func create_mod_url(id uint, name string, modURL string) string {
     if modURL == "" {
         modURL = app.Settings.ModUrl
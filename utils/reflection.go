@@ -77,3 +77,24 @@ func editObjectInternal(obj *map[string]interface{}, patch map[string]interface{
     }
     return 0
 }
+
+/*
+ Compares two maps created by ToMap and returns the fields that changed, with their old and new value
+ */
+func Diff(before map[string]interface{}, after map[string]interface{}) map[string]interface{} {
+    changes := map[string]interface{}{}
+    for field, value := range after {
+        if field == "updated" {
+            continue
+        }
+        if old, ok := before[field]; !ok || !reflect.DeepEqual(old, value) {
+            changes[field] = map[string]interface{}{"old": before[field], "new": value}
+        }
+    }
+    for field, value := range before {
+        if _, ok := after[field]; !ok {
+            changes[field] = map[string]interface{}{"old": value, "new": nil}
+        }
+    }
+    return changes
+}
@@ -80,6 +80,52 @@ func FromMap(data interface{}, values map[string]interface{}) error {
     return err
 }
 
+/*
+ Returns only the listed fields of a map. Fields of nested objects are selected with a dot, like "user.username"
+ */
+func SelectFields(data map[string]interface{}, fields []string) map[string]interface{} {
+    selected := map[string][]string{}
+    for _,element := range fields {
+        parts := strings.SplitN(strings.TrimSpace(element), ".", 2)
+        if _,ok := selected[parts[0]]; !ok {
+            selected[parts[0]] = []string{}
+        }
+        if len(parts) > 1 {
+            selected[parts[0]] = append(selected[parts[0]], parts[1])
+        }
+    }
+    output := map[string]interface{}{}
+    for key,nested := range selected {
+        value, ok := data[key]
+        if !ok {
+            continue
+        }
+        if len(nested) > 0 {
+            switch v := value.(type) {
+            case map[string]interface{}:
+                value = SelectFields(v, nested)
+            case []map[string]interface{}:
+                items := make([]map[string]interface{}, len(v))
+                for i,item := range v {
+                    items[i] = SelectFields(item, nested)
+                }
+                value = items
+            case []interface{}:
+                items := make([]interface{}, len(v))
+                for i,item := range v {
+                    if m, ok := item.(map[string]interface{}); ok {
+                        item = SelectFields(m, nested)
+                    }
+                    items[i] = item
+                }
+                value = items
+            }
+        }
+        output[key] = value
+    }
+    return output
+}
+
 func Format(format string, p map[string]interface{}) string {
     args, i := make([]string, len(p)*2), 0
     for k, v := range p {
@@ -88,4 +134,15 @@ func Format(format string, p map[string]interface{}) string {
         i += 2
     }
     return strings.NewReplacer(args...).Replace(format)
+}
+
+/*
+ Shortens a string to at most length characters. It counts runes, so a multi-byte character is never cut in half
+ */
+func Truncate(value string, length int) string {
+    runes := []rune(value)
+    if len(runes) <= length {
+        return value
+    }
+    return string(runes[:length])
 }
\ No newline at end of file
@@ -0,0 +1,90 @@
+/*
+ SpaceDock Backend
+ API Backend for the SpaceDock infrastructure to host modfiles for various games
+
+ SpaceDock Backend is licensed under the Terms of the MIT License.
+ Copyright (c) 2017 Dorian Stoll (StollD), RockyTV
+ */
+
+package utils
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+/*
+ The length of a TOTP time step in seconds (RFC 6238)
+ */
+const TotpPeriod = 30
+
+/*
+ Generates a new random TOTP secret in base32 encoding
+ */
+func NewTotpSecret() (string, error) {
+    bytes := make([]byte, 20)
+    if _, err := rand.Read(bytes); err != nil {
+        return "", err
+    }
+    return base32.StdEncoding.EncodeToString(bytes), nil
+}
+
+/*
+ Calculates the six digit code of a secret for a time step
+ */
+func TotpCode(secret string, step int64) (string, error) {
+    key, err := base32.StdEncoding.DecodeString(strings.ToUpper(strings.Replace(secret, " ", "", -1)))
+    if err != nil {
+        return "", err
+    }
+    counter := make([]byte, 8)
+    binary.BigEndian.PutUint64(counter, uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(counter)
+    sum := mac.Sum(nil)
+    offset := sum[len(sum) - 1] & 0xf
+    value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+    return fmt.Sprintf("%06d", value % 1000000), nil
+}
+
+/*
+ Checks a code against the current time step, allowing one step of clock drift in both directions.
+ Steps up to and including last are rejected, so a code can't be used twice. Returns the matched step
+ */
+func CheckTotp(secret string, code string, last int64) (int64, bool) {
+    now := time.Now().Unix() / TotpPeriod
+    for _,step := range []int64{now - 1, now, now + 1} {
+        if step <= last {
+            continue
+        }
+        expected, err := TotpCode(secret, step)
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+/*
+ Builds the otpauth:// URI that authenticator apps read from a QR code
+ */
+func TotpURI(issuer string, account string, secret string) string {
+    query := url.Values{}
+    query.Set("secret", secret)
+    query.Set("issuer", issuer)
+    query.Set("algorithm", "SHA1")
+    query.Set("digits", "6")
+    query.Set("period", fmt.Sprint(TotpPeriod))
+    return "otpauth://totp/" + url.PathEscape(issuer + ":" + account) + "?" + query.Encode()
+}